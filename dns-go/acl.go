@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// privateNetworks are the loopback, private and link-local ranges recursion is limited to by default,
+// so a dns-go reachable from the Internet is not an open resolver
+var privateNetworks = []string{
+	"127.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16",
+	"::1/128", "fc00::/7", "fe80::/10",
+}
+
+// ACL decides which clients may use a service, by source network or by the TSIG key a request
+// is signed with. A client matching either is allowed.
+type ACL struct {
+	Any      bool
+	Networks []*net.IPNet
+	Keys     map[string]bool
+}
+
+// ParseACL parses a list of IPs, CIDRs, "key:<name>" entries naming TSIG keys, and the keywords
+// "any", "none" and "private" (loopback, private and link-local networks)
+func ParseACL(items []string) (*ACL, error) {
+	acl := &ACL{Keys: make(map[string]bool)}
+	var networks []string
+	for _, item := range items {
+		switch {
+		case item == "any":
+			acl.Any = true
+		case item == "none":
+		case item == "private":
+			networks = append(networks, privateNetworks...)
+		case strings.HasPrefix(item, "key:"):
+			name := strings.TrimPrefix(item, "key:")
+			if _, ok := dns.IsDomainName(name); !ok || name == "" {
+				return nil, fmt.Errorf("invalid TSIG key name %q", name)
+			}
+			acl.Keys[dns.CanonicalName(name)] = true
+		default:
+			networks = append(networks, item)
+		}
+	}
+	var err error
+	if acl.Networks, err = parseNetworks(networks); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// Allows reports whether the client that sent r through w is allowed. TSIG keys only count
+// when the server verified the signature.
+func (a *ACL) Allows(w dns.ResponseWriter, r *dns.Msg) bool {
+	if a.Any {
+		return true
+	}
+	if tsig := r.IsTsig(); tsig != nil && a.Keys[dns.CanonicalName(tsig.Hdr.Name)] && w.TsigStatus() == nil {
+		return true
+	}
+	return a.AllowsIP(addrIP(w.RemoteAddr()))
+}
+
+// AllowsIP reports whether a client at ip is allowed, for services that cannot carry TSIG keys
+func (a *ACL) AllowsIP(ip net.IP) bool {
+	if a.Any {
+		return true
+	}
+	for _, network := range a.Networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ACLs holds the access control lists of the services dns-go offers
+type ACLs struct {
+	// Recursion covers answers from the cache and from upstream resolvers
+	Recursion *ACL
+	// Query covers answers from the local domain and the zones dns-go is authoritative for
+	Query *ACL
+	// Update covers dynamic updates, which must be signed with a known TSIG key in any case
+	Update *ACL
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseACL(t *testing.T) {
+	tests := []struct {
+		items   []string
+		allowed []string
+		denied  []string
+	}{
+		{[]string{"any"}, []string{"198.51.100.1", "::1"}, nil},
+		{[]string{"none"}, nil, []string{"127.0.0.1", "192.168.1.1"}},
+		{[]string{"private"}, []string{"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.1.1", "::1", "fd00::1", "fe80::1"}, []string{"198.51.100.1", "172.32.0.1", "2001:db8::1"}},
+		{[]string{"192.0.2.0/24", "2001:db8::1"}, []string{"192.0.2.200", "2001:db8::1"}, []string{"192.0.3.1", "2001:db8::2"}},
+		{[]string{"127.0.0.1", "::1"}, []string{"127.0.0.1", "::1"}, []string{"127.0.0.2", "10.0.0.1"}},
+	}
+	for _, test := range tests {
+		acl, err := ParseACL(test.items)
+		if err != nil {
+			t.Fatalf("ParseACL(%v): %v", test.items, err)
+		}
+		for _, ip := range test.allowed {
+			if !acl.Allows(writerFrom(ip), new(dns.Msg)) {
+				t.Errorf("%v denies %s", test.items, ip)
+			}
+		}
+		for _, ip := range test.denied {
+			if acl.Allows(writerFrom(ip), new(dns.Msg)) {
+				t.Errorf("%v allows %s", test.items, ip)
+			}
+		}
+	}
+
+	for _, items := range [][]string{{"192.0.2.0/33"}, {"not-an-address"}, {"key:"}, {"key:bad..name"}} {
+		if _, err := ParseACL(items); err == nil {
+			t.Errorf("ParseACL(%v) succeeded, want an error", items)
+		}
+	}
+}
+
+func TestACLKeys(t *testing.T) {
+	acl, err := ParseACL([]string{"key:Updater"})
+	if err != nil {
+		t.Fatalf("ParseACL: %v", err)
+	}
+	signed := func(key string) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion("www.home.", dns.TypeA)
+		r.SetTsig(key, dns.HmacSHA256, 300, time.Now().Unix())
+		return r
+	}
+	// testWriter reports every signature as verified
+	if !acl.Allows(writerFrom("198.51.100.1"), signed("updater.")) {
+		t.Error("A request signed with a listed key was denied")
+	}
+	if acl.Allows(writerFrom("198.51.100.1"), signed("other.")) {
+		t.Error("A request signed with another key was allowed")
+	}
+	if acl.AllowsIP(nil) {
+		t.Error("A key-only ACL allows clients by address")
+	}
+}
+
+func TestACLRefused(t *testing.T) {
+	zones := NewZoneSet()
+	view := &View{Name: defaultViewName, Local: NewLocalZone("home.", NewMemoryStore(), zones), Cache: NewCacheStore(10)}
+	view.Updater = NewUpdater(view.Local, TSIGKeys{testUpdateKey.Name: testUpdateKey})
+	setRecord(t, view.Local, "www.home.", dns.TypeA, testRecord(t, "www.home. 300 IN A 192.0.2.1"))
+	setRecord(t, view.Cache, "www.example.test.", dns.TypeA, testRecord(t, "www.example.test. 300 IN A 192.0.2.2"))
+
+	// Each service is open to a network of its own
+	acl := func(network string) *ACL {
+		acl, err := ParseACL([]string{network})
+		if err != nil {
+			t.Fatalf("ParseACL: %v", err)
+		}
+		return acl
+	}
+	acls := &ACLs{Query: acl("10.0.1.0/24"), Recursion: acl("10.0.2.0/24"), Update: acl("10.0.3.0/24")}
+	transfers := NewTransfers(view.Local, zones, acl("10.0.4.0/24"), nil)
+	handler := DNSHandler(NewViewSet(view, nil), zones, transfers, acls, NewPolicies())
+
+	query := func(name string, qType uint16) func() *dns.Msg {
+		return func() *dns.Msg {
+			r := new(dns.Msg)
+			r.SetQuestion(name, qType)
+			return r
+		}
+	}
+	update := func() *dns.Msg {
+		r := new(dns.Msg)
+		r.SetUpdate("home.")
+		r.Insert([]dns.RR{mustRR(t, "new.home. 300 IN A 192.0.2.3")})
+		r.SetTsig(testUpdateKey.Name, testUpdateKey.Algorithm, 300, time.Now().Unix())
+		return r
+	}
+
+	tests := []struct {
+		service string
+		request func() *dns.Msg
+		allowed string
+	}{
+		{"query", query("www.home.", dns.TypeA), "10.0.1.1"},
+		{"recursion", query("www.example.test.", dns.TypeA), "10.0.2.1"},
+		{"transfer", query("home.", dns.TypeAXFR), "10.0.4.1"},
+		{"update", update, "10.0.3.1"},
+	}
+	for _, test := range tests {
+		for _, client := range []string{"198.51.100.1", test.allowed} {
+			w := writerFrom(client)
+			if test.service == "transfer" {
+				// Zones are only transferred over TCP
+				w.remote = &net.TCPAddr{IP: net.ParseIP(client), Port: 5353}
+			}
+			handler.ServeDNS(w, test.request())
+			refused := w.msg != nil && w.msg.Rcode == dns.RcodeRefused
+			if want := client != test.allowed; refused != want {
+				t.Errorf("%s from %s: got %v, want refused %t", test.service, client, w.msg, want)
+			}
+		}
+	}
+}
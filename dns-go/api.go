@@ -0,0 +1,393 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// apiDefaultTTL is the TTL of records created through the API without one
+const apiDefaultTTL = 300
+
+// RRset is the JSON representation of a set of records sharing a name and type. Records hold
+// the record data in master file format, e.g. "10 mail.example." for an MX record.
+type RRset struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	TTL     *uint32  `json:"ttl,omitempty"`
+	Records []string `json:"records"`
+}
+
+// apiError is the body of every error response
+type apiError struct {
+	Error string `json:"error"`
+}
+
+var (
+	// errConflict is returned when a change would clash with records already stored
+	errConflict = errors.New("conflict")
+	// errMediaType is returned for request bodies that are not JSON
+	errMediaType = errors.New("unsupported content type")
+)
+
+// API serves the versioned JSON API for managing local records under /api/v1/. Requests address
+// the default view unless they name another with ?view=. Changes go through the view's updater
+// lock so they never interleave with dynamic updates.
+type API struct {
+	views *ViewSet
+	// Allow lists the clients that may use the API without a token
+	Allow *ACL
+	// Token, if set, lets any client bearing it use the API
+	Token string
+}
+
+// NewAPI initializes and returns a new API changing the records of views for the clients in
+// allow and those bearing token
+func NewAPI(views *ViewSet, allow *ACL, token string) *API {
+	return &API{views: views, Allow: allow, Token: token}
+}
+
+// Authorized reports whether r comes from a client allowed to manage records, by address or by
+// an "Authorization: Bearer <token>" header
+func (a *API) Authorized(r *http.Request) bool {
+	if a.Allow.AllowsIP(addrIP(addrFromString(r.RemoteAddr))) {
+		return true
+	}
+	return a.Token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+a.Token)) == 1
+}
+
+// Handler returns the HTTP handler serving the API to authorized clients
+func (a *API) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/rrsets", a.list)
+	mux.HandleFunc("POST /api/v1/rrsets", a.create)
+	mux.HandleFunc("GET /api/v1/rrsets/{name}/{type}", a.get)
+	mux.HandleFunc("PUT /api/v1/rrsets/{name}/{type}", a.update)
+	mux.HandleFunc("DELETE /api/v1/rrsets/{name}/{type}", a.delete)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.Authorized(r) {
+			if a.Token == "" {
+				writeError(w, http.StatusForbidden, "not allowed from this address")
+				return
+			}
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "missing or wrong token")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// updater returns the updater of the view addressed by the request. On failure it writes the
+// error response and returns nil.
+func (a *API) updater(w http.ResponseWriter, r *http.Request) *Updater {
+	name := r.URL.Query().Get("view")
+	if name == "" {
+		return a.views.Default.Updater
+	}
+	view, ok := a.views.Get(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no such view %q", name))
+		return nil
+	}
+	return view.Updater
+}
+
+// list returns every stored RRset, or those at the name given with ?name=
+func (a *API) list(w http.ResponseWriter, r *http.Request) {
+	updater := a.updater(w, r)
+	if updater == nil {
+		return
+	}
+	filter := r.URL.Query().Get("name")
+	sets := []RRset{}
+	for _, msg := range updater.local.GetAll() {
+		if len(msg.Answer) == 0 {
+			continue
+		}
+		if filter != "" && !strings.EqualFold(msg.Answer[0].Header().Name, dns.Fqdn(filter)) {
+			continue
+		}
+		sets = append(sets, toRRset(msg.Answer))
+	}
+	slices.SortFunc(sets, func(x, y RRset) int {
+		if c := compareCanonical(x.Name, y.Name); c != 0 {
+			return c
+		}
+		return strings.Compare(x.Type, y.Type)
+	})
+	writeJSON(w, http.StatusOK, sets)
+}
+
+// get returns a single RRset
+func (a *API) get(w http.ResponseWriter, r *http.Request) {
+	updater := a.updater(w, r)
+	if updater == nil {
+		return
+	}
+	name, rrType, err := rrsetPath(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	rrs := updater.rrset(name, rrType)
+	if len(rrs) == 0 {
+		writeError(w, http.StatusNotFound, "no such RRset")
+		return
+	}
+	writeJSON(w, http.StatusOK, toRRset(rrs))
+}
+
+// create stores a new RRset, failing if one with the same name and type exists
+func (a *API) create(w http.ResponseWriter, r *http.Request) {
+	updater := a.updater(w, r)
+	if updater == nil {
+		return
+	}
+	var body RRset
+	if !readJSON(w, r, &body) {
+		return
+	}
+	name, rrType, rrs, err := parseRRset(updater, body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	updater.mu.Lock()
+	defer updater.mu.Unlock()
+	if len(updater.rrset(name, rrType)) > 0 {
+		writeError(w, http.StatusConflict, "RRset already exists, use PUT to replace it")
+		return
+	}
+	if err := checkCNAME(updater, name, rrType); err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err := updater.setRRset(name, rrType, rrs); err != nil {
+		storeFailed(w, err)
+		return
+	}
+
+	w.Header().Set("Location", rrsetURL(name, rrType))
+	writeJSON(w, http.StatusCreated, toRRset(rrs))
+}
+
+// update replaces the records of an existing RRset
+func (a *API) update(w http.ResponseWriter, r *http.Request) {
+	updater := a.updater(w, r)
+	if updater == nil {
+		return
+	}
+	name, rrType, err := rrsetPath(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var body RRset
+	if !readJSON(w, r, &body) {
+		return
+	}
+	// The name and type come from the path, the body may repeat them
+	if body.Name != "" && !strings.EqualFold(dns.Fqdn(body.Name), name) || body.Type != "" && !strings.EqualFold(body.Type, dns.TypeToString[rrType]) {
+		writeError(w, http.StatusBadRequest, "name and type in the body do not match the URL")
+		return
+	}
+	body.Name, body.Type = name, dns.TypeToString[rrType]
+	_, _, rrs, err := parseRRset(updater, body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	updater.mu.Lock()
+	defer updater.mu.Unlock()
+	if len(updater.rrset(name, rrType)) == 0 {
+		writeError(w, http.StatusNotFound, "no such RRset")
+		return
+	}
+	if err := updater.setRRset(name, rrType, rrs); err != nil {
+		storeFailed(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toRRset(rrs))
+}
+
+// delete removes an RRset
+func (a *API) delete(w http.ResponseWriter, r *http.Request) {
+	updater := a.updater(w, r)
+	if updater == nil {
+		return
+	}
+	name, rrType, err := rrsetPath(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := checkManaged(updater, name, rrType); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	updater.mu.Lock()
+	defer updater.mu.Unlock()
+	if len(updater.rrset(name, rrType)) == 0 {
+		writeError(w, http.StatusNotFound, "no such RRset")
+		return
+	}
+	if err := updater.setRRset(name, rrType, nil); err != nil {
+		storeFailed(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseRRset validates an RRset from a request body and parses its records
+func parseRRset(updater *Updater, body RRset) (string, uint16, []dns.RR, error) {
+	name, rrType, err := parseNameType(body.Name, body.Type)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	if err := checkManaged(updater, name, rrType); err != nil {
+		return "", 0, nil, err
+	}
+	if len(body.Records) == 0 {
+		return "", 0, nil, errors.New("records must not be empty, delete the RRset instead")
+	}
+	if rrType == dns.TypeCNAME && len(body.Records) > 1 {
+		return "", 0, nil, errors.New("a name can only have one CNAME record")
+	}
+	ttl := uint32(apiDefaultTTL)
+	if body.TTL != nil {
+		ttl = *body.TTL
+	}
+
+	var rrs []dns.RR
+	for _, data := range body.Records {
+		// Everything else, quoted strings included, is left to the master file parser, which reads
+		// a single record from a single line
+		if strings.ContainsAny(data, "\n\r") {
+			return "", 0, nil, fmt.Errorf("invalid record data %q", data)
+		}
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", name, ttl, dns.TypeToString[rrType], data))
+		if err != nil || rr == nil {
+			return "", 0, nil, fmt.Errorf("invalid %s record data %q: %v", dns.TypeToString[rrType], data, err)
+		}
+		if slices.ContainsFunc(rrs, func(other dns.RR) bool { return dns.IsDuplicate(other, rr) }) {
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+	return name, rrType, rrs, nil
+}
+
+// checkManaged rejects names outside the local domain and records dns-go maintains itself
+func checkManaged(updater *Updater, name string, rrType uint16) error {
+	local := updater.local
+	if !local.Contains(name) && !isReverseName(name) {
+		return fmt.Errorf("%s is not in the local domain %s or a reverse zone", name, local.Domain)
+	}
+	if name == local.Domain && (rrType == dns.TypeSOA || rrType == dns.TypeNS) {
+		return errors.New("the SOA and NS records of the local domain are managed by dns-go")
+	}
+	if name == local.Domain && rrType == dns.TypeCNAME {
+		return errors.New("the local domain cannot be a CNAME, it owns SOA and NS records")
+	}
+	switch rrType {
+	case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3, dns.TypeNSEC3PARAM:
+		return fmt.Errorf("%s records are generated by the DNSSEC signer", dns.TypeToString[rrType])
+	}
+	return nil
+}
+
+// checkCNAME rejects creating a CNAME next to other data or other data next to a CNAME (RFC 1034 section 3.6.2)
+func checkCNAME(updater *Updater, name string, rrType uint16) error {
+	types := updater.storedTypes(name)
+	switch {
+	case rrType == dns.TypeCNAME && len(types) > 0:
+		return fmt.Errorf("%w: %s already has other records", errConflict, name)
+	case rrType != dns.TypeCNAME && slices.Contains(types, dns.TypeCNAME):
+		return fmt.Errorf("%w: %s is a CNAME", errConflict, name)
+	}
+	return nil
+}
+
+// rrsetPath returns the name and type of the RRset addressed by the request path
+func rrsetPath(r *http.Request) (string, uint16, error) {
+	return parseNameType(r.PathValue("name"), r.PathValue("type"))
+}
+
+// parseNameType validates a domain name and record type given by a client
+func parseNameType(name, typeName string) (string, uint16, error) {
+	if _, ok := dns.IsDomainName(name); !ok || name == "" {
+		return "", 0, fmt.Errorf("invalid name %q", name)
+	}
+	rrType, ok := dns.StringToType[strings.ToUpper(typeName)]
+	if !ok {
+		return "", 0, fmt.Errorf("unknown record type %q", typeName)
+	}
+	if isMetaType(rrType) || rrType == dns.TypeANY {
+		return "", 0, fmt.Errorf("%s records cannot be stored", typeName)
+	}
+	return dns.CanonicalName(name), rrType, nil
+}
+
+// toRRset converts records sharing a name and type into their JSON representation
+func toRRset(rrs []dns.RR) RRset {
+	hdr := rrs[0].Header()
+	ttl := hdr.Ttl
+	set := RRset{Name: hdr.Name, Type: dns.TypeToString[hdr.Rrtype], TTL: &ttl, Records: []string{}}
+	for _, rr := range rrs {
+		// The record data is what follows the header in the presentation format
+		set.Records = append(set.Records, strings.TrimPrefix(rr.String(), rr.Header().String()))
+	}
+	return set
+}
+
+// rrsetURL returns the API path of an RRset
+func rrsetURL(name string, rrType uint16) string {
+	return "/api/v1/rrsets/" + url.PathEscape(name) + "/" + dns.TypeToString[rrType]
+}
+
+// readJSON decodes a JSON request body into v, rejecting unknown fields. On failure it writes
+// the error response and returns false.
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	if ct := r.Header.Get("Content-Type"); ct != "" && !strings.HasPrefix(ct, "application/json") {
+		writeError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("%v %q, send application/json", errMediaType, ct))
+		return false
+	}
+	decoder := json.NewDecoder(io.LimitReader(r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// writeJSON writes v as a JSON response with the given status
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes a JSON error response
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, apiError{Error: message})
+}
+
+// storeFailed logs a change the record store could not take and reports it to the client
+func storeFailed(w http.ResponseWriter, err error) {
+	log.Printf("Failed to change local records: %v", err)
+	writeError(w, http.StatusServiceUnavailable, "storing the change failed")
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseRRsetData(t *testing.T) {
+	updater := NewUpdater(NewLocalZone("home.", NewMemoryStore(), NewZoneSet()), nil)
+
+	tests := []struct {
+		rrType, data string
+		want         string // record text, or "" for data to reject
+	}{
+		{"TXT", `"v=spf1 a; mx (all)"`, "box.home.\t300\tIN\tTXT\t\"v=spf1 a; mx (all)\""},
+		{"TXT", `"two" "strings"`, "box.home.\t300\tIN\tTXT\t\"two\" \"strings\""},
+		{"MX", "10 mail.home.", "box.home.\t300\tIN\tMX\t10 mail.home."},
+		{"A", "192.0.2.1", "box.home.\t300\tIN\tA\t192.0.2.1"},
+		{"TXT", "\"first\"\nbox.home. 300 IN A 192.0.2.66", ""},
+		{"TXT", "\"first\"\rsecond", ""},
+		{"A", "192.0.2.1 192.0.2.2", ""},
+		{"TXT", `"unterminated`, ""},
+	}
+	for _, test := range tests {
+		_, _, rrs, err := parseRRset(updater, RRset{Name: "box.home.", Type: test.rrType, Records: []string{test.data}})
+		switch {
+		case test.want == "" && err == nil:
+			t.Errorf("%s %q: got %v, want an error", test.rrType, test.data, rrs)
+		case test.want != "" && (err != nil || len(rrs) != 1 || rrs[0].String() != test.want):
+			t.Errorf("%s %q: got %v, %v, want %s", test.rrType, test.data, rrs, err, test.want)
+		}
+	}
+}
+
+func TestAPIAuthorization(t *testing.T) {
+	views := NewViewSet(&View{Name: defaultViewName}, nil)
+	_, admin, _ := net.ParseCIDR("192.0.2.0/28")
+	handler := NewAPI(views, &ACL{Networks: []*net.IPNet{admin}}, "s3cret").Handler()
+
+	tests := []struct {
+		name, client, auth string
+		status             int
+	}{
+		{"allowed network", "192.0.2.5:4000", "", http.StatusOK},
+		{"token", "198.51.100.1:4000", "Bearer s3cret", http.StatusOK},
+		{"wrong token", "198.51.100.1:4000", "Bearer guess", http.StatusUnauthorized},
+		{"no token", "198.51.100.1:4000", "", http.StatusUnauthorized},
+	}
+	views.Default.Local = NewLocalZone("home.", NewMemoryStore(), NewZoneSet())
+	views.Default.Updater = NewUpdater(views.Default.Local, nil)
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/rrsets", nil)
+		r.RemoteAddr = test.client
+		if test.auth != "" {
+			r.Header.Set("Authorization", test.auth)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, w.Code, test.status)
+		}
+	}
+
+	// Without a token only the allowed networks get in
+	setRecord(t, views.Default.Local, "box.home.", dns.TypeA, testRecord(t, "box.home. 300 IN A 192.0.2.1"))
+	handler = NewAPI(views, &ACL{Networks: []*net.IPNet{admin}}, "").Handler()
+	r := httptest.NewRequest(http.MethodDelete, "/api/v1/rrsets/box.home./A", nil)
+	r.RemoteAddr = "198.51.100.1:4000"
+	r.Header.Set("Authorization", "Bearer ")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Got status %d from an unlisted network without a token configured, want %d", w.Code, http.StatusForbidden)
+	}
+	if _, ok := views.Default.Local.Get("box.home.", dns.TypeA); !ok {
+		t.Error("A refused request deleted the record")
+	}
+}
+
+// testAPI returns the API handler for a default view serving home. from a memory store,
+// open to every client
+func testAPI(t *testing.T) (http.Handler, *View, *ZoneSet) {
+	t.Helper()
+	zones := NewZoneSet()
+	view := &View{Name: defaultViewName, Local: NewLocalZone("home.", NewMemoryStore(), zones)}
+	view.Updater = NewUpdater(view.Local, nil)
+	return NewAPI(NewViewSet(view, nil), &ACL{Any: true}, "").Handler(), view, zones
+}
+
+// apiRequest sends a request with an optional JSON body to handler and returns the response
+func apiRequest(handler http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.RemoteAddr = "192.0.2.5:4000"
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestAPIRRsets(t *testing.T) {
+	handler, view, _ := testAPI(t)
+
+	steps := []struct {
+		name, method, path, body string
+		status                   int
+		records                  []string // expected in the response body, if any
+	}{
+		{"create", "POST", "/api/v1/rrsets", `{"name":"box.home.","type":"A","records":["192.0.2.1","192.0.2.2"]}`, http.StatusCreated, []string{"192.0.2.1", "192.0.2.2"}},
+		{"create existing", "POST", "/api/v1/rrsets", `{"name":"box.home.","type":"A","records":["192.0.2.3"]}`, http.StatusConflict, nil},
+		{"create next to CNAME", "POST", "/api/v1/rrsets", `{"name":"box.home.","type":"CNAME","records":["other.home."]}`, http.StatusConflict, nil},
+		{"create without records", "POST", "/api/v1/rrsets", `{"name":"empty.home.","type":"A","records":[]}`, http.StatusBadRequest, nil},
+		{"create outside the domain", "POST", "/api/v1/rrsets", `{"name":"www.example.test.","type":"A","records":["192.0.2.1"]}`, http.StatusBadRequest, nil},
+		{"create SOA", "POST", "/api/v1/rrsets", `{"name":"home.","type":"SOA","records":["ns.home. hostmaster.home. 1 2 3 4 5"]}`, http.StatusBadRequest, nil},
+		{"create bad data", "POST", "/api/v1/rrsets", `{"name":"box.home.","type":"AAAA","records":["192.0.2.1"]}`, http.StatusBadRequest, nil},
+		{"create unknown field", "POST", "/api/v1/rrsets", `{"name":"box.home.","type":"AAAA","records":["2001:db8::1"],"extra":1}`, http.StatusBadRequest, nil},
+		{"get", "GET", "/api/v1/rrsets/box.home./A", "", http.StatusOK, []string{"192.0.2.1", "192.0.2.2"}},
+		{"get without trailing dot", "GET", "/api/v1/rrsets/box.home/a", "", http.StatusOK, []string{"192.0.2.1", "192.0.2.2"}},
+		{"get missing", "GET", "/api/v1/rrsets/nope.home./A", "", http.StatusNotFound, nil},
+		{"get unknown type", "GET", "/api/v1/rrsets/box.home./BOGUS", "", http.StatusBadRequest, nil},
+		{"get unknown view", "GET", "/api/v1/rrsets/box.home./A?view=nope", "", http.StatusNotFound, nil},
+		{"replace", "PUT", "/api/v1/rrsets/box.home./A", `{"records":["192.0.2.9"]}`, http.StatusOK, []string{"192.0.2.9"}},
+		{"replace other name", "PUT", "/api/v1/rrsets/box.home./A", `{"name":"other.home.","records":["192.0.2.9"]}`, http.StatusBadRequest, nil},
+		{"replace missing", "PUT", "/api/v1/rrsets/nope.home./A", `{"records":["192.0.2.9"]}`, http.StatusNotFound, nil},
+		{"get replaced", "GET", "/api/v1/rrsets/box.home./A", "", http.StatusOK, []string{"192.0.2.9"}},
+		{"delete", "DELETE", "/api/v1/rrsets/box.home./A", "", http.StatusNoContent, nil},
+		{"delete again", "DELETE", "/api/v1/rrsets/box.home./A", "", http.StatusNotFound, nil},
+		{"get deleted", "GET", "/api/v1/rrsets/box.home./A", "", http.StatusNotFound, nil},
+	}
+	for _, step := range steps {
+		w := apiRequest(handler, step.method, step.path, step.body)
+		if w.Code != step.status {
+			t.Errorf("%s: got status %d (%s), want %d", step.name, w.Code, strings.TrimSpace(w.Body.String()), step.status)
+			continue
+		}
+		if step.records == nil {
+			continue
+		}
+		var set RRset
+		if err := json.Unmarshal(w.Body.Bytes(), &set); err != nil {
+			t.Errorf("%s: bad response body %q: %v", step.name, w.Body.String(), err)
+			continue
+		}
+		if set.Name != "box.home." || set.Type != "A" || !slices.Equal(set.Records, step.records) {
+			t.Errorf("%s: got %+v, want box.home. A %v", step.name, set, step.records)
+		}
+	}
+	if _, ok := view.Local.Get("box.home.", dns.TypeA); ok {
+		t.Error("box.home. A is still stored after it was deleted")
+	}
+
+	// Request bodies must be JSON
+	r := httptest.NewRequest("POST", "/api/v1/rrsets", strings.NewReader(`name=box.home.`))
+	r.RemoteAddr = "192.0.2.5:4000"
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Got status %d for a form body, want %d", w.Code, http.StatusUnsupportedMediaType)
+	}
+}
+
+func TestAPIChangesAnswered(t *testing.T) {
+	handler, view, zones := testAPI(t)
+	addr := serveTestView(t, view, zones)
+
+	// lookup returns the rcode and addresses dns-go answers for box.home.
+	lookup := func() (int, []string) {
+		t.Helper()
+		query := new(dns.Msg)
+		query.SetQuestion("box.home.", dns.TypeA)
+		msg, _, err := new(dns.Client).Exchange(query, addr)
+		if err != nil {
+			t.Fatalf("Exchange: %v", err)
+		}
+		var addrs []string
+		for _, rr := range msg.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				addrs = append(addrs, a.A.String())
+			}
+		}
+		return msg.Rcode, addrs
+	}
+
+	if w := apiRequest(handler, "POST", "/api/v1/rrsets", `{"name":"box.home.","type":"A","ttl":60,"records":["192.0.2.1"]}`); w.Code != http.StatusCreated {
+		t.Fatalf("Create: got status %d", w.Code)
+	}
+	if rcode, addrs := lookup(); rcode != dns.RcodeSuccess || !slices.Equal(addrs, []string{"192.0.2.1"}) {
+		t.Errorf("Got %s %v after creating box.home., want 192.0.2.1", dns.RcodeToString[rcode], addrs)
+	}
+	if w := apiRequest(handler, "PUT", "/api/v1/rrsets/box.home./A", `{"records":["192.0.2.2"]}`); w.Code != http.StatusOK {
+		t.Fatalf("Replace: got status %d", w.Code)
+	}
+	if rcode, addrs := lookup(); rcode != dns.RcodeSuccess || !slices.Equal(addrs, []string{"192.0.2.2"}) {
+		t.Errorf("Got %s %v after replacing box.home., want 192.0.2.2", dns.RcodeToString[rcode], addrs)
+	}
+	if w := apiRequest(handler, "DELETE", "/api/v1/rrsets/box.home./A", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("Delete: got status %d", w.Code)
+	}
+	if rcode, addrs := lookup(); rcode != dns.RcodeNameError {
+		t.Errorf("Got %s %v after deleting box.home., want NXDOMAIN", dns.RcodeToString[rcode], addrs)
+	}
+}
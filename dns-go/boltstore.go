@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/miekg/dns"
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltBucket is the bucket holding the records, keyed like MemoryStore
+var boltBucket = []byte("records")
+
+// BoltStore implements DNSRecordStore on a bbolt database file, so local records survive restarts.
+// Each record is stored as a packed DNS message.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore opens (or creates) the bbolt database at path and returns a BoltStore using it
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+// Get retrieves a DNS record for a given domain and query type
+func (s *BoltStore) Get(domain string, qType uint16) (*dns.Msg, bool) {
+	var msg *dns.Msg
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltBucket).Get([]byte(key(domain, qType)))
+		if data == nil {
+			return nil
+		}
+		var err error
+		msg, err = unpackRecord(data)
+		return err
+	})
+	if err != nil {
+		log.Printf("Failed to read %s %s from %s: %v", domain, dns.TypeToString[qType], s.db.Path(), err)
+		return nil, false
+	}
+	return msg, msg != nil
+}
+
+// Set stores a DNS record for a given domain and query type
+func (s *BoltStore) Set(domain string, qType uint16, msg *dns.Msg) error {
+	data, err := msg.Pack()
+	if err == nil {
+		err = s.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(boltBucket).Put([]byte(key(domain, qType)), data)
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("storing %s %s in %s: %w", domain, dns.TypeToString[qType], s.db.Path(), err)
+	}
+	return nil
+}
+
+// Delete removes the DNS record for a given domain and query type
+func (s *BoltStore) Delete(domain string, qType uint16) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(key(domain, qType)))
+	})
+	if err != nil {
+		return fmt.Errorf("deleting %s %s from %s: %w", domain, dns.TypeToString[qType], s.db.Path(), err)
+	}
+	return nil
+}
+
+// GetAll retrieves all stored DNS records
+func (s *BoltStore) GetAll() map[string]*dns.Msg {
+	records := make(map[string]*dns.Msg)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).ForEach(func(k, data []byte) error {
+			msg, err := unpackRecord(data)
+			if err != nil {
+				return fmt.Errorf("%s: %w", k, err)
+			}
+			records[string(k)] = msg
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("Failed to read records from %s: %v", s.db.Path(), err)
+	}
+	return records
+}
+
+// Close closes the database
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// unpackRecord decodes a record stored by a persistent store
+func unpackRecord(data []byte) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(data); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxCacheTTL caps how long any upstream answer is kept, regardless of its TTL
+const maxCacheTTL = 24 * time.Hour
+
+// Entries are prefetched when a hit finds less than prefetchWindow of their TTL left, as long as
+// the TTL is at least minPrefetchTTL so short-lived answers do not keep the upstreams busy
+const (
+	prefetchWindow = 0.1
+	minPrefetchTTL = 10 * time.Second
+)
+
+// staleTTL is the TTL of stale answers, as recommended by RFC 8767 section 4
+const staleTTL = 30
+
+// CacheStore implements DNSRecordStore as a TTL-aware LRU cache for upstream answers
+type CacheStore struct {
+	// Prefetch, if set, is called in its own goroutine to refresh a popular entry shortly before
+	// it expires; it should resolve the name again and Set the answer
+	Prefetch func(domain string, qType uint16)
+	// PrefetchHits is how many hits make an entry popular enough to prefetch
+	PrefetchHits int
+	// StaleWindow is how long entries are kept after they expire, to be served by GetStale
+	// when the upstreams cannot be reached (RFC 8767)
+	StaleWindow time.Duration
+	// StaleAnswerTimeout is how long a query with a stale answer to fall back on waits for the
+	// upstreams before it gets the stale answer, the client response timer of RFC 8767 section 5
+	StaleAnswerTimeout time.Duration
+	// StaleRecheck is how long stale answers are served without asking the upstreams again after
+	// they failed to resolve a name, the failure recheck timer of RFC 8767 section 5
+	StaleRecheck time.Duration
+
+	mu      sync.Mutex
+	maxSize int
+	entries map[string]*list.Element
+	lru     *list.List
+	failed  map[string]time.Time // when resolving each key last failed, within StaleRecheck
+	now     func() time.Time
+}
+
+// cacheEntry is a cached message together with the time it was stored and when it expires
+type cacheEntry struct {
+	key     string
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+
+	hits        int
+	prefetching bool
+}
+
+// NewCacheStore initializes and returns a new CacheStore holding at most maxSize entries.
+// A maxSize of zero or less disables the size limit.
+func NewCacheStore(maxSize int) *CacheStore {
+	return &CacheStore{
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		failed:  make(map[string]time.Time),
+		now:     time.Now,
+	}
+}
+
+// Get retrieves a cached message with its TTLs decremented by the time spent in the cache.
+// Expired entries are evicted and reported as a miss.
+func (c *CacheStore) Get(domain string, qType uint16) (*dns.Msg, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key(domain, qType)]
+	if !ok {
+		cacheLookups.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	now := c.now()
+	if !now.Before(entry.expires) {
+		if !now.Before(entry.expires.Add(c.StaleWindow)) {
+			c.remove(elem)
+			cacheEvictions.WithLabelValues("expired").Inc()
+		}
+		cacheLookups.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+	cacheLookups.WithLabelValues("hit").Inc()
+	c.lru.MoveToFront(elem)
+	entry.hits++
+	if c.Prefetch != nil && c.PrefetchHits > 0 && entry.hits >= c.PrefetchHits && !entry.prefetching {
+		ttl := entry.expires.Sub(entry.stored)
+		if ttl >= minPrefetchTTL && entry.expires.Sub(now) < time.Duration(float64(ttl)*prefetchWindow) {
+			entry.prefetching = true
+			cachePrefetches.Inc()
+			go func() {
+				c.Prefetch(domain, qType)
+				c.prefetched(entry)
+			}()
+		}
+	}
+	return agedCopy(entry.msg, now.Sub(entry.stored)), true
+}
+
+// prefetched allows entry to be prefetched again. A successful prefetch has already replaced it,
+// but one that failed must not keep the name from being refreshed on later hits.
+func (c *CacheStore) prefetched(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry.prefetching = false
+}
+
+// HasStale reports whether GetStale has a message for a given domain and query type
+func (c *CacheStore) HasStale(domain string, qType uint16) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key(domain, qType)]
+	return ok && c.now().Before(elem.Value.(*cacheEntry).expires.Add(c.StaleWindow))
+}
+
+// Failed records that the upstreams failed to resolve a given domain and query type, so
+// RecentlyFailed reports it until StaleRecheck has passed or a new answer is Set
+func (c *CacheStore) Failed(domain string, qType uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failed[key(domain, qType)] = c.now()
+}
+
+// RecentlyFailed reports whether the upstreams failed to resolve a given domain and query type
+// less than StaleRecheck ago
+func (c *CacheStore) RecentlyFailed(domain string, qType uint16) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	failed, ok := c.failed[key(domain, qType)]
+	return ok && c.now().Before(failed.Add(c.StaleRecheck))
+}
+
+// GetStale retrieves a cached message that expired less than StaleWindow ago, with every TTL
+// set to staleTTL. It is the answer of last resort when the upstreams fail.
+func (c *CacheStore) GetStale(domain string, qType uint16) (*dns.Msg, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key(domain, qType)]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !c.now().Before(entry.expires.Add(c.StaleWindow)) {
+		return nil, false
+	}
+	cacheLookups.WithLabelValues("stale").Inc()
+	msg := entry.msg.Copy()
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if hdr := rr.Header(); hdr.Rrtype != dns.TypeOPT {
+				hdr.Ttl = min(hdr.Ttl, staleTTL)
+			}
+		}
+	}
+	return msg, true
+}
+
+// Set caches a message for as long as its TTL allows (see cacheTTL).
+// Messages with a TTL of zero are not cached, but clear a failure recorded by Failed all the same.
+// It never fails.
+func (c *CacheStore) Set(domain string, qType uint16, msg *dns.Msg) error {
+	ttl := cacheTTL(msg)
+	if ttl <= 0 {
+		c.mu.Lock()
+		delete(c.failed, key(domain, qType))
+		c.mu.Unlock()
+		return nil
+	}
+
+	stored := msg.Copy()
+	if len(stored.Answer) == 0 {
+		// The SOA of a negative answer must not outlive the negative entry itself
+		for _, rr := range stored.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				soa.Hdr.Ttl = uint32(ttl / time.Second)
+			}
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	delete(c.failed, key(domain, qType))
+	entry := &cacheEntry{
+		key:     key(domain, qType),
+		msg:     stored,
+		stored:  now,
+		expires: now.Add(ttl),
+	}
+	if elem, ok := c.entries[entry.key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return nil
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	cacheEntries.Inc()
+
+	for c.maxSize > 0 && c.lru.Len() > c.maxSize {
+		c.remove(c.lru.Back())
+		cacheEvictions.WithLabelValues("capacity").Inc()
+	}
+	return nil
+}
+
+// Delete evicts the cached message for a given domain and query type. It never fails.
+func (c *CacheStore) Delete(domain string, qType uint16) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key(domain, qType)]; ok {
+		c.remove(elem)
+	}
+	return nil
+}
+
+// GetAll retrieves a snapshot of all unexpired cache entries with their remaining TTLs
+func (c *CacheStore) GetAll() map[string]*dns.Msg {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	records := make(map[string]*dns.Msg, len(c.entries))
+	for k, elem := range c.entries {
+		entry := elem.Value.(*cacheEntry)
+		if now.Before(entry.expires) {
+			records[k] = agedCopy(entry.msg, now.Sub(entry.stored))
+		}
+	}
+	return records
+}
+
+// Len returns the number of entries currently held, including expired ones not yet evicted
+func (c *CacheStore) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// EvictExpired removes every entry from the cache that expired more than StaleWindow ago, and
+// forgets failures older than StaleRecheck
+func (c *CacheStore) EvictExpired() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for _, elem := range c.entries {
+		if !now.Before(elem.Value.(*cacheEntry).expires.Add(c.StaleWindow)) {
+			c.remove(elem)
+			cacheEvictions.WithLabelValues("expired").Inc()
+		}
+	}
+	for k, failed := range c.failed {
+		if !now.Before(failed.Add(c.StaleRecheck)) {
+			delete(c.failed, k)
+		}
+	}
+}
+
+// RunJanitor periodically evicts expired entries so unused names do not linger until pushed out by the LRU
+func (c *CacheStore) RunJanitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.EvictExpired()
+	}
+}
+
+func (c *CacheStore) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+	cacheEntries.Dec()
+}
+
+// cacheTTL returns how long msg may be cached, capped at maxCacheTTL.
+// Positive answers live for the lowest TTL among their records; NXDOMAIN and
+// NODATA answers follow RFC 2308 and use the SOA in the authority section.
+func cacheTTL(msg *dns.Msg) time.Duration {
+	switch {
+	case msg.Rcode == dns.RcodeNameError, msg.Rcode == dns.RcodeSuccess && len(msg.Answer) == 0:
+		return negativeTTL(msg)
+	case msg.Rcode != dns.RcodeSuccess:
+		return 0
+	}
+
+	minTTL := uint32(maxCacheTTL / time.Second)
+	found := false
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			found = true
+			if rr.Header().Ttl < minTTL {
+				minTTL = rr.Header().Ttl
+			}
+		}
+	}
+	if !found {
+		return 0
+	}
+	return time.Duration(minTTL) * time.Second
+}
+
+// negativeTTL returns the RFC 2308 negative caching TTL of msg, which is the lower
+// of the SOA record's own TTL and its MINIMUM field. Negative answers without an
+// SOA must not be cached and yield zero.
+func negativeTTL(msg *dns.Msg) time.Duration {
+	for _, rr := range msg.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+		ttl := min(soa.Hdr.Ttl, soa.Minttl, uint32(maxCacheTTL/time.Second))
+		return time.Duration(ttl) * time.Second
+	}
+	return 0
+}
+
+// agedCopy returns a copy of msg with every TTL reduced by the given age
+func agedCopy(msg *dns.Msg, age time.Duration) *dns.Msg {
+	out := msg.Copy()
+	elapsed := uint32(age / time.Second)
+	for _, section := range [][]dns.RR{out.Answer, out.Ns, out.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if hdr.Ttl > elapsed {
+				hdr.Ttl -= elapsed
+			} else {
+				hdr.Ttl = 0
+			}
+		}
+	}
+	return out
+}
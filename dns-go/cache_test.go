@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testCache returns a CacheStore holding at most maxSize entries on a clock that only moves
+// when the test moves it
+func testCache(maxSize int) (*CacheStore, *time.Time) {
+	cache := NewCacheStore(maxSize)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	return cache, &now
+}
+
+// cachedTTL returns the TTL of the first answer cached for name, or -1 on a miss
+func cachedTTL(cache *CacheStore, name string) int {
+	msg, ok := cache.Get(name, dns.TypeA)
+	if !ok {
+		return -1
+	}
+	return int(msg.Answer[0].Header().Ttl)
+}
+
+func TestAgedCopy(t *testing.T) {
+	msg := testRecord(t, "www.example.test. 300 IN A 192.0.2.1")
+	msg.Ns = []dns.RR{mustRR(t, "example.test. 60 IN NS ns.example.test.")}
+	msg.SetEdns0(1232, true)
+
+	tests := []struct {
+		age          time.Duration
+		answer, auth uint32
+	}{
+		{0, 300, 60},
+		{999 * time.Millisecond, 300, 60},
+		{time.Second, 299, 59},
+		{100 * time.Second, 200, 0},
+		{time.Hour, 0, 0},
+	}
+	for _, test := range tests {
+		aged := agedCopy(msg, test.age)
+		if answer, auth := aged.Answer[0].Header().Ttl, aged.Ns[0].Header().Ttl; answer != test.answer || auth != test.auth {
+			t.Errorf("Aged %v: got TTLs %d and %d, want %d and %d", test.age, answer, auth, test.answer, test.auth)
+		}
+		if opt := aged.IsEdns0(); opt == nil || opt.UDPSize() != 1232 {
+			t.Errorf("Aged %v: the OPT record was changed to %v", test.age, opt)
+		}
+	}
+	if ttl := msg.Answer[0].Header().Ttl; ttl != 300 {
+		t.Errorf("agedCopy changed the original to TTL %d", ttl)
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	tests := []struct {
+		name   string
+		record string
+		age    time.Duration
+		ttl    int // -1 for a miss
+	}{
+		{"fresh", "www.example.test. 300 IN A 192.0.2.1", 0, 300},
+		{"aged", "www.example.test. 300 IN A 192.0.2.1", 120 * time.Second, 180},
+		{"last second", "www.example.test. 300 IN A 192.0.2.1", 299 * time.Second, 1},
+		{"expired", "www.example.test. 300 IN A 192.0.2.1", 300 * time.Second, -1},
+		{"below the cap", "www.example.test. 172800 IN A 192.0.2.1", maxCacheTTL - time.Second, 172800 - int(maxCacheTTL/time.Second) + 1},
+		{"capped", "www.example.test. 172800 IN A 192.0.2.1", maxCacheTTL, -1},
+		{"zero TTL", "www.example.test. 0 IN A 192.0.2.1", 0, -1},
+	}
+	for _, test := range tests {
+		cache, now := testCache(10)
+		setRecord(t, cache, "www.example.test.", dns.TypeA, testRecord(t, test.record))
+		*now = now.Add(test.age)
+		if ttl := cachedTTL(cache, "www.example.test."); ttl != test.ttl {
+			t.Errorf("%s: got TTL %d after %v, want %d", test.name, ttl, test.age, test.ttl)
+		}
+		if _, ok := cache.GetAll()[key("www.example.test.", dns.TypeA)]; ok != (test.ttl >= 0) {
+			t.Errorf("%s: GetAll holds the entry: %t, want %t", test.name, ok, test.ttl >= 0)
+		}
+	}
+}
+
+func TestCacheEvictExpired(t *testing.T) {
+	cache, now := testCache(10)
+	cache.StaleWindow = time.Hour
+	setRecord(t, cache, "short.example.test.", dns.TypeA, testRecord(t, "short.example.test. 60 IN A 192.0.2.1"))
+	setRecord(t, cache, "long.example.test.", dns.TypeA, testRecord(t, "long.example.test. 7200 IN A 192.0.2.2"))
+
+	// Expired entries stay for the stale window, served only as stale answers
+	*now = now.Add(time.Minute)
+	cache.EvictExpired()
+	if cache.Len() != 2 {
+		t.Fatalf("Got %d entries within the stale window, want 2", cache.Len())
+	}
+	if msg, ok := cache.GetStale("short.example.test.", dns.TypeA); !ok || msg.Answer[0].Header().Ttl != staleTTL {
+		t.Errorf("Got %v as the stale answer, want the record with TTL %d", msg, staleTTL)
+	}
+
+	*now = now.Add(time.Hour)
+	cache.EvictExpired()
+	if cache.Len() != 1 || cachedTTL(cache, "long.example.test.") < 0 {
+		t.Errorf("Got %d entries after the stale window, want just the unexpired one", cache.Len())
+	}
+	if _, ok := cache.GetStale("short.example.test.", dns.TypeA); ok {
+		t.Error("Got a stale answer after the stale window")
+	}
+}
+
+func TestCacheLRU(t *testing.T) {
+	cache, _ := testCache(2)
+	set := func(name string) {
+		setRecord(t, cache, name, dns.TypeA, testRecord(t, name+" 300 IN A 192.0.2.1"))
+	}
+
+	set("a.example.test.")
+	set("b.example.test.")
+	// Using a makes b the least recently used entry, which the third one pushes out
+	cachedTTL(cache, "a.example.test.")
+	set("c.example.test.")
+	if cache.Len() != 2 {
+		t.Fatalf("Got %d entries, want at most 2", cache.Len())
+	}
+	for name, cached := range map[string]bool{"a.example.test.": true, "b.example.test.": false, "c.example.test.": true} {
+		if got := cachedTTL(cache, name) >= 0; got != cached {
+			t.Errorf("%s cached: %t, want %t", name, got, cached)
+		}
+	}
+
+	// Replacing an entry does not count against the size
+	set("c.example.test.")
+	if cache.Len() != 2 || cachedTTL(cache, "a.example.test.") < 0 {
+		t.Errorf("Replacing an entry evicted another")
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	soa := "example.test. %d IN SOA ns.example.test. hostmaster.example.test. 1 3600 600 86400 %d"
+	tests := []struct {
+		name   string
+		rcode  int
+		answer []string
+		auth   []string
+		ttl    time.Duration
+	}{
+		{"answer", dns.RcodeSuccess, []string{"www.example.test. 300 IN A 192.0.2.1", "www.example.test. 60 IN A 192.0.2.2"}, nil, time.Minute},
+		{"answer and authority", dns.RcodeSuccess, []string{"www.example.test. 300 IN A 192.0.2.1"}, []string{"example.test. 30 IN NS ns.example.test."}, 30 * time.Second},
+		{"NXDOMAIN under SOA minimum", dns.RcodeNameError, nil, []string{fmt.Sprintf(soa, 30, 600)}, 30 * time.Second},
+		{"NXDOMAIN over SOA minimum", dns.RcodeNameError, nil, []string{fmt.Sprintf(soa, 3600, 60)}, time.Minute},
+		{"NODATA", dns.RcodeSuccess, nil, []string{fmt.Sprintf(soa, 3600, 120)}, 2 * time.Minute},
+		{"NXDOMAIN capped", dns.RcodeNameError, nil, []string{fmt.Sprintf(soa, 1<<30, 1<<30)}, maxCacheTTL},
+		{"NXDOMAIN without SOA", dns.RcodeNameError, nil, nil, 0},
+		{"NODATA without SOA", dns.RcodeSuccess, nil, []string{"example.test. 3600 IN NS ns.example.test."}, 0},
+		{"SERVFAIL", dns.RcodeServerFailure, nil, []string{fmt.Sprintf(soa, 3600, 60)}, 0},
+		{"REFUSED", dns.RcodeRefused, nil, nil, 0},
+	}
+
+	for _, test := range tests {
+		msg := new(dns.Msg)
+		msg.SetQuestion("www.example.test.", dns.TypeA)
+		msg.Rcode = test.rcode
+		for _, record := range test.answer {
+			msg.Answer = append(msg.Answer, mustRR(t, record))
+		}
+		for _, record := range test.auth {
+			msg.Ns = append(msg.Ns, mustRR(t, record))
+		}
+		if ttl := cacheTTL(msg); ttl != test.ttl {
+			t.Errorf("%s: got TTL %v, want %v", test.name, ttl, test.ttl)
+		}
+
+		// What may not be cached passes through without being stored
+		cache, _ := testCache(10)
+		setRecord(t, cache, "www.example.test.", dns.TypeA, msg)
+		cached, ok := cache.Get("www.example.test.", dns.TypeA)
+		if ok != (test.ttl > 0) {
+			t.Errorf("%s: cached %t, want %t", test.name, ok, test.ttl > 0)
+			continue
+		}
+		if ok && cached.Rcode != test.rcode {
+			t.Errorf("%s: got %s from the cache, want %s", test.name, dns.RcodeToString[cached.Rcode], dns.RcodeToString[test.rcode])
+		}
+		// The SOA of a cached negative answer carries the negative TTL
+		if ok && len(test.answer) == 0 {
+			if ttl := cached.Ns[0].Header().Ttl; time.Duration(ttl)*time.Second != test.ttl {
+				t.Errorf("%s: got SOA TTL %d from the cache, want %v", test.name, ttl, test.ttl)
+			}
+		}
+	}
+}
+
+func TestCachePrefetch(t *testing.T) {
+	cache, now := testCache(10)
+	cache.PrefetchHits = 3
+	started := make(chan string, 10)
+	release := make(chan struct{})
+	// The prefetch never stores a fresh answer, as when the upstreams fail
+	cache.Prefetch = func(domain string, qType uint16) {
+		started <- domain
+		<-release
+	}
+	prefetches := func() float64 { return testutil.ToFloat64(cachePrefetches) }
+	cache.Set("www.example.test.", dns.TypeA, testRecord(t, "www.example.test. 100 IN A 192.0.2.1"))
+	cache.Set("short.example.test.", dns.TypeA, testRecord(t, "short.example.test. 5 IN A 192.0.2.2"))
+	before := prefetches()
+
+	// Popular entries are not prefetched until they are about to expire, and short-lived ones never are
+	for range 5 {
+		cache.Get("www.example.test.", dns.TypeA)
+	}
+	*now = now.Add(4900 * time.Millisecond)
+	for range 5 {
+		cache.Get("short.example.test.", dns.TypeA)
+	}
+	if got := prefetches() - before; got != 0 {
+		t.Fatalf("Prefetched %v times outside the prefetch window", got)
+	}
+
+	// Within the last tenth of the TTL, a hit prefetches once until that prefetch is done
+	*now = now.Add(90 * time.Second)
+	cache.Get("www.example.test.", dns.TypeA)
+	select {
+	case domain := <-started:
+		if domain != "www.example.test." {
+			t.Errorf("Prefetched %s", domain)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Prefetch not started")
+	}
+	cache.Get("www.example.test.", dns.TypeA)
+	if got := prefetches() - before; got != 1 {
+		t.Fatalf("Prefetched %v times while a prefetch was running, want 1", got)
+	}
+
+	// A failed prefetch is retried on a later hit
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for prefetches()-before < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("Failed prefetch not retried")
+		}
+		time.Sleep(time.Millisecond)
+		cache.Get("www.example.test.", dns.TypeA)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config holds the dns-go settings that can be read from a JSON file given with -config.
+// Flags set explicitly on the command line take precedence over values from the file.
+type Config struct {
+	LocalDomain          string         `json:"local_domain"`
+	SynthesizePTR        *bool          `json:"synthesize_ptr"`
+	CacheSize            *int           `json:"cache_size"`
+	PrefetchHits         *int           `json:"prefetch_hits"`
+	ServeStale           Duration       `json:"serve_stale"`
+	StaleAnswerTimeout   Duration       `json:"stale_answer_timeout"`
+	StaleRecheck         Duration       `json:"stale_recheck"`
+	ECS                  string         `json:"ecs"`
+	Upstreams            []string       `json:"upstreams"`
+	UpstreamPolicy       string         `json:"upstream_policy"`
+	UpstreamTimeout      Duration       `json:"upstream_timeout"`
+	HealthCheckInterval  Duration       `json:"health_check_interval"`
+	ForwardZones         ForwardZones   `json:"forward_zones"`
+	Zones                ZoneFiles      `json:"zones"`
+	Secondaries          SecondaryZones `json:"secondaries"`
+	AllowTransfer        []string       `json:"allow_transfer"`
+	AllowRecursion       []string       `json:"allow_recursion"`
+	AllowQuery           []string       `json:"allow_query"`
+	AllowUpdate          []string       `json:"allow_update"`
+	AllowAPI             []string       `json:"allow_api"`
+	APIToken             string         `json:"api_token"`
+	RateLimitResponses   *float64       `json:"rate_limit_responses"`
+	RateLimitQueries     *float64       `json:"rate_limit_queries"`
+	RateLimitBurst       *float64       `json:"rate_limit_burst"`
+	RateLimitSlip        *int           `json:"rate_limit_slip"`
+	RateLimitExempt      []string       `json:"rate_limit_exempt"`
+	RPZ                  []string       `json:"rpz"`
+	Blocklists           []string       `json:"blocklists"`
+	PolicyReloadInterval Duration       `json:"policy_reload_interval"`
+	Dnstap               string         `json:"dnstap"`
+	Verbose              bool           `json:"verbose"`
+	Notify               []string       `json:"notify"`
+	TSIGKeys             []string       `json:"tsig_keys"`
+	DoTListen            string         `json:"dot_listen"`
+	DoHListen            string         `json:"doh_listen"`
+	TLSCert              string         `json:"tls_cert"`
+	TLSKey               string         `json:"tls_key"`
+	TLSDir               string         `json:"tls_dir"`
+	TLSHost              string         `json:"tls_host"`
+	DNSSEC               bool           `json:"dnssec"`
+	DNSSECKeyDir         string         `json:"dnssec_key_dir"`
+	DNSSECAlgorithm      string         `json:"dnssec_algorithm"`
+	DNSSECDenial         string         `json:"dnssec_denial"`
+	DNSSECValidate       bool           `json:"dnssec_validate"`
+	TrustAnchor          string         `json:"trust_anchor"`
+	Recursive            bool           `json:"recursive"`
+	RootHints            string         `json:"root_hints"`
+	Store                string         `json:"store"`
+	StorePath            string         `json:"store_path"`
+	EtcdEndpoints        []string       `json:"etcd_endpoints"`
+	EtcdPrefix           string         `json:"etcd_prefix"`
+	Views                []ViewConfig   `json:"views"`
+	ViewClientSubnet     bool           `json:"view_client_subnet"`
+	TrustedForwarders    []string       `json:"trusted_forwarders"`
+}
+
+// Duration is a time.Duration that is written as a string such as "2s" in the config file
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// LoadConfig reads the JSON config file at path
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := new(Config)
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
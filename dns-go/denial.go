@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// maxNSEC3Iterations is the most extra NSEC3 hash iterations a proof may use; answers relying on
+// costlier hashes are treated as insecure rather than checked (RFC 9276 section 3.2)
+const maxNSEC3Iterations = 150
+
+// nsec3OptOut is the NSEC3 flag marking spans that may hide unsigned delegations (RFC 5155 section 3.1.2.1)
+const nsec3OptOut = 1
+
+// checkDenial checks that the NSEC or NSEC3 records in ns, already validated, prove that name does
+// not exist (nxdomain) or has no qType records, and that no wildcard could have answered instead
+// (RFC 4035 section 5.4, RFC 5155 section 8). It reports whether the proof is secure; proofs
+// resting on opt-out spans or on costly hashes are sound but insecure.
+func checkDenial(ns []dns.RR, name string, qType uint16, nxdomain bool) (bool, error) {
+	nsecs, nsec3s := denialRecords(ns)
+	switch {
+	case len(nsecs) > 0:
+		return true, checkNSECDenial(nsecs, name, qType, nxdomain)
+	case len(nsec3s) > 0:
+		if costlyNSEC3(nsec3s) {
+			return false, nil
+		}
+		return checkNSEC3Denial(nsec3s, name, qType, nxdomain)
+	}
+	return false, noProof(name, qType, nxdomain)
+}
+
+// checkNSECDenial does the work of checkDenial for NSEC records
+func checkNSECDenial(nsecs []*dns.NSEC, name string, qType uint16, nxdomain bool) error {
+	if !nxdomain {
+		if rr := matchingNSEC(nsecs, name); rr != nil {
+			return checkTypeAbsent(rr.TypeBitMap, name, qType)
+		}
+	}
+	cover := coveringNSEC(nsecs, name)
+	if cover == nil {
+		return noProof(name, qType, nxdomain)
+	}
+	if !nxdomain && dns.IsSubDomain(name, dns.CanonicalName(cover.NextDomain)) {
+		// name is an empty non-terminal: it has no NSEC of its own, but a name below it follows it
+		return nil
+	}
+
+	wildcard := wildcardName(nsecClosestEncloser(cover, name))
+	if nxdomain {
+		if coveringNSEC(nsecs, wildcard) == nil {
+			return fmt.Errorf("%w: no proof that no wildcard answers for %s", errBogus, name)
+		}
+		return nil
+	}
+	// NODATA from a wildcard: it exists, but without qType records
+	if rr := matchingNSEC(nsecs, wildcard); rr != nil {
+		return checkTypeAbsent(rr.TypeBitMap, wildcard, qType)
+	}
+	return noProof(name, qType, nxdomain)
+}
+
+// checkNSEC3Denial does the work of checkDenial for NSEC3 records
+func checkNSEC3Denial(nsec3s []*dns.NSEC3, name string, qType uint16, nxdomain bool) (bool, error) {
+	if !nxdomain {
+		if rr := matchingNSEC3(nsec3s, name); rr != nil {
+			return true, checkTypeAbsent(rr.TypeBitMap, name, qType)
+		}
+	}
+	ce, nextCloser, err := nsec3ClosestEncloser(nsec3s, name)
+	if err != nil {
+		return false, err
+	}
+	// An opt-out span may hide an unsigned delegation at the next closer name, making the proof insecure
+	optOut := nextCloser.Flags&nsec3OptOut != 0
+
+	wildcard := wildcardName(ce)
+	switch {
+	case nxdomain:
+		if coveringNSEC3(nsec3s, wildcard) == nil {
+			return false, fmt.Errorf("%w: no proof that no wildcard answers for %s", errBogus, name)
+		}
+		return !optOut, nil
+	case qType == dns.TypeDS:
+		// Only opt-out spans may leave out a delegation, which is then unsigned (RFC 5155 section 8.6)
+		if !optOut {
+			return false, noProof(name, qType, nxdomain)
+		}
+		return false, nil
+	}
+	// NODATA from a wildcard: it exists, but without qType records (RFC 5155 section 8.7)
+	if rr := matchingNSEC3(nsec3s, wildcard); rr != nil {
+		return !optOut, checkTypeAbsent(rr.TypeBitMap, wildcard, qType)
+	}
+	return false, noProof(name, qType, nxdomain)
+}
+
+// checkWildcardAnswer checks that ns proves name does not exist itself, so the wildcard with the
+// given number of labels that answered for it was entitled to (RFC 4035 section 5.3.4, RFC 5155
+// section 8.8). It reports whether the proof is secure, like checkDenial.
+func checkWildcardAnswer(ns []dns.RR, name string, labels int) (bool, error) {
+	encloser := ancestorWithLabels(name, labels)
+	nsecs, nsec3s := denialRecords(ns)
+	switch {
+	case len(nsecs) > 0:
+		// The NSEC covering name must also show that no name between it and the wildcard exists
+		if cover := coveringNSEC(nsecs, name); cover != nil && nsecClosestEncloser(cover, name) == encloser {
+			return true, nil
+		}
+	case len(nsec3s) > 0:
+		if costlyNSEC3(nsec3s) {
+			return false, nil
+		}
+		if cover := coveringNSEC3(nsec3s, ancestorWithLabels(name, labels+1)); cover != nil {
+			return cover.Flags&nsec3OptOut == 0, nil
+		}
+	}
+	return false, fmt.Errorf("%w: no proof that %s, answered from a wildcard, does not exist", errBogus, name)
+}
+
+// wildcardLabels returns the number of labels of the wildcard rrset was expanded from, as told by
+// the signatures over it, and whether it was expanded from one at all (RFC 4035 section 5.3.2)
+func wildcardLabels(rrset []dns.RR, sigs []*dns.RRSIG) (int, bool) {
+	owner := rrset[0].Header().Name
+	labels := dns.CountLabel(owner)
+	if strings.HasPrefix(owner, "*.") {
+		// The wildcard itself, asked for by name
+		labels--
+	}
+	for _, sig := range sigs {
+		if int(sig.Labels) < labels {
+			return int(sig.Labels), true
+		}
+	}
+	return 0, false
+}
+
+// checkTypeAbsent checks that the type bitmap of the NSEC or NSEC3 record for name proves that it
+// has no qType records, and that the record speaks for that data: the parent side of a zone cut
+// only vouches for the DS records there, the child side for everything else
+func checkTypeAbsent(types []uint16, name string, qType uint16) error {
+	rrType := dns.TypeToString[qType]
+	switch {
+	case slices.Contains(types, qType) || slices.Contains(types, dns.TypeCNAME):
+		return fmt.Errorf("%w: the denial of %s %s lists it as present", errBogus, name, rrType)
+	case qType == dns.TypeDS && slices.Contains(types, dns.TypeSOA) && name != ".":
+		return fmt.Errorf("%w: the DS of %s is denied by its own zone", errBogus, name)
+	case qType != dns.TypeDS && slices.Contains(types, dns.TypeNS) && !slices.Contains(types, dns.TypeSOA):
+		return fmt.Errorf("%w: %s %s is denied by the parent side of a delegation", errBogus, name, rrType)
+	}
+	return nil
+}
+
+// nsec3ClosestEncloser finds the closest encloser of name proven by nsec3s (RFC 5155 section 8.3):
+// the longest ancestor with a matching NSEC3 whose child towards name, the next closer name, is
+// covered. It returns the encloser and the NSEC3 covering the next closer name.
+func nsec3ClosestEncloser(nsec3s []*dns.NSEC3, name string) (string, *dns.NSEC3, error) {
+	for nextCloser := name; nextCloser != "."; nextCloser = parentName(nextCloser) {
+		encloser := parentName(nextCloser)
+		rr := matchingNSEC3(nsec3s, encloser)
+		if rr == nil {
+			continue
+		}
+		if slices.Contains(rr.TypeBitMap, dns.TypeDNAME) ||
+			slices.Contains(rr.TypeBitMap, dns.TypeNS) && !slices.Contains(rr.TypeBitMap, dns.TypeSOA) {
+			return "", nil, fmt.Errorf("%w: the closest encloser of %s is a delegation or DNAME", errBogus, name)
+		}
+		cover := coveringNSEC3(nsec3s, nextCloser)
+		if cover == nil {
+			return "", nil, fmt.Errorf("%w: no NSEC3 covers %s, the next closer name of %s", errBogus, nextCloser, name)
+		}
+		return encloser, cover, nil
+	}
+	return "", nil, fmt.Errorf("%w: no proof of the closest encloser of %s", errBogus, name)
+}
+
+// nsecClosestEncloser returns the closest encloser of name proven by the NSEC covering it: the
+// longest ancestor name shares with either end of its span (RFC 4035 section 5.4)
+func nsecClosestEncloser(cover *dns.NSEC, name string) string {
+	common := max(dns.CompareDomainName(name, cover.Hdr.Name), dns.CompareDomainName(name, cover.NextDomain))
+	return ancestorWithLabels(name, common)
+}
+
+// denialRecords returns the NSEC and NSEC3 records in rrs
+func denialRecords(rrs []dns.RR) ([]*dns.NSEC, []*dns.NSEC3) {
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, rr)
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, rr)
+		}
+	}
+	return nsecs, nsec3s
+}
+
+// matchingNSEC returns the NSEC owned by name, if any
+func matchingNSEC(nsecs []*dns.NSEC, name string) *dns.NSEC {
+	for _, rr := range nsecs {
+		if dns.CanonicalName(rr.Hdr.Name) == name {
+			return rr
+		}
+	}
+	return nil
+}
+
+// coveringNSEC returns the NSEC whose span covers name, proving it does not exist, if any. The
+// last NSEC of a zone points back to the apex and covers every name after it.
+func coveringNSEC(nsecs []*dns.NSEC, name string) *dns.NSEC {
+	for _, rr := range nsecs {
+		owner, next := dns.CanonicalName(rr.Hdr.Name), dns.CanonicalName(rr.NextDomain)
+		if compareCanonical(owner, name) < 0 && (compareCanonical(name, next) < 0 || compareCanonical(next, owner) <= 0) {
+			return rr
+		}
+	}
+	return nil
+}
+
+// matchingNSEC3 returns the NSEC3 for the hash of name, if any
+func matchingNSEC3(nsec3s []*dns.NSEC3, name string) *dns.NSEC3 {
+	for _, rr := range nsec3s {
+		if rr.Match(name) {
+			return rr
+		}
+	}
+	return nil
+}
+
+// coveringNSEC3 returns the NSEC3 whose span covers the hash of name, if any. The record matching
+// the hash starts a span too, but proves that name exists.
+func coveringNSEC3(nsec3s []*dns.NSEC3, name string) *dns.NSEC3 {
+	for _, rr := range nsec3s {
+		if rr.Cover(name) && !rr.Match(name) {
+			return rr
+		}
+	}
+	return nil
+}
+
+// costlyNSEC3 reports whether any of nsec3s uses more hash iterations than proofs are checked for
+func costlyNSEC3(nsec3s []*dns.NSEC3) bool {
+	return slices.ContainsFunc(nsec3s, func(rr *dns.NSEC3) bool { return rr.Iterations > maxNSEC3Iterations })
+}
+
+// wildcardName returns the wildcard directly below encloser
+func wildcardName(encloser string) string {
+	if encloser == "." {
+		return "*."
+	}
+	return "*." + encloser
+}
+
+// ancestorWithLabels returns the ancestor of name, or name itself, with the given number of labels
+func ancestorWithLabels(name string, labels int) string {
+	if labels <= 0 {
+		return "."
+	}
+	offsets := dns.Split(name)
+	if labels >= len(offsets) {
+		return name
+	}
+	return name[offsets[len(offsets)-labels]:]
+}
+
+// noProof returns the error for a negative answer without a usable proof
+func noProof(name string, qType uint16, nxdomain bool) error {
+	if nxdomain {
+		return fmt.Errorf("%w: no proof that %s does not exist", errBogus, name)
+	}
+	return fmt.Errorf("%w: no proof that %s has no %s records", errBogus, name, dns.TypeToString[qType])
+}
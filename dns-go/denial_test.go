@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// denialTestZone has a wildcard, an empty non-terminal and an unsigned delegation to deny things around
+const denialTestZone = `
+example.test. 3600 IN SOA ns.example.test. hostmaster.example.test. 1 3600 600 86400 60
+example.test. 3600 IN NS ns.example.test.
+ns.example.test. 3600 IN A 192.0.2.1
+www.example.test. 3600 IN A 192.0.2.2
+*.apps.example.test. 3600 IN A 192.0.2.3
+host.apps.example.test. 3600 IN TXT "host"
+x.deep.example.test. 3600 IN A 192.0.2.4
+child.example.test. 3600 IN NS ns.child.example.test.
+ns.child.example.test. 3600 IN A 192.0.2.5
+`
+
+// denialChain returns the NSEC or NSEC3 chain the signer builds for denialTestZone
+func denialChain(t *testing.T, nsec3 bool) *signedZone {
+	t.Helper()
+	return (&Signer{Zone: "example.test.", NSEC3: nsec3}).stateFor(parseTestZone(t, denialTestZone))
+}
+
+// withOptOut returns copies of rrs with the opt-out flag set on their NSEC3 records
+func withOptOut(rrs []dns.RR) []dns.RR {
+	var out []dns.RR
+	for _, rr := range rrs {
+		rr = dns.Copy(rr)
+		if nsec3, ok := rr.(*dns.NSEC3); ok {
+			nsec3.Flags |= nsec3OptOut
+		}
+		out = append(out, rr)
+	}
+	return out
+}
+
+// denialTest is a negative answer for checkDenial and the verdict it should get
+type denialTest struct {
+	name     string
+	proof    []dns.RR
+	qname    string
+	qType    uint16
+	nxdomain bool
+	secure   bool
+	bogus    bool
+}
+
+func TestCheckDenial(t *testing.T) {
+	for _, nsec3 := range []bool{false, true} {
+		chain := denialChain(t, nsec3)
+		nxProof := func(name string) []dns.RR { return chain.denyName(name, nsec3) }
+
+		tests := []denialTest{
+			{name: "nxdomain", proof: nxProof("nope.example.test."), qname: "nope.example.test.", nxdomain: true, secure: true},
+			{name: "nxdomain below empty non-terminal", proof: nxProof("y.deep.example.test."), qname: "y.deep.example.test.", nxdomain: true, secure: true},
+			{name: "nxdomain without wildcard proof", proof: []dns.RR{chain.cover("zzz.example.test.", nsec3)}, qname: "zzz.example.test.", nxdomain: true, bogus: true},
+			{name: "nxdomain for existing name", proof: nxProof("nope.example.test."), qname: "www.example.test.", nxdomain: true, bogus: true},
+			{name: "nxdomain over opt-out span", proof: withOptOut(nxProof("nope.example.test.")), qname: "nope.example.test.", nxdomain: true, secure: !nsec3},
+			{name: "nodata", proof: chain.denyType("www.example.test.", nsec3), qname: "www.example.test.", qType: dns.TypeTXT, secure: true},
+			{name: "nodata for present type", proof: chain.denyType("www.example.test.", nsec3), qname: "www.example.test.", qType: dns.TypeA, bogus: true},
+			{name: "nodata at empty non-terminal", proof: chain.denyType("deep.example.test.", nsec3), qname: "deep.example.test.", qType: dns.TypeA, secure: true},
+			{name: "nodata at wildcard", proof: chain.denyType("a.apps.example.test.", nsec3), qname: "a.apps.example.test.", qType: dns.TypeTXT, secure: true},
+			{name: "nodata at wildcard for its type", proof: chain.denyType("a.apps.example.test.", nsec3), qname: "a.apps.example.test.", qType: dns.TypeA, bogus: true},
+			{name: "nodata from parent side of delegation", proof: chain.denyType("child.example.test.", nsec3), qname: "child.example.test.", qType: dns.TypeA, bogus: true},
+			{name: "no DS at unsigned delegation", proof: chain.denyType("child.example.test.", nsec3), qname: "child.example.test.", qType: dns.TypeDS, secure: true},
+			{name: "no DS from apex", proof: chain.denyType("example.test.", nsec3), qname: "example.test.", qType: dns.TypeDS, bogus: true},
+			{name: "nodata instead of nxdomain", proof: nxProof("nope.example.test."), qname: "nope.example.test.", qType: dns.TypeA, bogus: true},
+			{name: "no proof", qname: "nope.example.test.", nxdomain: true, bogus: true},
+		}
+		if nsec3 {
+			// Delegations without DS records may be left out of opt-out spans altogether
+			tests = append(tests, denialTest{name: "no DS in opt-out span", proof: withOptOut(nxProof("other.example.test.")), qname: "other.example.test.", qType: dns.TypeDS})
+		}
+
+		for _, test := range tests {
+			secure, err := checkDenial(test.proof, test.qname, test.qType, test.nxdomain)
+			if test.bogus {
+				if !errors.Is(err, errBogus) {
+					t.Errorf("NSEC3 %t, %s: got %v, want a bogus proof", nsec3, test.name, err)
+				}
+				continue
+			}
+			if err != nil || secure != test.secure {
+				t.Errorf("NSEC3 %t, %s: got secure %t and %v, want secure %t", nsec3, test.name, secure, err, test.secure)
+			}
+		}
+	}
+}
+
+func TestCheckWildcardAnswer(t *testing.T) {
+	for _, nsec3 := range []bool{false, true} {
+		chain := denialChain(t, nsec3)
+
+		// An answer for a.apps.example.test. expanded from *.apps.example.test., which has 3 labels
+		name := "a.apps.example.test."
+		proof := []dns.RR{chain.cover(name, nsec3)}
+		if secure, err := checkWildcardAnswer(proof, name, 3); err != nil || !secure {
+			t.Errorf("NSEC3 %t: got secure %t and %v for a proven wildcard answer", nsec3, secure, err)
+		}
+		if _, err := checkWildcardAnswer(nil, name, 3); !errors.Is(err, errBogus) {
+			t.Errorf("NSEC3 %t: got %v for a wildcard answer without proof, want bogus", nsec3, err)
+		}
+		// host.apps.example.test. exists, so no wildcard may answer for it
+		host := "host.apps.example.test."
+		if _, err := checkWildcardAnswer(chain.match(host, nsec3), host, 3); !errors.Is(err, errBogus) {
+			t.Errorf("NSEC3 %t: got %v for a wildcard answer replacing an existing name, want bogus", nsec3, err)
+		}
+	}
+}
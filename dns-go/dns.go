@@ -1,84 +1,496 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"strings"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-// DNSRecordStore defines storage interface for DNS records
+// DNSRecordStore defines storage interface for DNS records. Set and Delete fail when a
+// persistent store cannot write the change through.
 type DNSRecordStore interface {
 	Get(domain string, qType uint16) (*dns.Msg, bool)
-	Set(domain string, qType uint16, msg *dns.Msg)
+	Set(domain string, qType uint16, msg *dns.Msg) error
+	Delete(domain string, qType uint16) error
 	GetAll() map[string]*dns.Msg // To fetch all records for UI
 }
 
-// DNSHandler processes incoming DNS queries
-func DNSHandler(localDomain string, localStore, cacheStore DNSRecordStore) dns.HandlerFunc {
+// maxQuestions is the most questions a query may ask. Few servers accept more than one, but
+// those that do answer each in turn, so this bounds the work a single query can cause.
+const maxQuestions = 4
+
+// DNSHandler processes incoming DNS queries, answering each from the view its client belongs to
+func DNSHandler(views *ViewSet, zones *ZoneSet, transfers *Transfers, acls *ACLs, policies *Policies) dns.HandlerFunc {
 	return func(w dns.ResponseWriter, r *dns.Msg) {
+		view := views.Select(w, r)
+
 		// Log the DNS request
-		log.Printf("Received DNS request: %s", r.Question[0].Name)
+		debugf("Received DNS request: %s (view %s)", r.Question[0].Name, view.Name)
 
 		// Count DNS request in Prometheus
 		dnsRequests.WithLabelValues("query").Inc()
 
+		if badVersion(w, r) {
+			return
+		}
+
+		// Zone maintenance messages are handled apart from regular queries
+		switch r.Opcode {
+		case dns.OpcodeNotify:
+			answeredBy(w, SourceTransfer)
+			transfers.ServeNotify(w, r)
+			return
+		case dns.OpcodeUpdate:
+			if !acls.Update.Allows(w, r) {
+				refuse(w, r, "update")
+				return
+			}
+			answeredBy(w, SourceUpdate)
+			view.Updater.ServeUpdate(w, r)
+			return
+		}
+		if qType := r.Question[0].Qtype; qType == dns.TypeAXFR || qType == dns.TypeIXFR {
+			answeredBy(w, SourceTransfer)
+			transfers.ServeTransfer(w, r)
+			return
+		}
+
 		// Create a response message
 		response := new(dns.Msg)
 		response.SetReply(r)
+		// SetReply echoes only the first question
+		response.Question = append([]dns.Question(nil), r.Question...)
 
 		// Process each question in the request
 		handled := false
+		a := &answerer{
+			w:        w,
+			r:        r,
+			view:     view,
+			zones:    zones,
+			policies: policies,
+			// Answers tailored to the client network are neither taken from nor put into the cache
+			tailored: view.ECS == ECSPass && clientSubnet(r) != nil,
+			// CNAME chains may only lead out of our own data for clients allowed recursion
+			recursion: acls.Recursion.Allows(w, r),
+		}
 		for _, q := range r.Question {
 			domain := q.Name
 
-			var store DNSRecordStore
-			if strings.HasSuffix(domain, localDomain) {
-				store = localStore
-				log.Printf("Local domain found in local store: %s", domain)
-				log.Printf("Cache: %s", store.GetAll())
-			} else {
-				store = cacheStore
-				log.Printf("Local domain found in local cache: %s", domain)
-			}
-
-			if msg, ok := store.Get(domain, q.Qtype); ok {
-				// Cache hit
-				log.Printf("Cache hit for %s", domain)
-				log.Printf("Cache hit: %s", msg)
-				response.Answer = append(response.Answer, msg.Answer...)
-				handled = true
-				continue
+			if a.ours(domain, q.Qtype) {
+				if !acls.Query.Allows(w, r) {
+					refuse(w, r, "query")
+					return
+				}
+			} else if !a.recursion {
+				refuse(w, r, "recursion")
+				return
 			}
 
-			// Forward request to upstream DNS (8.8.8.8 as an example)
-			client := new(dns.Client)
-			msg, _, err := client.Exchange(r, "8.8.8.8:53")
+			msg, source, err := a.answer(domain, q.Qtype)
+			answeredBy(w, source)
 			if err != nil {
 				log.Printf("Failed to resolve %s: %v", domain, err)
 				dns.HandleFailed(w, r)
 				return
 			}
+			if msg == nil {
+				// Dropped by a response policy
+				return
+			}
+			msg = a.chase(domain, q.Qtype, msg)
+			a.addAdditional(msg)
 
-			// Store the result in the appropriate store
-			store.Set(domain, q.Qtype, msg)
-			response.Answer = append(response.Answer, msg.Answer...)
+			response.Authoritative = msg.Authoritative
+			response.AuthenticatedData = msg.AuthenticatedData
+			appendSections(response, msg)
 			handled = true
 		}
 
+		// Echo EDNS so clients asking for DNSSEC records know they got them, and make the
+		// response fit what the client can receive
+		fitResponse(w, r, response, a.options)
+
 		// If handled, send the response
 		if handled {
 			w.WriteMsg(response)
 			// Log the DNS response
-			log.Printf("Responded with %d answers", len(response.Answer))
+			debugf("Responded %s with %d answers", dns.RcodeToString[response.Rcode], len(response.Answer))
 			dnsRequests.WithLabelValues("response").Inc()
 		} else {
+			answeredBy(w, SourceFailed)
 			dns.HandleFailed(w, r)
 		}
 	}
 }
 
+// answerer answers the questions of one request from the view serving its client
+type answerer struct {
+	w         dns.ResponseWriter
+	r         *dns.Msg
+	view      *View
+	zones     *ZoneSet
+	policies  *Policies
+	tailored  bool
+	recursion bool
+
+	options []dns.EDNS0 // EDNS options to add to the response
+}
+
+// zone returns the zone holding name and whether dns-go answers for name from it. Zones below the
+// local domain take precedence over it, zones above it do not.
+func (a *answerer) zone(name string) (*Zone, bool) {
+	zone := a.zones.Find(name)
+	local := a.view.Local
+	return zone, zone != nil && (!local.Contains(name) || dns.CountLabel(zone.Origin) > dns.CountLabel(local.Domain))
+}
+
+// ours reports whether name is answered from our own data rather than resolved. Reverse records
+// in the local store or synthesized for local hosts are our own data, other reverse names are resolved.
+func (a *answerer) ours(name string, qType uint16) bool {
+	_, authoritative := a.zone(name)
+	_, stored := a.view.Local.Get(name, qType)
+	if !stored && qType == dns.TypePTR {
+		_, stored = a.view.Local.PTR(name)
+	}
+	return a.view.Local.Contains(name) || authoritative || stored && isReverseName(name)
+}
+
+// answer answers a single question from the first part of dns-go responsible for name and returns
+// which part that was. A nil message without error means a response policy dropped the query.
+func (a *answerer) answer(name string, qType uint16) (*dns.Msg, string, error) {
+	local, cacheStore := a.view.Local, a.view.Cache
+	isLocal := local.Contains(name)
+	zone, authoritative := a.zone(name)
+
+	// Response policies block or rewrite names before any store is consulted
+	if rule, source := a.policies.Match(name); rule != nil {
+		log.Printf("Policy %s matched %s from %s: %s", source, name, a.w.RemoteAddr(), rule.Action)
+		policyHits.WithLabelValues(source, rule.Action).Inc()
+		switch rule.Action {
+		case PolicyDrop:
+			return nil, SourcePolicy, nil
+		case PolicyPassthru:
+		default:
+			return rule.Answer(name, qType), SourcePolicy, nil
+		}
+	}
+
+	// Signed answers are built from the whole zone, which knows what to sign and what to deny
+	signed := isLocal && local.Signer != nil && dnssecOK(a.r)
+	if (isLocal || isReverseName(name)) && !signed {
+		// Reverse records registered through dynamic updates live in the local store too
+		debugf("Looking up %s in local store", name)
+		if msg, ok := local.Get(name, qType); ok {
+			debugf("Local hit: %s", msg)
+			msg = msg.Copy()
+			msg.Authoritative = true
+			return msg, SourceLocal, nil
+		}
+	}
+
+	if qType == dns.TypePTR && !authoritative {
+		if msg, ok := local.PTR(name); ok {
+			// Reverse lookups for local hosts are answered from their A and AAAA records,
+			// unless a reverse zone is served for them
+			return msg, SourceLocal, nil
+		}
+	}
+
+	if authoritative {
+		// Answer (or refer) from a zone we are authoritative for
+		return zone.Lookup(name, qType), SourceZone, nil
+	}
+
+	if isLocal {
+		// We are authoritative for the local domain, so answer from the whole zone,
+		// including its apex SOA and NS and definitive negative answers
+		return local.Lookup(name, qType, dnssecOK(a.r)), SourceLocal, nil
+	}
+
+	debugf("Looking up %s in local cache", name)
+	if msg, ok := cacheStore.Get(name, qType); ok && !a.tailored {
+		// Cache hit
+		debugf("Cache hit: %s", msg)
+		return a.recursive(msg, qType), SourceCache, nil
+	}
+
+	// A name answered recently can be answered stale when the upstreams fail or are slow (RFC 8767)
+	hasStale := !a.tailored && cacheStore.HasStale(name, qType)
+	if hasStale && cacheStore.RecentlyFailed(name, qType) {
+		// The upstreams failed for this name moments ago, so they are not asked again for a while
+		if msg, ok := a.stale(name, qType, "upstreams failed recently"); ok {
+			return msg, SourceStale, nil
+		}
+	}
+
+	// Forward the question to the upstream resolvers responsible for the name,
+	// validating the answer when DNSSEC validation is enabled
+	msg, err := a.resolve(name, qType, hasStale)
+	if hasStale && (err != nil || msg.Rcode == dns.RcodeServerFailure) {
+		// Rather fail than lie, unless the name was answered recently
+		reason := "upstreams are slow"
+		if !errors.Is(err, errUpstreamSlow) {
+			reason = "upstreams failed"
+			cacheStore.Failed(name, qType)
+		}
+		if msg, ok := a.stale(name, qType, reason); ok {
+			return msg, SourceStale, nil
+		}
+	}
+	if err != nil {
+		return nil, SourceFailed, err
+	}
+
+	// Store the result in the cache along with its validation state (the AD bit);
+	// negative answers are cached per RFC 2308
+	if a.tailored {
+		if subnet := subnetOption(msg); subnet != nil {
+			a.options = append(a.options, subnet)
+		}
+	} else if a.cacheable(msg) {
+		cacheStore.Set(name, qType, msg)
+	}
+	return a.recursive(msg, qType), SourceUpstream, nil
+}
+
+// cacheable reports whether an upstream answer may be cached for every client. With CD set the
+// validator passes bogus answers on instead of failing, and telling them apart from insecure ones
+// is not worth it, so answers fetched for such clients are only cached when they validated.
+func (a *answerer) cacheable(msg *dns.Msg) bool {
+	return !a.r.CheckingDisabled || a.view.Validator == nil || msg.AuthenticatedData
+}
+
+// errUpstreamSlow is returned by resolve when it stops waiting for the upstreams
+var errUpstreamSlow = errors.New("upstreams did not answer in time")
+
+// resolve forwards a question to the upstreams. When a stale answer can stand in for theirs, it
+// waits only as long as the client response timer and then returns errUpstreamSlow, leaving the
+// upstream exchange to finish in the background and refresh the cache (RFC 8767 section 5).
+func (a *answerer) resolve(name string, qType uint16, hasStale bool) (*dns.Msg, error) {
+	query := questionQuery(a.r, name, qType)
+	cacheStore := a.view.Cache
+	if !hasStale || cacheStore.StaleAnswerTimeout <= 0 {
+		return a.view.Resolve(query)
+	}
+
+	type result struct {
+		msg *dns.Msg
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		msg, err := a.view.Resolve(query)
+		done <- result{msg, err}
+	}()
+	timer := time.NewTimer(cacheStore.StaleAnswerTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.msg, r.err
+	case <-timer.C:
+		go func() {
+			r := <-done
+			if r.err != nil || r.msg.Rcode == dns.RcodeServerFailure {
+				cacheStore.Failed(name, qType)
+				return
+			}
+			if a.cacheable(r.msg) {
+				cacheStore.Set(name, qType, r.msg)
+			}
+		}()
+		return nil, errUpstreamSlow
+	}
+}
+
+// stale returns the stale answer for a question, telling the client it is stale (RFC 8914)
+func (a *answerer) stale(name string, qType uint16, reason string) (*dns.Msg, bool) {
+	msg, ok := a.view.Cache.GetStale(name, qType)
+	if !ok {
+		return nil, false
+	}
+	log.Printf("Serving stale answer for %s: %s", name, reason)
+	a.options = append(a.options, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeStaleAnswer})
+	return a.recursive(msg, qType), true
+}
+
+// recursive prepares an answer obtained from upstream for the client. DNSSEC records are only passed
+// on to clients that set DO, and AD only to clients that set DO or AD themselves (RFC 6840 section 5.8).
+func (a *answerer) recursive(msg *dns.Msg, qType uint16) *dns.Msg {
+	if dnssecOK(a.r) {
+		msg = msg.Copy()
+	} else {
+		msg = withoutDNSSEC(msg, qType)
+	}
+	msg.Authoritative = false
+	msg.AuthenticatedData = msg.AuthenticatedData && (dnssecOK(a.r) || a.r.AuthenticatedData)
+	return msg
+}
+
+// chase follows the CNAME and DNAME records msg answers name with until it reaches records of
+// type qType, looking up each target the answer so far leaves open the way the query itself was
+// answered, and returns the whole chain. Loops and overlong chains fail the answer.
+func (a *answerer) chase(name string, qType uint16, msg *dns.Msg) *dns.Msg {
+	if qType == dns.TypeCNAME || qType == dns.TypeANY {
+		return msg
+	}
+	seen := map[string]bool{dns.CanonicalName(name): true}
+	for msg.Rcode == dns.RcodeSuccess && !hasRRset(msg.Answer, name, qType) {
+		target := chainTarget(msg.Answer, name)
+		if target == "" {
+			return msg
+		}
+		if seen[target] || len(seen) > maxCNAMEChain {
+			log.Printf("Failed to follow CNAME chain of %s: loop or more than %d links at %s", dns.CanonicalName(a.r.Question[0].Name), maxCNAMEChain, target)
+			msg.Rcode = dns.RcodeServerFailure
+			return msg
+		}
+		seen[target] = true
+		name = target
+		if hasRRset(msg.Answer, name, qType) || chainTarget(msg.Answer, name) != "" {
+			// The answer so far already covers the next link
+			continue
+		}
+		if !a.recursion && !a.ours(name, qType) {
+			// Clients without recursion get the chain as far as our own data goes
+			return msg
+		}
+
+		next, _, err := a.answer(name, qType)
+		if err != nil || next == nil {
+			if err != nil {
+				log.Printf("Failed to resolve CNAME target %s: %v", name, err)
+			}
+			return msg
+		}
+		msg.Rcode = next.Rcode
+		msg.AuthenticatedData = msg.AuthenticatedData && next.AuthenticatedData
+		msg.Answer = append(msg.Answer, next.Answer...)
+		msg.Ns = next.Ns
+		msg.Extra = append(msg.Extra, next.Extra...)
+	}
+	return msg
+}
+
+// addAdditional adds the addresses of the targets of the MX, SRV and NS records answered in msg to
+// its additional section, sparing clients a query for each. Only our own data is consulted.
+func (a *answerer) addAdditional(msg *dns.Msg) {
+	seen := make(map[string]bool)
+	for _, rr := range msg.Answer {
+		var target string
+		switch rr := rr.(type) {
+		case *dns.MX:
+			target = rr.Mx
+		case *dns.SRV:
+			target = rr.Target
+		case *dns.NS:
+			target = rr.Ns
+		default:
+			continue
+		}
+		target = dns.CanonicalName(target)
+		if seen[target] {
+			continue
+		}
+		seen[target] = true
+		for _, qType := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			if !hasRRset(msg.Extra, target, qType) {
+				msg.Extra = append(msg.Extra, a.known(target, qType)...)
+			}
+		}
+	}
+}
+
+// known returns the records of type qType that our own data holds for name, without resolving it
+func (a *answerer) known(name string, qType uint16) []dns.RR {
+	local := a.view.Local
+	var answer []dns.RR
+	if msg, ok := local.Get(name, qType); ok {
+		answer = msg.Answer
+	} else if zone, authoritative := a.zone(name); authoritative {
+		answer = zone.Lookup(name, qType).Answer
+	} else if local.Contains(name) {
+		answer = local.Lookup(name, qType, false).Answer
+	}
+	var rrs []dns.RR
+	for _, rr := range answer {
+		if hdr := rr.Header(); hdr.Rrtype == qType && strings.EqualFold(hdr.Name, name) {
+			rrs = append(rrs, dns.Copy(rr))
+		}
+	}
+	return rrs
+}
+
+// chainTarget returns the name a CNAME or DNAME record in answer redirects name to, if any
+func chainTarget(answer []dns.RR, name string) string {
+	if target := cnameTarget(answer, name); target != "" {
+		return target
+	}
+	for _, rr := range answer {
+		if dname, ok := rr.(*dns.DNAME); ok {
+			if target := dnameTarget(dname, name); target != "" {
+				return target
+			}
+		}
+	}
+	return ""
+}
+
+// questionQuery returns a query for a single question carrying the flags and EDNS record of r, so
+// each question of r is resolved on its own
+func questionQuery(r *dns.Msg, name string, qType uint16) *dns.Msg {
+	query := new(dns.Msg)
+	query.SetQuestion(name, qType)
+	query.Question[0].Qclass = r.Question[0].Qclass
+	query.RecursionDesired = r.RecursionDesired
+	query.CheckingDisabled = r.CheckingDisabled
+	query.AuthenticatedData = r.AuthenticatedData
+	if opt := r.IsEdns0(); opt != nil {
+		query.Extra = append(query.Extra, dns.Copy(opt))
+	}
+	return query
+}
+
+// refuse answers r with REFUSED because its client may not use service
+func refuse(w dns.ResponseWriter, r *dns.Msg, service string) {
+	debugf("Refusing %s of %s from %s: not allowed", service, r.Question[0].Name, w.RemoteAddr())
+	dnsRequests.WithLabelValues("refused").Inc()
+	answeredBy(w, SourceRefused)
+	replyRcode(w, r, dns.RcodeRefused)
+}
+
+// verbose enables logging every query and how it was answered, which is slow under load
+var verbose bool
+
+// debugf logs like log.Printf, but only with verbose logging enabled
+func debugf(format string, v ...any) {
+	if verbose {
+		log.Printf(format, v...)
+	}
+}
+
+// isReverseName reports whether name lies in the IPv4 or IPv6 reverse mapping trees
+func isReverseName(name string) bool {
+	return dns.IsSubDomain("in-addr.arpa.", name) || dns.IsSubDomain("ip6.arpa.", name)
+}
+
+// appendSections copies the rcode and the answer, authority and additional records of msg into response.
+// OPT records are left out since EDNS is negotiated separately with each client.
+func appendSections(response, msg *dns.Msg) {
+	response.Rcode = msg.Rcode
+	response.Answer = append(response.Answer, msg.Answer...)
+	response.Ns = append(response.Ns, msg.Ns...)
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			response.Extra = append(response.Extra, rr)
+		}
+	}
+}
+
 var dnsRequests = prometheus.NewCounterVec(
 	prometheus.CounterOpts{
 		Name: "dns_requests_total",
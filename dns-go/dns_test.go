@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startTestServer serves DNS over UDP on loopback with a default view for home. holding records
+// in master file format, and returns its address
+func startTestServer(t *testing.T, records ...string) string {
+	t.Helper()
+	zones := NewZoneSet()
+	view := &View{Name: defaultViewName, Local: NewLocalZone("home.", NewMemoryStore(), zones)}
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatalf("Bad test record %q: %v", record, err)
+		}
+		msg := new(dns.Msg)
+		msg.Answer = append(msg.Answer, rr)
+		view.Local.Set(rr.Header().Name, rr.Header().Rrtype, msg)
+	}
+	return serveTestView(t, view, zones)
+}
+
+// testHandler returns the DNS handler answering from view, open to everyone
+func testHandler(view *View, zones *ZoneSet) dns.Handler {
+	anyone := &ACL{Any: true}
+	acls := &ACLs{Recursion: anyone, Query: anyone, Update: anyone}
+	return DNSHandler(NewViewSet(view, nil), zones, NewTransfers(view.Local, zones, &ACL{}, nil), acls, NewPolicies())
+}
+
+// serveTestView serves DNS over UDP on loopback from view, open to everyone, and returns its address
+func serveTestView(t *testing.T, view *View, zones *ZoneSet) string {
+	t.Helper()
+	handler := testHandler(view, zones)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Cannot listen on loopback: %v", err)
+	}
+	server := &dns.Server{PacketConn: conn, Handler: handler, MsgAcceptFunc: acceptMsg}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	return conn.LocalAddr().String()
+}
+
+func TestMultipleQuestions(t *testing.T) {
+	addr := startTestServer(t, "www.home. 300 IN A 192.0.2.1", "mail.home. 300 IN AAAA 2001:db8::1")
+
+	query := new(dns.Msg)
+	query.SetQuestion("www.home.", dns.TypeA)
+	query.Question = append(query.Question, dns.Question{Name: "mail.home.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET})
+	msg, _, err := new(dns.Client).Exchange(query, addr)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if msg.Rcode != dns.RcodeSuccess || len(msg.Question) != 2 || len(msg.Answer) != 2 {
+		t.Fatalf("Got %s with %d questions and answers %v, want NOERROR answering both questions",
+			dns.RcodeToString[msg.Rcode], len(msg.Question), msg.Answer)
+	}
+	for i, q := range query.Question {
+		if rr := msg.Answer[i].Header(); rr.Name != q.Name || rr.Rrtype != q.Qtype {
+			t.Errorf("Answer %d is %s, want %s %s", i, msg.Answer[i], q.Name, dns.TypeToString[q.Qtype])
+		}
+	}
+
+	// Queries asking more than maxQuestions questions are refused as malformed
+	for len(query.Question) <= maxQuestions {
+		query.Question = append(query.Question, query.Question[0])
+	}
+	msg, _, err = new(dns.Client).Exchange(query, addr)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if msg.Rcode != dns.RcodeFormatError {
+		t.Errorf("Got %s for %d questions, want FORMERR", dns.RcodeToString[msg.Rcode], len(query.Question))
+	}
+}
+
+func TestServeStale(t *testing.T) {
+	// The upstream answers www.example.test. with 192.0.2.<n> for the nth query it answers,
+	// unless told to be slow or to fail
+	var mode atomic.Value
+	mode.Store("answer")
+	var queries atomic.Int32
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Cannot listen on loopback: %v", err)
+	}
+	server := &dns.Server{PacketConn: upstream, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		n := queries.Add(1)
+		reply := new(dns.Msg)
+		reply.SetReply(r)
+		switch mode.Load() {
+		case "fail":
+			reply.Rcode = dns.RcodeServerFailure
+			w.WriteMsg(reply)
+			return
+		case "slow":
+			time.Sleep(300 * time.Millisecond)
+		}
+		rr, _ := dns.NewRR(fmt.Sprintf("www.example.test. 60 IN A 192.0.2.%d", n))
+		reply.Answer = []dns.RR{rr}
+		w.WriteMsg(reply)
+	})}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+
+	pool, err := NewUpstreamPool(defaultViewName, []string{upstream.LocalAddr().String()}, PolicySequential, 2*time.Second)
+	if err != nil {
+		t.Fatalf("NewUpstreamPool: %v", err)
+	}
+	zones := NewZoneSet()
+	cache := NewCacheStore(100)
+	cache.StaleWindow, cache.StaleAnswerTimeout, cache.StaleRecheck = time.Hour, 50*time.Millisecond, time.Minute
+	var skew atomic.Int64
+	cache.now = func() time.Time { return time.Now().Add(time.Duration(skew.Load())) }
+	view := &View{
+		Name:      defaultViewName,
+		Local:     NewLocalZone("home.", NewMemoryStore(), zones),
+		Cache:     cache,
+		Forwarder: NewForwarder(pool),
+	}
+	addr := serveTestView(t, view, zones)
+
+	// ask resolves www.example.test. and returns the address it got and whether it was stale
+	ask := func() (string, bool) {
+		t.Helper()
+		query := new(dns.Msg)
+		query.SetQuestion("www.example.test.", dns.TypeA)
+		query.SetEdns0(1232, false)
+		msg, _, err := new(dns.Client).Exchange(query, addr)
+		if err != nil {
+			t.Fatalf("Exchange: %v", err)
+		}
+		if msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 1 {
+			t.Fatalf("Got %s with answers %v, want an address", dns.RcodeToString[msg.Rcode], msg.Answer)
+		}
+		stale := false
+		if opt := msg.IsEdns0(); opt != nil {
+			for _, option := range opt.Option {
+				if ede, ok := option.(*dns.EDNS0_EDE); ok && ede.InfoCode == dns.ExtendedErrorCodeStaleAnswer {
+					stale = true
+				}
+			}
+		}
+		return msg.Answer[0].(*dns.A).A.String(), stale
+	}
+	expire := func() { skew.Add(int64(2 * time.Minute)) }
+
+	if got, stale := ask(); got != "192.0.2.1" || stale {
+		t.Fatalf("Got %s (stale %t), want a fresh 192.0.2.1", got, stale)
+	}
+
+	// A slow upstream is not waited for; it refreshes the cache when it answers after all
+	expire()
+	mode.Store("slow")
+	start := time.Now()
+	if got, stale := ask(); got != "192.0.2.1" || !stale {
+		t.Errorf("Got %s (stale %t), want a stale 192.0.2.1", got, stale)
+	}
+	if elapsed := time.Since(start); elapsed >= 300*time.Millisecond {
+		t.Errorf("The stale answer took %v, as long as the upstream", elapsed)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if got, stale := ask(); got != "192.0.2.2" || stale {
+		t.Errorf("Got %s (stale %t) after the upstream answered, want a fresh 192.0.2.2", got, stale)
+	}
+
+	// A failed upstream is not asked again until the failure recheck timer runs out
+	expire()
+	mode.Store("fail")
+	if got, stale := ask(); got != "192.0.2.2" || !stale {
+		t.Errorf("Got %s (stale %t), want a stale 192.0.2.2", got, stale)
+	}
+	asked := queries.Load()
+	if got, stale := ask(); got != "192.0.2.2" || !stale {
+		t.Errorf("Got %s (stale %t), want a stale 192.0.2.2", got, stale)
+	}
+	if queries.Load() != asked {
+		t.Errorf("The upstream was asked again within the failure recheck time")
+	}
+	mode.Store("answer")
+	skew.Add(int64(cache.StaleRecheck))
+	if got, stale := ask(); stale || got == "192.0.2.2" {
+		t.Errorf("Got %s (stale %t) after the failure recheck time, want a fresh answer", got, stale)
+	}
+}
+
+func TestBogusAnswerForCheckingDisabled(t *testing.T) {
+	// The upstream serves a signed example.test. whose bad.example.test. address does not match its signature
+	signer, err := LoadOrGenerateSigner("example.test.", t.TempDir(), dns.ECDSAP256SHA256, false)
+	if err != nil {
+		t.Fatalf("LoadOrGenerateSigner: %v", err)
+	}
+	zone := parseTestZone(t, `
+example.test. 3600 IN SOA ns.example.test. hostmaster.example.test. 1 3600 600 86400 60
+example.test. 3600 IN NS ns.example.test.
+ns.example.test. 3600 IN A 192.0.2.1
+bad.example.test. 3600 IN A 192.0.2.2
+`)
+	for _, rr := range signer.ZoneRecords() {
+		if err := zone.Add(rr); err != nil {
+			t.Fatalf("Add %s: %v", rr, err)
+		}
+	}
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Cannot listen on loopback: %v", err)
+	}
+	server := &dns.Server{PacketConn: upstream, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		q := r.Question[0]
+		msg := zone.Lookup(q.Name, q.Qtype)
+		signer.Sign(zone, msg, q.Name, q.Qtype)
+		for _, rr := range msg.Answer {
+			if a, ok := rr.(*dns.A); ok && a.Hdr.Name == "bad.example.test." {
+				a.A = net.IPv4(192, 0, 2, 66)
+			}
+		}
+		msg.SetReply(r)
+		w.WriteMsg(msg)
+	})}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+
+	pool, err := NewUpstreamPool(defaultViewName, []string{upstream.LocalAddr().String()}, PolicySequential, 2*time.Second)
+	if err != nil {
+		t.Fatalf("NewUpstreamPool: %v", err)
+	}
+	zones := NewZoneSet()
+	forwarder := NewForwarder(pool)
+	view := &View{
+		Name:      defaultViewName,
+		Local:     NewLocalZone("home.", NewMemoryStore(), zones),
+		Cache:     NewCacheStore(100),
+		Forwarder: forwarder,
+		Validator: NewValidator(forwarder, signer.DS()),
+	}
+	addr := serveTestView(t, view, zones)
+
+	ask := func(cd bool) *dns.Msg {
+		t.Helper()
+		query := new(dns.Msg)
+		query.SetQuestion("bad.example.test.", dns.TypeA)
+		query.CheckingDisabled = cd
+		msg, _, err := new(dns.Client).Exchange(query, addr)
+		if err != nil {
+			t.Fatalf("Exchange: %v", err)
+		}
+		return msg
+	}
+
+	// A client that set CD gets the bogus data, but other clients must not get it from the cache
+	if msg := ask(true); msg.Rcode != dns.RcodeSuccess || len(msg.Answer) == 0 {
+		t.Fatalf("Got %s with answers %v with CD set, want the bogus answer", dns.RcodeToString[msg.Rcode], msg.Answer)
+	}
+	if msg := ask(false); msg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Got %s with answers %v without CD, want SERVFAIL", dns.RcodeToString[msg.Rcode], msg.Answer)
+	}
+}
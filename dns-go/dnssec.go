@@ -0,0 +1,517 @@
+package main
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// signatureValidity is how long RRSIGs made by the online signer stay valid
+	signatureValidity = 7 * 24 * time.Hour
+	// signatureBackdate allows for clock skew between dns-go and validators
+	signatureBackdate = time.Hour
+)
+
+// Signer signs answers from a zone on the fly (online signing). It holds the zone's key signing
+// key (KSK) and zone signing key (ZSK), and proves nonexistence with NSEC or NSEC3 (RFC 4034, RFC 5155)
+// records computed from the zone snapshot being served.
+type Signer struct {
+	Zone  string
+	NSEC3 bool
+
+	ksk, zsk         *dns.DNSKEY
+	kskPriv, zskPriv crypto.Signer
+
+	mu    sync.Mutex
+	state *signedZone
+}
+
+// signedZone is the denial of existence chain and signature cache for one zone snapshot
+type signedZone struct {
+	zone   *Zone
+	ttl    uint32
+	nsec   []*dns.NSEC  // in canonical order
+	nsec3  []*dns.NSEC3 // in hash order
+	hashed map[string]*dns.NSEC3
+	sigs   map[string]*dns.RRSIG
+}
+
+// LoadOrGenerateSigner loads the KSK and ZSK of zone from dir, generating and saving them in BIND's
+// K<zone>+<alg>+<tag>.key/.private format when none exist yet
+func LoadOrGenerateSigner(zone, dir string, algorithm uint8, nsec3 bool) (*Signer, error) {
+	s := &Signer{Zone: dns.CanonicalName(zone), NSEC3: nsec3}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "K"+s.Zone+"+*.key"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		key, priv, err := readKeyPair(path)
+		if err != nil {
+			return nil, err
+		}
+		if key.Algorithm != algorithm {
+			continue
+		}
+		switch {
+		case key.Flags&dns.SEP != 0 && s.ksk == nil:
+			s.ksk, s.kskPriv = key, priv
+		case key.Flags&dns.SEP == 0 && s.zsk == nil:
+			s.zsk, s.zskPriv = key, priv
+		}
+	}
+
+	if s.ksk == nil {
+		if s.ksk, s.kskPriv, err = generateKey(s.Zone, dir, algorithm, dns.ZONE|dns.SEP); err != nil {
+			return nil, err
+		}
+	}
+	if s.zsk == nil {
+		if s.zsk, s.zskPriv, err = generateKey(s.Zone, dir, algorithm, dns.ZONE); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// readKeyPair reads a DNSKEY from a .key file and its private key from the matching .private file
+func readKeyPair(path string) (*dns.DNSKEY, crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	rr, err := dns.NewRR(string(data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	key, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s: not a DNSKEY record", path)
+	}
+
+	privatePath := strings.TrimSuffix(path, ".key") + ".private"
+	f, err := os.Open(privatePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	priv, err := key.ReadPrivateKey(f, privatePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s: unsupported private key", privatePath)
+	}
+	return key, signer, nil
+}
+
+// generateKey creates a new key for zone and writes it to dir
+func generateKey(zone, dir string, algorithm uint8, flags uint16) (*dns.DNSKEY, crypto.Signer, error) {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: algorithm,
+	}
+	bits := 256
+	switch algorithm {
+	case dns.RSASHA256, dns.RSASHA512:
+		bits = 2048
+	case dns.ECDSAP384SHA384:
+		bits = 384
+	}
+	priv, err := key.Generate(bits)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generating key for %s: %w", zone, err)
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, nil, errors.New("generated key cannot sign")
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, nil, err
+	}
+	base := filepath.Join(dir, fmt.Sprintf("K%s+%03d+%05d", zone, algorithm, key.KeyTag()))
+	if err := os.WriteFile(base+".key", []byte(key.String()+"\n"), 0o644); err != nil {
+		return nil, nil, err
+	}
+	if err := os.WriteFile(base+".private", []byte(key.PrivateKeyString(priv)), 0o600); err != nil {
+		return nil, nil, err
+	}
+	kind := "ZSK"
+	if flags&dns.SEP != 0 {
+		kind = "KSK"
+	}
+	log.Printf("Generated DNSSEC %s for %s with key tag %d in %s", kind, zone, key.KeyTag(), dir)
+	return key, signer, nil
+}
+
+// ZoneRecords returns the records the signer adds to the zone apex: the DNSKEY set and,
+// when NSEC3 is in use, the NSEC3PARAM record
+func (s *Signer) ZoneRecords() []dns.RR {
+	records := []dns.RR{dns.Copy(s.ksk), dns.Copy(s.zsk)}
+	if s.NSEC3 {
+		records = append(records, &dns.NSEC3PARAM{
+			Hdr:  dns.RR_Header{Name: s.Zone, Rrtype: dns.TypeNSEC3PARAM, Class: dns.ClassINET, Ttl: 3600},
+			Hash: dns.SHA1,
+		})
+	}
+	return records
+}
+
+// DS returns the DS records of the KSK, which have to be published in the parent zone
+func (s *Signer) DS() []*dns.DS {
+	return []*dns.DS{s.ksk.ToDS(dns.SHA256)}
+}
+
+// WriteDSSet writes the DS records to a dsset-<zone> file in dir, like BIND's dnssec-signzone does
+func (s *Signer) WriteDSSet(dir string) error {
+	var lines []string
+	for _, ds := range s.DS() {
+		lines = append(lines, ds.String())
+	}
+	return os.WriteFile(filepath.Join(dir, "dsset-"+s.Zone), []byte(strings.Join(lines, "\n")+"\n"), 0o644)
+}
+
+// Sign adds DNSSEC records to an answer from zone for qname and qType: NSEC or NSEC3 records proving
+// what does not exist, and RRSIGs over every authoritative RRset in the answer and authority sections
+func (s *Signer) Sign(zone *Zone, msg *dns.Msg, qname string, qType uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := s.stateFor(zone)
+	qname = dns.CanonicalName(qname)
+
+	switch {
+	case !msg.Authoritative:
+		// Referral: prove the delegation is insecure (no DS) when the chain holds the cut
+		if len(msg.Ns) > 0 {
+			msg.Ns = append(msg.Ns, state.match(msg.Ns[0].Header().Name, s.NSEC3)...)
+		}
+	case msg.Rcode == dns.RcodeNameError:
+		msg.Ns = append(msg.Ns, state.denyName(qname, s.NSEC3)...)
+	case len(msg.Answer) == 0:
+		msg.Ns = append(msg.Ns, state.denyType(qname, s.NSEC3)...)
+	}
+
+	msg.Answer = append(msg.Answer, s.signatures(state, msg.Answer)...)
+	msg.Ns = append(msg.Ns, s.signatures(state, msg.Ns)...)
+	msg.Extra = append(msg.Extra, s.signatures(state, msg.Extra)...)
+}
+
+// signatures returns an RRSIG for every RRset in rrs, reusing cached signatures while they are fresh
+func (s *Signer) signatures(state *signedZone, rrs []dns.RR) []dns.RR {
+	var sigs []dns.RR
+	for _, rrset := range groupRRsets(rrs) {
+		hdr := rrset[0].Header()
+		if hdr.Rrtype == dns.TypeRRSIG || hdr.Rrtype == dns.TypeOPT || !dns.IsSubDomain(s.Zone, hdr.Name) {
+			continue
+		}
+		if hdr.Rrtype != dns.TypeDS && hdr.Rrtype != dns.TypeNSEC && state.zone.delegation(hdr.Name, hdr.Rrtype) != "" {
+			// Delegation NS records and glue belong to the child zone and are not signed
+			continue
+		}
+
+		var parts []string
+		for _, rr := range rrset {
+			parts = append(parts, rr.String())
+		}
+		cacheKey := strings.Join(parts, "\n")
+		now := time.Now()
+		if sig, ok := state.sigs[cacheKey]; ok && time.Unix(int64(sig.Expiration), 0).Sub(now) > signatureValidity/2 {
+			sigs = append(sigs, dns.Copy(sig))
+			continue
+		}
+
+		key, priv := s.zsk, s.zskPriv
+		if hdr.Rrtype == dns.TypeDNSKEY {
+			key, priv = s.ksk, s.kskPriv
+		}
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Ttl: hdr.Ttl},
+			Algorithm:  key.Algorithm,
+			KeyTag:     key.KeyTag(),
+			SignerName: s.Zone,
+			Inception:  uint32(now.Add(-signatureBackdate).Unix()),
+			Expiration: uint32(now.Add(signatureValidity).Unix()),
+		}
+		if err := sig.Sign(priv, rrset); err != nil {
+			log.Printf("Failed to sign %s %s: %v", hdr.Name, dns.TypeToString[hdr.Rrtype], err)
+			continue
+		}
+		// Owners synthesized from a wildcard are as many as the names clients make up, so only
+		// the signatures of the zone's own RRsets and NSEC3 chain are kept
+		if _, exists := state.zone.nodes[dns.CanonicalName(hdr.Name)]; exists || hdr.Rrtype == dns.TypeNSEC3 {
+			state.sigs[cacheKey] = sig
+		}
+		sigs = append(sigs, dns.Copy(sig))
+	}
+	return sigs
+}
+
+// groupRRsets splits records into RRsets, keeping the order in which each set first appears
+func groupRRsets(rrs []dns.RR) [][]dns.RR {
+	var sets [][]dns.RR
+	index := make(map[string]int)
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		k := key(hdr.Name, hdr.Rrtype)
+		if i, ok := index[k]; ok {
+			sets[i] = append(sets[i], rr)
+			continue
+		}
+		index[k] = len(sets)
+		sets = append(sets, []dns.RR{rr})
+	}
+	return sets
+}
+
+// stateFor returns the denial chain for zone, rebuilding it when a new snapshot is served
+func (s *Signer) stateFor(zone *Zone) *signedZone {
+	if s.state != nil && s.state.zone == zone {
+		return s.state
+	}
+	state := &signedZone{
+		zone:   zone,
+		ttl:    min(zone.SOA.Hdr.Ttl, zone.SOA.Minttl),
+		hashed: make(map[string]*dns.NSEC3),
+		sigs:   make(map[string]*dns.RRSIG),
+	}
+	// Names below a zone cut are glue and not part of the chain, the cut itself is
+	var names []string
+	for name := range zone.nodes {
+		if zone.delegation(name, dns.TypeDS) == "" {
+			names = append(names, name)
+		}
+	}
+	slices.SortFunc(names, compareCanonical)
+
+	if s.NSEC3 {
+		state.buildNSEC3(names)
+	} else {
+		state.buildNSEC(names)
+	}
+	s.state = state
+	return state
+}
+
+// types returns the sorted record types present at name, as listed in NSEC and NSEC3 bitmaps
+func (z *signedZone) types(name string, extra ...uint16) []uint16 {
+	types := extra
+	// Only the NS and DS records at a zone cut are authoritative data of this zone
+	cut := name != z.zone.Origin && len(z.zone.rrset(name, dns.TypeNS)) > 0
+	for _, rr := range z.zone.nodes[name] {
+		rrType := rr.Header().Rrtype
+		if cut && rrType != dns.TypeNS && rrType != dns.TypeDS {
+			continue
+		}
+		if !slices.Contains(types, rrType) {
+			types = append(types, rrType)
+		}
+	}
+	slices.Sort(types)
+	return types
+}
+
+// buildNSEC links the names of the zone into an NSEC chain in canonical order
+func (z *signedZone) buildNSEC(names []string) {
+	for i, name := range names {
+		z.nsec = append(z.nsec, &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: z.ttl},
+			NextDomain: names[(i+1)%len(names)],
+			TypeBitMap: z.types(name, dns.TypeNSEC, dns.TypeRRSIG),
+		})
+	}
+}
+
+// buildNSEC3 links the hashed names of the zone, including empty non-terminals, into an NSEC3 chain.
+// Hashes use no salt and no extra iterations, as RFC 9276 recommends.
+func (z *signedZone) buildNSEC3(names []string) {
+	all := make(map[string]bool)
+	for _, name := range names {
+		// Every ancestor up to the apex exists, possibly as an empty non-terminal
+		for n := name; dns.IsSubDomain(z.zone.Origin, n); n = parentName(n) {
+			all[n] = true
+			if n == z.zone.Origin {
+				break
+			}
+		}
+	}
+
+	for name := range all {
+		var types []uint16
+		if len(z.zone.nodes[name]) > 0 {
+			types = z.types(name, dns.TypeRRSIG)
+		}
+		hash := dns.HashName(name, dns.SHA1, 0, "")
+		z.hashed[hash] = &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: strings.ToLower(hash) + "." + z.zone.Origin, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: z.ttl},
+			Hash:       dns.SHA1,
+			HashLength: 20,
+			TypeBitMap: types,
+		}
+	}
+	hashes := make([]string, 0, len(z.hashed))
+	for hash := range z.hashed {
+		hashes = append(hashes, hash)
+	}
+	slices.Sort(hashes)
+	for i, hash := range hashes {
+		rr := z.hashed[hash]
+		rr.NextDomain = hashes[(i+1)%len(hashes)]
+		z.nsec3 = append(z.nsec3, rr)
+	}
+}
+
+// match returns the NSEC or NSEC3 record owned by (or hashed from) name, if any
+func (z *signedZone) match(name string, nsec3 bool) []dns.RR {
+	if nsec3 {
+		if rr, ok := z.hashed[dns.HashName(name, dns.SHA1, 0, "")]; ok {
+			return []dns.RR{dns.Copy(rr)}
+		}
+		return nil
+	}
+	for _, rr := range z.nsec {
+		if rr.Hdr.Name == name {
+			return []dns.RR{dns.Copy(rr)}
+		}
+	}
+	return nil
+}
+
+// cover returns the NSEC or NSEC3 record whose span covers name
+func (z *signedZone) cover(name string, nsec3 bool) dns.RR {
+	if nsec3 {
+		hash := dns.HashName(name, dns.SHA1, 0, "")
+		i, _ := slices.BinarySearchFunc(z.nsec3, hash, func(rr *dns.NSEC3, hash string) int {
+			return strings.Compare(strings.ToUpper(dns.SplitDomainName(rr.Hdr.Name)[0]), hash)
+		})
+		return dns.Copy(z.nsec3[(i-1+len(z.nsec3))%len(z.nsec3)])
+	}
+	i, _ := slices.BinarySearchFunc(z.nsec, name, func(rr *dns.NSEC, name string) int {
+		return compareCanonical(rr.Hdr.Name, name)
+	})
+	return dns.Copy(z.nsec[(i-1+len(z.nsec))%len(z.nsec)])
+}
+
+// closestEncloser returns the longest existing ancestor of a name that does not exist
+func (z *signedZone) closestEncloser(name string) string {
+	for n := parentName(name); ; n = parentName(n) {
+		if z.zone.exists(n) || n == z.zone.Origin {
+			return n
+		}
+	}
+}
+
+// denyName proves that qname does not exist and that no wildcard could have matched it
+func (z *signedZone) denyName(qname string, nsec3 bool) []dns.RR {
+	ce := z.closestEncloser(qname)
+	wildcard := "*." + ce
+	if !nsec3 {
+		return dedupeRRs(z.cover(qname, false), z.cover(wildcard, false))
+	}
+
+	// RFC 5155 section 7.2.2: closest encloser match, next closer and wildcard covers
+	proof := z.match(ce, true)
+	return dedupeRRs(append(proof, z.cover(nextCloserName(qname, ce), true), z.cover(wildcard, true))...)
+}
+
+// denyType proves that qname, or the wildcard answering for it, exists but has no data of the requested type
+func (z *signedZone) denyType(qname string, nsec3 bool) []dns.RR {
+	if proof := z.match(qname, nsec3); len(proof) > 0 {
+		return proof
+	}
+	if !z.zone.exists(qname) {
+		if wildcard := z.zone.wildcard(qname); wildcard != "" {
+			// The wildcard lacks the type and qname itself does not exist (RFC 4035 section 3.1.3.4,
+			// RFC 5155 section 7.2.5)
+			if !nsec3 {
+				return dedupeRRs(append([]dns.RR{z.cover(qname, false)}, z.match(wildcard, false)...)...)
+			}
+			ce := parentName(wildcard)
+			proof := append(z.match(ce, true), z.cover(nextCloserName(qname, ce), true))
+			return dedupeRRs(append(proof, z.match(wildcard, true)...)...)
+		}
+	}
+	// An empty non-terminal has no NSEC of its own, the record covering it proves it is empty
+	return []dns.RR{z.cover(qname, nsec3)}
+}
+
+// nextCloserName returns the ancestor of qname one label below its closest encloser ce
+func nextCloserName(qname, ce string) string {
+	nextCloser := qname
+	for parentName(nextCloser) != ce {
+		nextCloser = parentName(nextCloser)
+	}
+	return nextCloser
+}
+
+// dedupeRRs drops records that appear more than once
+func dedupeRRs(rrs ...dns.RR) []dns.RR {
+	var out []dns.RR
+	for _, rr := range rrs {
+		if !slices.ContainsFunc(out, func(o dns.RR) bool { return dns.IsDuplicate(o, rr) }) {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// parentName returns name with its leftmost label removed
+func parentName(name string) string {
+	if next, end := dns.NextLabel(name, 0); !end {
+		return name[next:]
+	}
+	return "."
+}
+
+// compareCanonical orders domain names canonically (RFC 4034 section 6.1): label by label
+// starting from the root, comparing lowercased labels as byte strings
+func compareCanonical(a, b string) int {
+	la, lb := dns.SplitDomainName(strings.ToLower(a)), dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// dnssecOK reports whether the client set the DO bit, asking for DNSSEC records
+func dnssecOK(r *dns.Msg) bool {
+	opt := r.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// withoutDNSSEC returns a copy of msg without the RRSIG, NSEC and NSEC3 records that clients which
+// did not set the DO bit should not see, unless they asked for those types
+func withoutDNSSEC(msg *dns.Msg, qType uint16) *dns.Msg {
+	out := msg.Copy()
+	filter := func(rrs []dns.RR) []dns.RR {
+		var kept []dns.RR
+		for _, rr := range rrs {
+			switch rrType := rr.Header().Rrtype; rrType {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				if rrType != qType {
+					continue
+				}
+			}
+			kept = append(kept, rr)
+		}
+		return kept
+	}
+	out.Answer, out.Ns, out.Extra = filter(out.Answer), filter(out.Ns), filter(out.Extra)
+	return out
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testSigner returns a signer with fresh keys for example.test. and denialTestZone with its keys added
+func testSigner(t *testing.T, nsec3 bool) (*Signer, *Zone) {
+	t.Helper()
+	signer, err := LoadOrGenerateSigner("example.test.", t.TempDir(), dns.ECDSAP256SHA256, nsec3)
+	if err != nil {
+		t.Fatalf("LoadOrGenerateSigner: %v", err)
+	}
+	zone := parseTestZone(t, denialTestZone)
+	for _, rr := range signer.ZoneRecords() {
+		if err := zone.Add(rr); err != nil {
+			t.Fatalf("Add %s: %v", rr, err)
+		}
+	}
+	return signer, zone
+}
+
+func TestSignerNSECChain(t *testing.T) {
+	chain := denialChain(t, false)
+	want := []string{
+		"example.test.", "*.apps.example.test.", "host.apps.example.test.", "child.example.test.",
+		"x.deep.example.test.", "ns.example.test.", "www.example.test.",
+	}
+	var owners []string
+	for _, rr := range chain.nsec {
+		owners = append(owners, rr.Hdr.Name)
+	}
+	// Glue below the delegation and empty non-terminals have no NSEC records
+	if !slices.Equal(owners, want) {
+		t.Fatalf("Got NSEC owners %v, want %v", owners, want)
+	}
+	for i, rr := range chain.nsec {
+		if next := want[(i+1)%len(want)]; rr.NextDomain != next {
+			t.Errorf("NSEC at %s points to %s, want %s", rr.Hdr.Name, rr.NextDomain, next)
+		}
+	}
+
+	bitmaps := map[string][]uint16{
+		"www.example.test.":   {dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC},
+		"child.example.test.": {dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC},
+		"example.test.":       {dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeNSEC},
+	}
+	for _, rr := range chain.nsec {
+		if types, ok := bitmaps[rr.Hdr.Name]; ok && !slices.Equal(rr.TypeBitMap, types) {
+			t.Errorf("NSEC at %s lists %v, want %v", rr.Hdr.Name, rr.TypeBitMap, types)
+		}
+	}
+}
+
+func TestSignerNSEC3Chain(t *testing.T) {
+	chain := denialChain(t, true)
+	names := []string{
+		"example.test.", "*.apps.example.test.", "host.apps.example.test.", "child.example.test.",
+		"ns.example.test.", "x.deep.example.test.", "www.example.test.",
+		// empty non-terminals
+		"apps.example.test.", "deep.example.test.",
+	}
+	var want []string
+	for _, name := range names {
+		want = append(want, dns.HashName(name, dns.SHA1, 0, ""))
+	}
+	slices.Sort(want)
+
+	var hashes []string
+	for _, rr := range chain.nsec3 {
+		hashes = append(hashes, strings.ToUpper(dns.SplitDomainName(rr.Hdr.Name)[0]))
+	}
+	if !slices.Equal(hashes, want) {
+		t.Fatalf("Got NSEC3 hashes %v, want %v", hashes, want)
+	}
+	for i, rr := range chain.nsec3 {
+		if next := want[(i+1)%len(want)]; rr.NextDomain != next {
+			t.Errorf("NSEC3 %s points to %s, want %s", hashes[i], rr.NextDomain, next)
+		}
+		if !strings.HasSuffix(rr.Hdr.Name, ".example.test.") || rr.Iterations != 0 || rr.SaltLength != 0 {
+			t.Errorf("NSEC3 %s is not an unsalted record in the zone", rr)
+		}
+	}
+	ent := chain.match("apps.example.test.", true)
+	if len(ent) != 1 || len(ent[0].(*dns.NSEC3).TypeBitMap) != 0 {
+		t.Errorf("Got %v for the empty non-terminal apps.example.test., want an NSEC3 without types", ent)
+	}
+}
+
+func TestSignerSignatures(t *testing.T) {
+	questions := []struct {
+		name  string
+		qType uint16
+	}{
+		{"www.example.test.", dns.TypeA},
+		{"example.test.", dns.TypeDNSKEY},
+		{"example.test.", dns.TypeSOA},
+		{"nope.example.test.", dns.TypeA},
+		{"www.example.test.", dns.TypeTXT},
+		{"a.apps.example.test.", dns.TypeA},
+		{"www.child.example.test.", dns.TypeA},
+	}
+	for _, nsec3 := range []bool{false, true} {
+		signer, zone := testSigner(t, nsec3)
+		keys := make(map[uint16]*dns.DNSKEY)
+		for _, rr := range signer.ZoneRecords() {
+			if key, ok := rr.(*dns.DNSKEY); ok {
+				keys[key.KeyTag()] = key
+			}
+		}
+
+		for _, q := range questions {
+			msg := zone.Lookup(q.name, q.qType)
+			signer.Sign(zone, msg, q.name, q.qType)
+			for section, rrs := range map[string][]dns.RR{"answer": msg.Answer, "authority": msg.Ns} {
+				signed := make(map[string]bool)
+				for _, rr := range rrs {
+					sig, ok := rr.(*dns.RRSIG)
+					if !ok {
+						continue
+					}
+					var rrset []dns.RR
+					for _, rr2 := range rrs {
+						if rr2.Header().Rrtype == sig.TypeCovered && strings.EqualFold(rr2.Header().Name, sig.Hdr.Name) {
+							rrset = append(rrset, rr2)
+						}
+					}
+					signingKey := keys[sig.KeyTag]
+					if signingKey == nil || (sig.TypeCovered == dns.TypeDNSKEY) != (signingKey.Flags&dns.SEP != 0) {
+						t.Errorf("NSEC3 %t: %s %s is signed with the wrong key %d", nsec3, q.name, section, sig.KeyTag)
+						continue
+					}
+					if err := sig.Verify(signingKey, rrset); err != nil || !sig.ValidityPeriod(time.Now()) {
+						t.Errorf("NSEC3 %t: signature %s over %v does not verify: %v", nsec3, sig, rrset, err)
+					}
+					signed[key(sig.Hdr.Name, sig.TypeCovered)] = true
+				}
+				for _, rr := range rrs {
+					hdr := rr.Header()
+					// Delegation NS records belong to the child and are not signed
+					referral := !msg.Authoritative && hdr.Rrtype == dns.TypeNS
+					if hdr.Rrtype != dns.TypeRRSIG && signed[key(hdr.Name, hdr.Rrtype)] == referral {
+						t.Errorf("NSEC3 %t: %s %s: %s signed %t, want %t", nsec3, q.name, section, rr, !referral, referral)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestSignerSynthesizedOwnersNotCached(t *testing.T) {
+	signer, zone := testSigner(t, false)
+	sign := func(name string) {
+		msg := zone.Lookup(name, dns.TypeA)
+		signer.Sign(zone, msg, name, dns.TypeA)
+		if len(msg.Answer) != 2 {
+			t.Fatalf("Got %v for %s, want a signed wildcard answer", msg.Answer, name)
+		}
+	}
+	sign("www.example.test.")
+	cached := len(signer.state.sigs)
+	for i := range 100 {
+		sign(fmt.Sprintf("random%d.apps.example.test.", i))
+	}
+	if len(signer.state.sigs) != cached {
+		t.Errorf("The signature cache grew from %d to %d with answers for made-up names", cached, len(signer.state.sigs))
+	}
+}
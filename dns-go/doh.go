@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dohMediaType is the media type of DNS messages carried over HTTPS (RFC 8484 section 6)
+const dohMediaType = "application/dns-message"
+
+// DoHHandler serves DNS over HTTPS (RFC 8484) by passing each GET or POST request to handler,
+// the same handler that serves plain DNS. tsigSecrets are used to verify signed requests.
+func DoHHandler(handler dns.Handler, tsigSecrets map[string]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var raw []byte
+		switch r.Method {
+		case http.MethodGet:
+			var err error
+			raw, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+			if err != nil || len(raw) == 0 {
+				http.Error(w, "missing or invalid dns parameter", http.StatusBadRequest)
+				return
+			}
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != dohMediaType {
+				http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			var err error
+			raw, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize+1))
+			if err != nil || len(raw) > dns.MaxMsgSize {
+				http.Error(w, "invalid request body", http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		req := new(dns.Msg)
+		if err := req.Unpack(raw); err != nil || len(req.Question) == 0 || len(req.Question) > maxQuestions {
+			http.Error(w, "malformed DNS message", http.StatusBadRequest)
+			return
+		}
+
+		rw := &dohResponseWriter{
+			local:       addrFromString(r.Context().Value(http.LocalAddrContextKey)),
+			remote:      addrFromString(r.RemoteAddr),
+			tsigSecrets: tsigSecrets,
+		}
+		if tsig := req.IsTsig(); tsig != nil {
+			secret, ok := tsigSecrets[dns.CanonicalName(tsig.Hdr.Name)]
+			rw.tsigStatus = dns.ErrSecret
+			if ok {
+				rw.tsigStatus = dns.TsigVerify(raw, secret, "", false)
+			}
+			rw.requestMAC = tsig.MAC
+		}
+		handler.ServeDNS(rw, req)
+
+		if rw.response == nil {
+			// The handler chose not to answer, as a UDP server would drop the query
+			http.Error(w, "no response", http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", dohMediaType)
+		w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(cacheTTL(rw.msg)/time.Second)))
+		w.Write(rw.response)
+	})
+}
+
+// dohResponseWriter implements dns.ResponseWriter for a single DoH exchange, holding on to the
+// packed response so it can be returned in the HTTP response body
+type dohResponseWriter struct {
+	local, remote net.Addr
+	tsigSecrets   map[string]string
+	tsigStatus    error
+	requestMAC    string
+	msg           *dns.Msg
+	response      []byte
+}
+
+// LocalAddr returns the address the HTTPS request was received on
+func (w *dohResponseWriter) LocalAddr() net.Addr { return w.local }
+
+// RemoteAddr returns the address of the HTTPS client
+func (w *dohResponseWriter) RemoteAddr() net.Addr { return w.remote }
+
+// WriteMsg packs and stores the response, signing it when it carries a TSIG record
+func (w *dohResponseWriter) WriteMsg(msg *dns.Msg) error {
+	if w.response != nil {
+		return errors.New("DoH exchanges carry a single response")
+	}
+	if tsig := msg.IsTsig(); tsig != nil {
+		secret, ok := w.tsigSecrets[dns.CanonicalName(tsig.Hdr.Name)]
+		if !ok {
+			return dns.ErrSecret
+		}
+		packed, _, err := dns.TsigGenerate(msg, secret, w.requestMAC, false)
+		if err != nil {
+			return err
+		}
+		w.msg, w.response = msg, packed
+		return nil
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	w.msg, w.response = msg, packed
+	return nil
+}
+
+// Write stores an already packed response
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(b); err != nil {
+		return 0, err
+	}
+	if w.response != nil {
+		return 0, errors.New("DoH exchanges carry a single response")
+	}
+	w.msg, w.response = msg, b
+	return len(b), nil
+}
+
+// Close is a no-op, the HTTP server owns the connection
+func (w *dohResponseWriter) Close() error { return nil }
+
+// TsigStatus returns the outcome of verifying the request's TSIG signature
+func (w *dohResponseWriter) TsigStatus() error { return w.tsigStatus }
+
+// TsigTimersOnly is a no-op, DoH carries a single signed message per exchange
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+
+// Hijack is a no-op, the HTTP server owns the connection
+func (w *dohResponseWriter) Hijack() {}
+
+// addrFromString converts an address as found on an http.Request into a *net.TCPAddr,
+// so handlers treat DoH clients like any other TCP client
+func addrFromString(addr any) net.Addr {
+	var s string
+	switch addr := addr.(type) {
+	case net.Addr:
+		s = addr.String()
+	case string:
+		s = addr
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", s)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return tcpAddr
+}
+
+// StartDoHServer starts the DNS over HTTPS server on addr, serving queries at /dns-query
+func StartDoHServer(addr string, handler dns.Handler, tsigSecrets map[string]string, tlsConfig *tls.Config) {
+	mux := http.NewServeMux()
+	mux.Handle("/dns-query", DoHHandler(handler, tsigSecrets))
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	log.Printf("Starting DNS over HTTPS server on %s", addr)
+	if err := server.ListenAndServeTLS("", ""); err != nil {
+		log.Fatalf("Failed to start DoH server: %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// testDoHHandler returns a DoH handler answering from a local domain home. holding www.home.
+func testDoHHandler(t *testing.T) http.Handler {
+	t.Helper()
+	zones := NewZoneSet()
+	view := &View{Name: defaultViewName, Local: NewLocalZone("home.", NewMemoryStore(), zones)}
+	setRecord(t, view.Local, "www.home.", dns.TypeA, testRecord(t, "www.home. 300 IN A 192.0.2.1"))
+	return DoHHandler(testHandler(view, zones), nil)
+}
+
+// packedQuery returns a packed query for name and type A
+func packedQuery(t *testing.T, name string) []byte {
+	t.Helper()
+	query := new(dns.Msg)
+	query.SetQuestion(name, dns.TypeA)
+	// RFC 8484 section 4.1 recommends ID 0 so responses are cacheable
+	query.Id = 0
+	raw, err := query.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+	return raw
+}
+
+// dohRequest sends a DoH request to handler and returns the response
+func dohRequest(handler http.Handler, method, target, contentType string, body []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, bytes.NewReader(body))
+	r.RemoteAddr = "192.0.2.10:4000"
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+// checkDoHAnswer checks that w holds the DNS answer for www.home.
+func checkDoHAnswer(t *testing.T, w *httptest.ResponseRecorder) {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d (%s), want %d", w.Code, strings.TrimSpace(w.Body.String()), http.StatusOK)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != dohMediaType {
+		t.Errorf("Got content type %q, want %q", ct, dohMediaType)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "max-age=300" {
+		t.Errorf("Got Cache-Control %q, want max-age=300 from the answer TTL", cc)
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(w.Body.Bytes()); err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	if msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 1 || msg.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Errorf("Got %s with answers %v, want 192.0.2.1", dns.RcodeToString[msg.Rcode], msg.Answer)
+	}
+}
+
+func TestDoHGet(t *testing.T) {
+	handler := testDoHHandler(t)
+	param := base64.RawURLEncoding.EncodeToString(packedQuery(t, "www.home."))
+	checkDoHAnswer(t, dohRequest(handler, http.MethodGet, "/dns-query?dns="+param, "", nil))
+
+	noQuestion, _ := new(dns.Msg).Pack()
+	for name, target := range map[string]string{
+		"missing parameter": "/dns-query",
+		"padded base64":     "/dns-query?dns=" + base64.URLEncoding.EncodeToString(packedQuery(t, "www.home.")),
+		"not base64":        "/dns-query?dns=%25%25%25",
+		"not a DNS message": "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString([]byte("hello")),
+		"no question":       "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(noQuestion),
+	} {
+		if w := dohRequest(handler, http.MethodGet, target, "", nil); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", name, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestDoHPost(t *testing.T) {
+	handler := testDoHHandler(t)
+	checkDoHAnswer(t, dohRequest(handler, http.MethodPost, "/dns-query", dohMediaType, packedQuery(t, "www.home.")))
+
+	tests := []struct {
+		name, contentType string
+		body              []byte
+		status            int
+	}{
+		{"no content type", "", packedQuery(t, "www.home."), http.StatusUnsupportedMediaType},
+		{"JSON", "application/json", []byte(`{"name":"www.home."}`), http.StatusUnsupportedMediaType},
+		{"text", "text/plain", packedQuery(t, "www.home."), http.StatusUnsupportedMediaType},
+		{"not a DNS message", dohMediaType, []byte("hello"), http.StatusBadRequest},
+		{"too large", dohMediaType, make([]byte, dns.MaxMsgSize+1), http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		if w := dohRequest(handler, http.MethodPost, "/dns-query", test.contentType, test.body); w.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, w.Code, test.status)
+		}
+	}
+}
+
+func TestDoHMethods(t *testing.T) {
+	handler := testDoHHandler(t)
+	for _, method := range []string{http.MethodPut, http.MethodDelete, http.MethodPatch, http.MethodHead} {
+		w := dohRequest(handler, method, "/dns-query", dohMediaType, packedQuery(t, "www.home."))
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s: got status %d, want %d", method, w.Code, http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func TestDoHNoResponse(t *testing.T) {
+	// A handler dropping the query, as response policies and rate limiting do
+	handler := DoHHandler(dns.HandlerFunc(func(dns.ResponseWriter, *dns.Msg) {}), nil)
+	w := dohRequest(handler, http.MethodPost, "/dns-query", dohMediaType, packedQuery(t, "www.home."))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("Got status %d for a dropped query, want %d", w.Code, http.StatusBadGateway)
+	}
+}
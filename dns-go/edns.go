@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// serverUDPSize is the EDNS buffer size dns-go advertises to clients and upstreams, and the most
+// it sends over UDP, small enough to avoid IP fragmentation (DNS flag day 2020)
+const serverUDPSize = 1232
+
+// paddingBlockSize is the block size responses over encrypted transports are padded to, so
+// their length reveals little about the names in them (RFC 8467 section 4.1)
+const paddingBlockSize = 468
+
+// EDNS Client Subnet policies, deciding what happens to the ECS option of queries (RFC 7871)
+const (
+	// ECSStrip removes ECS from queries before forwarding them, keeping client networks private
+	ECSStrip = "strip"
+	// ECSPass forwards ECS to the upstreams and echoes their scope back. Such answers are
+	// tailored to the client network, so they bypass the cache.
+	ECSPass = "pass"
+)
+
+// checkECSPolicy validates an ECS policy name
+func checkECSPolicy(policy string) error {
+	if policy != ECSStrip && policy != ECSPass {
+		return fmt.Errorf("invalid ECS policy %q, must be strip or pass", policy)
+	}
+	return nil
+}
+
+// badVersion answers r with BADVERS if it uses an EDNS version dns-go does not speak and reports
+// whether it did (RFC 6891 section 6.1.3)
+func badVersion(w dns.ResponseWriter, r *dns.Msg) bool {
+	opt := r.IsEdns0()
+	if opt == nil || opt.Version() == 0 {
+		return false
+	}
+	response := new(dns.Msg)
+	response.SetRcode(r, dns.RcodeBadVers)
+	response.SetEdns0(serverUDPSize, opt.Do())
+	w.WriteMsg(response)
+	return true
+}
+
+// upstreamQuery returns the query to forward for r. It always carries EDNS with the DO bit so
+// upstreams send whole answers, DNSSEC records included, which are cached for every client and
+// cut down per client later. It carries ECS only under ECSPass.
+func upstreamQuery(r *dns.Msg, ecsPolicy string) *dns.Msg {
+	query := r.Copy()
+	opt := query.IsEdns0()
+	if opt == nil {
+		query.SetEdns0(serverUDPSize, true)
+		return query
+	}
+	opt.SetUDPSize(serverUDPSize)
+	opt.SetDo()
+	var options []dns.EDNS0
+	for _, option := range opt.Option {
+		switch option.(type) {
+		case *dns.EDNS0_SUBNET:
+			if ecsPolicy != ECSPass {
+				continue
+			}
+		case *dns.EDNS0_PADDING, *dns.EDNS0_COOKIE, *dns.EDNS0_TCP_KEEPALIVE:
+			// These concern the hop between the client and dns-go only
+			continue
+		}
+		options = append(options, option)
+	}
+	opt.Option = options
+	return query
+}
+
+// subnetOption returns the ECS option of msg, if any
+func subnetOption(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, option := range opt.Option {
+		if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// fitResponse negotiates EDNS for response and makes it fit the transport of w. Clients that
+// sent EDNS get an OPT record with options added and, over encrypted transports, padding. UDP
+// responses are truncated to the smaller of the client's buffer size and serverUDPSize, or to
+// 512 bytes without EDNS, with TC set so the client retries over TCP.
+func fitResponse(w dns.ResponseWriter, r, response *dns.Msg, options []dns.EDNS0) {
+	size := dns.MinMsgSize
+	opt := r.IsEdns0()
+	if opt != nil {
+		response.SetEdns0(serverUDPSize, opt.Do())
+		edns := response.IsEdns0()
+		edns.Option = append(edns.Option, options...)
+		size = max(dns.MinMsgSize, min(int(opt.UDPSize()), serverUDPSize))
+	}
+
+	switch transport(w) {
+	case "udp":
+		response.Truncate(size)
+	case "dot", "doh":
+		if opt != nil {
+			pad(response)
+		}
+	}
+}
+
+// pad adds a padding option growing msg to a multiple of paddingBlockSize (RFC 7830)
+func pad(msg *dns.Msg) {
+	padding := new(dns.EDNS0_PADDING)
+	edns := msg.IsEdns0()
+	edns.Option = append(edns.Option, padding)
+	if rem := msg.Len() % paddingBlockSize; rem != 0 {
+		padding.Padding = make([]byte, paddingBlockSize-rem)
+	}
+}
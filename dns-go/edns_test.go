@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestUpstreamQueryDNSSEC(t *testing.T) {
+	plain := new(dns.Msg)
+	plain.SetQuestion("example.test.", dns.TypeA)
+	withEDNS := plain.Copy()
+	withEDNS.SetEdns0(1232, false)
+
+	// Answers are cached for every client, so they are fetched with DNSSEC records whether the
+	// client asked for them or not
+	for name, r := range map[string]*dns.Msg{"without EDNS": plain, "without DO": withEDNS} {
+		query := upstreamQuery(r, ECSStrip)
+		if opt := query.IsEdns0(); opt == nil || !opt.Do() || opt.UDPSize() != serverUDPSize {
+			t.Errorf("%s: got OPT %v, want DO set and a UDP size of %d", name, opt, serverUDPSize)
+		}
+		if r.IsEdns0() != nil && r.IsEdns0().Do() {
+			t.Errorf("%s: the client query was changed", name)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// etcdTimeout bounds every etcd request, so a lost cluster cannot stall DNS answers for long
+const etcdTimeout = 2 * time.Second
+
+// EtcdStore implements DNSRecordStore in etcd, letting several dns-go instances share their local
+// records. Each record is stored as a packed DNS message under prefix. Reads are served from a copy
+// of the records kept current by Watch, so queries never wait for the cluster; writes go to etcd
+// first and fail when it cannot take them.
+type EtcdStore struct {
+	client *clientv3.Client
+	prefix string
+
+	// writeMu is held across writes through the store, so Watch, taking it too, sees them applied
+	// before their own events arrive and does not report them as changes by others
+	writeMu sync.Mutex
+	mu      sync.RWMutex
+	records map[string][]byte // packed records by key
+	revs    map[string]int64  // etcd revision of the last change applied to each key, deletions included
+	loaded  int64             // etcd revision the copy is known to be current at
+}
+
+// NewEtcdStore connects to the etcd cluster at endpoints and returns an EtcdStore keeping records
+// under prefix, loaded with the records already there
+func NewEtcdStore(endpoints []string, prefix string) (*EtcdStore, error) {
+	client, err := clientv3.New(clientv3.Config{Endpoints: endpoints, DialTimeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("connecting to etcd: %w", err)
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	s := &EtcdStore{client: client, prefix: prefix, records: make(map[string][]byte), revs: make(map[string]int64)}
+	if _, err := s.load(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get retrieves a DNS record for a given domain and query type
+func (s *EtcdStore) Get(domain string, qType uint16) (*dns.Msg, bool) {
+	s.mu.RLock()
+	data, ok := s.records[key(domain, qType)]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	msg, err := unpackRecord(data)
+	if err != nil {
+		log.Printf("Failed to decode %s %s from etcd: %v", domain, dns.TypeToString[qType], err)
+		return nil, false
+	}
+	return msg, true
+}
+
+// Set stores a DNS record for a given domain and query type
+func (s *EtcdStore) Set(domain string, qType uint16, msg *dns.Msg) error {
+	data, err := msg.Pack()
+	if err != nil {
+		return fmt.Errorf("packing %s %s: %w", domain, dns.TypeToString[qType], err)
+	}
+	k := key(domain, qType)
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	response, err := s.client.Put(ctx, s.prefix+k, string(data))
+	if err != nil {
+		return fmt.Errorf("storing %s %s in etcd: %w", domain, dns.TypeToString[qType], err)
+	}
+	s.mu.Lock()
+	s.apply(k, data, response.Header.Revision)
+	s.mu.Unlock()
+	return nil
+}
+
+// Delete removes the DNS record for a given domain and query type
+func (s *EtcdStore) Delete(domain string, qType uint16) error {
+	k := key(domain, qType)
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	response, err := s.client.Delete(ctx, s.prefix+k)
+	if err != nil {
+		return fmt.Errorf("deleting %s %s from etcd: %w", domain, dns.TypeToString[qType], err)
+	}
+	s.mu.Lock()
+	s.apply(k, nil, response.Header.Revision)
+	s.mu.Unlock()
+	return nil
+}
+
+// GetAll retrieves all stored DNS records
+func (s *EtcdStore) GetAll() map[string]*dns.Msg {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	records := make(map[string]*dns.Msg, len(s.records))
+	for k, data := range s.records {
+		msg, err := unpackRecord(data)
+		if err != nil {
+			log.Printf("Failed to decode %s from etcd: %v", k, err)
+			continue
+		}
+		records[k] = msg
+	}
+	return records
+}
+
+// Close closes the connection to etcd
+func (s *EtcdStore) Close() error {
+	return s.client.Close()
+}
+
+// Watch keeps the records current with the changes made by other dns-go instances sharing the
+// cluster and calls onChange after each. Changes made through this store were applied when they
+// were made, so they are not reported again. It returns when the store is closed.
+func (s *EtcdStore) Watch(onChange func()) {
+	for {
+		s.mu.RLock()
+		from := s.loaded + 1
+		s.mu.RUnlock()
+
+		ctx, cancel := context.WithCancel(clientv3.WithRequireLeader(context.Background()))
+		for response := range s.client.Watch(ctx, s.prefix, clientv3.WithPrefix(), clientv3.WithRev(from)) {
+			if err := response.Err(); err != nil {
+				log.Printf("etcd watch failed: %v", err)
+				break
+			}
+			changed := false
+			s.writeMu.Lock()
+			s.mu.Lock()
+			for _, event := range response.Events {
+				var data []byte
+				if event.Type == clientv3.EventTypePut {
+					data = event.Kv.Value
+				}
+				changed = s.apply(strings.TrimPrefix(string(event.Kv.Key), s.prefix), data, event.Kv.ModRevision) || changed
+			}
+			s.loaded = max(s.loaded, response.Header.Revision)
+			s.mu.Unlock()
+			s.writeMu.Unlock()
+			if changed {
+				onChange()
+			}
+		}
+		cancel()
+
+		// Catch up with whatever the watch missed, then watch again
+		for {
+			if s.client.Ctx().Err() != nil {
+				return
+			}
+			s.writeMu.Lock()
+			changed, err := s.load()
+			s.writeMu.Unlock()
+			if err == nil {
+				if changed {
+					onChange()
+				}
+				break
+			}
+			log.Printf("Failed to reload records from etcd: %v", err)
+			time.Sleep(etcdTimeout)
+		}
+	}
+}
+
+// load reads every record under the prefix into the copy and reports whether that changed it
+func (s *EtcdStore) load() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	response, err := s.client.Get(ctx, s.prefix, clientv3.WithPrefix())
+	if err != nil {
+		return false, fmt.Errorf("reading records from etcd: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	present := make(map[string]bool, len(response.Kvs))
+	for _, kv := range response.Kvs {
+		k := strings.TrimPrefix(string(kv.Key), s.prefix)
+		present[k] = true
+		changed = s.apply(k, kv.Value, kv.ModRevision) || changed
+	}
+	for k := range s.records {
+		if !present[k] {
+			// Deleted at or before the revision read
+			changed = s.apply(k, nil, response.Header.Revision) || changed
+		}
+	}
+	s.loaded = max(s.loaded, response.Header.Revision)
+	return changed, nil
+}
+
+// apply puts the record stored under k at revision rev into the copy, or removes it when data is
+// nil, unless a later change to k was applied already. It reports whether the copy changed and
+// must be called with s.mu held.
+func (s *EtcdStore) apply(k string, data []byte, rev int64) bool {
+	if rev <= s.revs[k] {
+		return false
+	}
+	s.revs[k] = rev
+	if data == nil {
+		if _, ok := s.records[k]; !ok {
+			return false
+		}
+		delete(s.records, k)
+		return true
+	}
+	s.records[k] = data
+	return true
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Resolver answers queries on behalf of clients, either by relaying them to upstreams or by
+// resolving them itself
+type Resolver interface {
+	Exchange(r *dns.Msg) (*dns.Msg, error)
+}
+
+// Forwarder chooses the upstream pool for a query. Names under a forward zone go to that
+// zone's upstreams, picking the longest matching zone; everything else goes to the default resolver.
+type Forwarder struct {
+	zones    map[string]*UpstreamPool
+	fallback Resolver
+}
+
+// NewForwarder initializes and returns a new Forwarder sending unmatched queries to fallback
+func NewForwarder(fallback Resolver) *Forwarder {
+	return &Forwarder{zones: make(map[string]*UpstreamPool), fallback: fallback}
+}
+
+// AddZone forwards queries for zone and every name below it to upstreams
+func (f *Forwarder) AddZone(zone string, upstreams *UpstreamPool) {
+	f.zones[dns.CanonicalName(zone)] = upstreams
+}
+
+// Match returns the resolver responsible for name and the forward zone that matched it.
+// The zone is empty when name falls through to the default resolver.
+func (f *Forwarder) Match(name string) (Resolver, string) {
+	name = dns.CanonicalName(name)
+	for _, offset := range dns.Split(name) {
+		if upstreams, ok := f.zones[name[offset:]]; ok {
+			return upstreams, name[offset:]
+		}
+	}
+	if upstreams, ok := f.zones["."]; ok {
+		return upstreams, "."
+	}
+	return f.fallback, ""
+}
+
+// Exchange forwards r to the upstreams responsible for its first question
+func (f *Forwarder) Exchange(r *dns.Msg) (*dns.Msg, error) {
+	if len(r.Question) == 0 {
+		return f.fallback.Exchange(r)
+	}
+	upstreams, _ := f.Match(r.Question[0].Name)
+	return upstreams.Exchange(r)
+}
+
+// RunHealthChecks starts active health probes for the default pool and every forward zone pool
+func (f *Forwarder) RunHealthChecks(interval time.Duration) {
+	for _, upstreams := range f.zones {
+		go upstreams.RunHealthChecks(interval)
+	}
+	if upstreams, ok := f.fallback.(*UpstreamPool); ok {
+		upstreams.RunHealthChecks(interval)
+	}
+}
+
+// ForwardZones maps forward zones to their upstream servers. It implements flag.Value so
+// rules can be given as repeated -forward-zone flags of the form "corp.example.=10.0.0.53,10.0.0.54".
+type ForwardZones map[string][]string
+
+// String returns the rules in flag syntax
+func (z ForwardZones) String() string {
+	var rules []string
+	for zone, upstreams := range z {
+		rules = append(rules, fmt.Sprintf("%s=%v", zone, upstreams))
+	}
+	return fmt.Sprint(rules)
+}
+
+// Set parses a single "zone=upstream[,upstream...]" rule
+func (z ForwardZones) Set(value string) error {
+	zone, upstreams, err := parseZoneServers(value)
+	if err != nil {
+		return err
+	}
+	z[zone] = upstreams
+	return nil
+}
+
+// SecondaryZones maps secondary zones to their primaries. It implements flag.Value so zones
+// can be given as repeated -secondary flags of the form "lab.example.=10.0.0.1,10.0.0.2".
+type SecondaryZones map[string][]string
+
+// String returns the zones in flag syntax
+func (z SecondaryZones) String() string {
+	return ForwardZones(z).String()
+}
+
+// Set parses a single "zone=primary[,primary...]" entry
+func (z SecondaryZones) Set(value string) error {
+	return ForwardZones(z).Set(value)
+}
+
+// parseZoneServers parses a "zone=server[,server...]" flag value
+func parseZoneServers(value string) (string, []string, error) {
+	zone, list, ok := strings.Cut(value, "=")
+	if !ok {
+		return "", nil, fmt.Errorf("%q must have the form zone=server[,server...]", value)
+	}
+	if _, valid := dns.IsDomainName(zone); !valid || zone == "" {
+		return "", nil, fmt.Errorf("invalid zone %q", zone)
+	}
+	servers := splitList(list)
+	if len(servers) == 0 {
+		return "", nil, fmt.Errorf("zone %q has no servers", zone)
+	}
+	return dns.Fqdn(zone), servers, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testPool returns an UpstreamPool for addr that is never asked anything
+func testPool(t *testing.T, addr string) *UpstreamPool {
+	t.Helper()
+	pool, err := NewUpstreamPool("test-forward", []string{addr}, PolicySequential, time.Second)
+	if err != nil {
+		t.Fatalf("NewUpstreamPool: %v", err)
+	}
+	return pool
+}
+
+func TestForwarderMatch(t *testing.T) {
+	fallback := testPool(t, "192.0.2.1")
+	forwarder := NewForwarder(fallback)
+	forwarder.AddZone("corp.example.", testPool(t, "192.0.2.2"))
+	forwarder.AddZone("Eng.Corp.Example", testPool(t, "192.0.2.3"))
+	forwarder.AddZone("10.in-addr.arpa.", testPool(t, "192.0.2.4"))
+
+	tests := []struct {
+		name string
+		zone string
+	}{
+		{"corp.example.", "corp.example."},
+		{"www.corp.example.", "corp.example."},
+		{"WWW.CORP.EXAMPLE.", "corp.example."},
+		{"eng.corp.example.", "eng.corp.example."},
+		{"build.eng.corp.example.", "eng.corp.example."},
+		{"build.ENG.corp.example", "eng.corp.example."},
+		{"1.0.0.10.in-addr.arpa.", "10.in-addr.arpa."},
+		// Zones match whole labels only
+		{"notcorp.example.", ""},
+		{"example.", ""},
+		{"www.example.test.", ""},
+	}
+	for _, test := range tests {
+		resolver, zone := forwarder.Match(test.name)
+		if zone != test.zone {
+			t.Errorf("%s matched zone %q, want %q", test.name, zone, test.zone)
+		}
+		if zone == "" && resolver != Resolver(fallback) {
+			t.Errorf("%s did not fall through to the default resolver", test.name)
+		}
+	}
+
+	// A forward zone for the root takes everything no other zone matches
+	root := testPool(t, "192.0.2.5")
+	forwarder.AddZone(".", root)
+	for name, want := range map[string]string{"www.example.test.": ".", ".": ".", "www.corp.example.": "corp.example."} {
+		resolver, zone := forwarder.Match(name)
+		if zone != want {
+			t.Errorf("%s matched zone %q with a root forward zone, want %q", name, zone, want)
+		}
+		if zone == "." && resolver != Resolver(root) {
+			t.Errorf("%s was not sent to the root forward zone's upstreams", name)
+		}
+	}
+}
+
+func TestForwarderExchange(t *testing.T) {
+	fallback, corp := startUpstream(t), startUpstream(t)
+	forwarder := NewForwarder(testPool(t, fallback.addr))
+	forwarder.AddZone("corp.example.", testPool(t, corp.addr))
+
+	for _, name := range []string{"www.corp.example.", "www.example.test."} {
+		query := new(dns.Msg)
+		query.SetQuestion(name, dns.TypeA)
+		if _, err := forwarder.Exchange(query); err != nil {
+			t.Fatalf("Exchange %s: %v", name, err)
+		}
+	}
+	if corp.queries.Load() != 1 || fallback.queries.Load() != 1 {
+		t.Errorf("Got %d queries at the forward zone's upstream and %d at the default one, want 1 each",
+			corp.queries.Load(), fallback.queries.Load())
+	}
+}
+
+func TestForwardZonesFlag(t *testing.T) {
+	zones := make(ForwardZones)
+	if err := zones.Set("corp.example=10.0.0.53, 10.0.0.54"); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if servers := zones["corp.example."]; len(servers) != 2 || servers[0] != "10.0.0.53" || servers[1] != "10.0.0.54" {
+		t.Errorf("Got %v, want both servers for corp.example.", zones)
+	}
+	for _, value := range []string{"corp.example.", "corp.example.=", "=10.0.0.53", "bad..name=10.0.0.53"} {
+		if err := zones.Set(value); err == nil {
+			t.Errorf("Set(%q) succeeded, want an error", value)
+		}
+	}
+}
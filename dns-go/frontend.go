@@ -11,15 +11,23 @@ import (
 	"github.com/miekg/dns"
 )
 
-// StartFrontend starts the HTTP server for the UI and metrics
-func StartFrontend(localDomain string, localStore, cacheStore DNSRecordStore) {
+// StartFrontend starts the HTTP server for the UI, the JSON API and metrics
+func StartFrontend(localDomain string, localStore, cacheStore DNSRecordStore, api *API) {
 	http.Handle("/metrics", promhttp.Handler()) // Expose Prometheus metrics
 
+	// Versioned JSON API for managing local records
+	http.Handle("/api/", api.Handler())
+
 	// Serve the static CSS file for better styling
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
 
 	// Status page for DNS records
 	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		// The UI shows and changes the same records as the API, for the same clients
+		if !api.Authorized(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		fmt.Fprintln(w, "<link rel=\"stylesheet\" type=\"text/css\" href=\"/static/style.css\">")
 		fmt.Fprintln(w, "<h1>DNS Records and Cache Status</h1>")
@@ -53,6 +61,10 @@ func StartFrontend(localDomain string, localStore, cacheStore DNSRecordStore) {
 
 	// Handle adding new local DNS records via POST
 	http.HandleFunc("/add-record", func(w http.ResponseWriter, r *http.Request) {
+		if !api.Authorized(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
 		if r.Method == "POST" {
 			// Parse the form data
 			err := r.ParseForm()
@@ -81,7 +93,11 @@ func StartFrontend(localDomain string, localStore, cacheStore DNSRecordStore) {
 			// Save it to the local store
 			msg := new(dns.Msg)
 			msg.Answer = append(msg.Answer, record)
-			localStore.Set(domain, record.Header().Rrtype, msg)
+			if err := localStore.Set(domain, record.Header().Rrtype, msg); err != nil {
+				log.Printf("Failed to add %s: %v", domain, err)
+				http.Error(w, "Failed to store record", http.StatusServiceUnavailable)
+				return
+			}
 
 			// Redirect to the status page
 			http.Redirect(w, r, "/status", http.StatusFound)
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// localNegativeTTL is the TTL of the synthesized SOA and NS records of the local domain,
+// and so how long clients may cache negative answers from it
+const localNegativeTTL = 60
+
+// LocalZone serves the local domain as an authoritative zone. It wraps the local record store,
+// bumping the zone serial on every change, and layers the stored records over the zone file
+// loaded for the same origin, if any. It implements DNSRecordStore so every writer goes through it.
+type LocalZone struct {
+	Domain string
+
+	// OnChange, if set, is called after every change to the local records
+	OnChange func()
+	// Signer, if set, signs the zone with DNSSEC
+	Signer *Signer
+	// SynthesizePTR answers reverse lookups for the addresses of local hosts with their names
+	SynthesizePTR bool
+
+	store DNSRecordStore
+	zones *ZoneSet
+
+	mu       sync.Mutex
+	serial   uint32
+	snapshot *Zone
+	base     *Zone // zone file the snapshot was built on
+	built    uint32
+	ptrs     map[string][]dns.RR // PTR records for the A and AAAA records of the snapshot, by reverse name
+}
+
+// NewLocalZone initializes and returns a new LocalZone for domain backed by store.
+// The serial starts at the current Unix time so it keeps increasing across restarts.
+func NewLocalZone(domain string, store DNSRecordStore, zones *ZoneSet) *LocalZone {
+	return &LocalZone{
+		Domain: dns.CanonicalName(domain),
+		store:  store,
+		zones:  zones,
+		serial: uint32(time.Now().Unix()),
+	}
+}
+
+// Contains reports whether name is at or below the local domain
+func (l *LocalZone) Contains(name string) bool {
+	return dns.IsSubDomain(l.Domain, name)
+}
+
+// Get retrieves a record from the local store
+func (l *LocalZone) Get(domain string, qType uint16) (*dns.Msg, bool) {
+	return l.store.Get(domain, qType)
+}
+
+// Set stores a record in the local store and advances the zone serial
+func (l *LocalZone) Set(domain string, qType uint16, msg *dns.Msg) error {
+	if err := l.store.Set(domain, qType, msg); err != nil {
+		return err
+	}
+	l.changed()
+	return nil
+}
+
+// Delete removes a record from the local store and advances the zone serial
+func (l *LocalZone) Delete(domain string, qType uint16) error {
+	if err := l.store.Delete(domain, qType); err != nil {
+		return err
+	}
+	l.changed()
+	return nil
+}
+
+// changed advances the serial after a change to the local records and reports it
+func (l *LocalZone) changed() {
+	l.mu.Lock()
+	next := max(l.serial+1, uint32(time.Now().Unix()))
+	if base, ok := l.zones.Get(l.Domain); ok && serialNewer(base.SOA.Serial, next) {
+		next = base.SOA.Serial + 1
+	}
+	l.serial = next
+	l.mu.Unlock()
+
+	if l.OnChange != nil {
+		l.OnChange()
+	}
+}
+
+// GetAll retrieves all records in the local store
+func (l *LocalZone) GetAll() map[string]*dns.Msg {
+	return l.store.GetAll()
+}
+
+// Serial returns the current serial of the local zone
+func (l *LocalZone) Serial() uint32 {
+	return l.Snapshot().SOA.Serial
+}
+
+// Snapshot returns the local domain as a Zone: the zone file for the domain (or a synthesized
+// SOA and NS when there is none) plus every record in the local store. The snapshot is rebuilt
+// only when the serial or the zone file changes, and must not be modified by callers.
+func (l *LocalZone) Snapshot() *Zone {
+	base, _ := l.zones.Get(l.Domain)
+
+	l.mu.Lock()
+	if l.snapshot != nil && l.built == l.serial && l.base == base {
+		zone := l.snapshot
+		l.mu.Unlock()
+		return zone
+	}
+	serial := l.serial
+	l.mu.Unlock()
+
+	// The store is read without holding the lock, so a slow store does not hold up queries
+	// answered from the current snapshot. Changes made meanwhile advance the serial again.
+	zone := NewZone(l.Domain)
+	if base != nil {
+		for _, rr := range base.Records() {
+			zone.Add(dns.Copy(rr))
+		}
+		if serialNewer(serial, zone.SOA.Serial) {
+			zone.SOA.Serial = serial
+		}
+	} else {
+		zone.Add(localSOA(l.Domain, serial))
+		zone.Add(&dns.NS{
+			Hdr: dns.RR_Header{Name: l.Domain, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: localNegativeTTL},
+			Ns:  "ns." + l.Domain,
+		})
+	}
+	if l.Signer != nil {
+		for _, rr := range l.Signer.ZoneRecords() {
+			zone.Add(rr)
+		}
+	}
+	for _, msg := range l.store.GetAll() {
+		for _, rr := range msg.Answer {
+			if !l.Contains(rr.Header().Name) {
+				// Reverse records registered through dynamic updates live outside the local domain
+				continue
+			}
+			rr = dns.Copy(rr)
+			if rr.Header().Class == 0 {
+				// Records added through the UI carry no class
+				rr.Header().Class = dns.ClassINET
+			}
+			zone.Add(rr)
+		}
+	}
+
+	ptrs := reverseRecords(zone)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.snapshot == nil || serialNewer(serial, l.built) || l.base != base {
+		l.snapshot, l.base, l.built = zone, base, serial
+		l.ptrs = ptrs
+	}
+	return zone
+}
+
+// PTR returns the PTR records synthesized for name, the reverse name of an address local hosts
+// have A or AAAA records for, so reverse lookups work without maintaining reverse records
+func (l *LocalZone) PTR(name string) (*dns.Msg, bool) {
+	if !l.SynthesizePTR || !isReverseName(name) {
+		return nil, false
+	}
+	l.Snapshot()
+	l.mu.Lock()
+	ptrs := l.ptrs[dns.CanonicalName(name)]
+	l.mu.Unlock()
+	if len(ptrs) == 0 {
+		return nil, false
+	}
+	msg := new(dns.Msg)
+	msg.Authoritative = true
+	msg.Answer = copyRRs(ptrs)
+	return msg, true
+}
+
+// reverseRecords returns PTR records pointing back to the owners of the A and AAAA records of zone,
+// keyed by reverse name. Wildcards stand for many names, so they get none.
+func reverseRecords(zone *Zone) map[string][]dns.RR {
+	ptrs := make(map[string][]dns.RR)
+	for _, rr := range zone.Records() {
+		var addr string
+		switch rr := rr.(type) {
+		case *dns.A:
+			addr = rr.A.String()
+		case *dns.AAAA:
+			addr = rr.AAAA.String()
+		default:
+			continue
+		}
+		hdr := rr.Header()
+		if strings.HasPrefix(hdr.Name, "*.") {
+			continue
+		}
+		reverse, err := dns.ReverseAddr(addr)
+		if err != nil {
+			continue
+		}
+		ptrs[reverse] = append(ptrs[reverse], &dns.PTR{
+			Hdr: dns.RR_Header{Name: reverse, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: hdr.Ttl},
+			Ptr: dns.CanonicalName(hdr.Name),
+		})
+	}
+	return ptrs
+}
+
+// Lookup answers a query for a name in the local domain from the current snapshot.
+// With dnssec set and a Signer configured the answer carries RRSIG and NSEC or NSEC3 records.
+func (l *LocalZone) Lookup(name string, qType uint16, dnssec bool) *dns.Msg {
+	zone := l.Snapshot()
+	msg := zone.Lookup(name, qType)
+	if dnssec && l.Signer != nil {
+		l.Signer.Sign(zone, msg, name, qType)
+	}
+	return msg
+}
+
+// localSOA synthesizes the SOA record for a local domain that has no zone file
+func localSOA(localDomain string, serial uint32) *dns.SOA {
+	zone := dns.Fqdn(localDomain)
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: localNegativeTTL},
+		Ns:      "ns." + zone,
+		Mbox:    "hostmaster." + zone,
+		Serial:  serial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  localNegativeTTL,
+	}
+}
+
+// serialNewer reports whether serial a is newer than b using RFC 1982 serial number arithmetic
+func serialNewer(a, b uint32) bool {
+	return a != b && int32(a-b) > 0
+}
@@ -1,16 +1,20 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"log"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/miekg/dns"
 )
 
 // StartDNSUDPServer starts the DNS UDP server
-func StartDNSUDPServer(localDomain string, localStore DNSRecordStore, cacheStore DNSRecordStore) {
-	server := &dns.Server{Addr: ":53", Net: "udp"}
-	dns.HandleFunc(".", DNSHandler(localDomain, localStore, cacheStore))
+func StartDNSUDPServer(handler dns.Handler, tsigSecrets map[string]string) {
+	server := &dns.Server{Addr: ":53", Net: "udp", Handler: handler, TsigSecret: tsigSecrets, MsgAcceptFunc: acceptMsg}
 
 	log.Println("Starting DNS UDP server on :53")
 	if err := server.ListenAndServe(); err != nil {
@@ -19,9 +23,8 @@ func StartDNSUDPServer(localDomain string, localStore DNSRecordStore, cacheStore
 }
 
 // StartDNSTCPServer starts the DNS TCP server
-func StartDNSTCPServer(localDomain string, localStore DNSRecordStore, cacheStore DNSRecordStore) {
-	server := &dns.Server{Addr: ":53", Net: "tcp"}
-	dns.HandleFunc(".", DNSHandler(localDomain, localStore, cacheStore))
+func StartDNSTCPServer(handler dns.Handler, tsigSecrets map[string]string) {
+	server := &dns.Server{Addr: ":53", Net: "tcp", Handler: handler, TsigSecret: tsigSecrets, MsgAcceptFunc: acceptMsg}
 
 	log.Println("Starting DNS TCP server on :53")
 	if err := server.ListenAndServe(); err != nil {
@@ -29,20 +32,512 @@ func StartDNSTCPServer(localDomain string, localStore DNSRecordStore, cacheStore
 	}
 }
 
-// StartFrontendServer starts the frontend (e.g., Prometheus metrics and UI)
-func StartFrontendServer(localDomain string, localStore DNSRecordStore, cacheStore DNSRecordStore) {
+// StartDoTServer starts the DNS over TLS server (RFC 7858)
+func StartDoTServer(addr string, handler dns.Handler, tsigSecrets map[string]string, tlsConfig *tls.Config) {
+	server := &dns.Server{Addr: addr, Net: "tcp-tls", Handler: handler, TsigSecret: tsigSecrets, MsgAcceptFunc: acceptMsg, TLSConfig: tlsConfig}
+
+	log.Printf("Starting DNS over TLS server on %s", addr)
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatalf("Failed to start DoT server: %v", err)
+	}
+}
+
+// StartFrontendServer starts the frontend (e.g., Prometheus metrics, UI and API)
+func StartFrontendServer(localDomain string, localStore DNSRecordStore, cacheStore DNSRecordStore, api *API) {
 	log.Println("Starting frontend server")
-	StartFrontend(localDomain, localStore, cacheStore)
+	StartFrontend(localDomain, localStore, cacheStore, api)
 }
 
 func main() {
+	configPath := flag.String("config", "", "Path to a JSON config file; flags given on the command line override its values")
 	localDomain := flag.String("local-domain", "local.", "The local domain to use (e.g., 'mydomain')")
+	synthesizePTR := flag.Bool("synthesize-ptr", true, "Answer reverse lookups for the addresses of local hosts from their A and AAAA records")
+	cacheSize := flag.Int("cache-size", 10000, "Maximum number of upstream answers kept in the cache (0 for unlimited)")
+	ecsPolicy := flag.String("ecs", ECSStrip, "What to do with the EDNS Client Subnet option of forwarded queries: strip it, or pass it to the upstreams (answers are then not cached)")
+	serveStale := flag.Duration("serve-stale", 0, "Keep expired cache entries this long to answer with when every upstream fails, e.g. 24h (0 disables serving stale answers)")
+	staleAnswerTimeout := flag.Duration("stale-answer-timeout", 1800*time.Millisecond, "How long to wait for the upstreams before answering with a stale answer when there is one, letting the upstreams finish in the background (0 waits for them)")
+	staleRecheck := flag.Duration("stale-recheck", 30*time.Second, "How long to answer a name with its stale answer without asking the upstreams again after they failed to resolve it")
+	prefetchHits := flag.Int("prefetch-hits", 5, "Refresh cached answers hit this many times shortly before they expire (0 disables prefetching)")
+	upstreamList := flag.String("upstreams", "8.8.8.8:53", "Comma-separated list of upstream DNS servers")
+	upstreamPolicy := flag.String("upstream-policy", PolicySequential, "Upstream selection policy: sequential, round-robin or lowest-latency")
+	upstreamTimeout := flag.Duration("upstream-timeout", 2*time.Second, "Timeout for a single upstream exchange before failing over")
+	healthCheckInterval := flag.Duration("health-check-interval", 10*time.Second, "Interval between active upstream health probes")
+	forwardZones := make(ForwardZones)
+	flag.Var(forwardZones, "forward-zone", "Forward a zone to dedicated upstreams, as zone=upstream[,upstream...] (repeatable)")
+	zoneFiles := make(ZoneFiles)
+	flag.Var(zoneFiles, "zone", "Serve a zone authoritatively from an RFC 1035 master file, as origin=path (repeatable)")
+	secondaryZones := make(SecondaryZones)
+	flag.Var(secondaryZones, "secondary", "Serve a zone as a secondary pulled from its primaries, as zone=primary[,primary...] (repeatable)")
+	allowTransfer := flag.String("allow-transfer", "none", "Clients allowed to transfer zones (AXFR/IXFR), as a comma-separated ACL (see -allow-recursion)")
+	allowRecursion := flag.String("allow-recursion", "private", "Clients allowed to resolve names through the cache and upstreams, as a comma-separated list of IPs, CIDRs, key:<tsig key>, any, none or private")
+	allowQuery := flag.String("allow-query", "any", "Clients allowed to query the local domain and authoritative zones, as a comma-separated ACL (see -allow-recursion)")
+	allowUpdate := flag.String("allow-update", "127.0.0.1,::1", "Clients allowed to send dynamic updates, which must be signed with a -tsig-key too, as a comma-separated ACL (see -allow-recursion)")
+	allowAPI := flag.String("allow-api", "private", "Clients allowed to manage local records through the web UI and JSON API without -api-token, as a comma-separated list of IPs, CIDRs, any, none or private")
+	apiToken := flag.String("api-token", "", "Token letting any client manage local records through the JSON API, sent as \"Authorization: Bearer <token>\"")
+	notifyList := flag.String("notify", "", "Comma-separated list of secondaries to send NOTIFY to when a zone changes")
+	rateLimitResponses := flag.Float64("rate-limit-responses", 20, "Identical UDP responses per second allowed to each client network before they are dropped or slipped (0 disables RRL)")
+	rateLimitQueries := flag.Float64("rate-limit-queries", 0, "Queries per second allowed from each client network (0 disables throttling)")
+	rateLimitBurst := flag.Float64("rate-limit-burst", 5, "Seconds worth of responses or queries a client network may send in a burst")
+	rateLimitSlip := flag.Int("rate-limit-slip", 2, "Send every Nth rate limited UDP response truncated so real clients retry over TCP (0 drops them all)")
+	rateLimitExempt := flag.String("rate-limit-exempt", "private", "Clients never rate limited, as a comma-separated ACL (see -allow-recursion); sites behind NAT share a client network")
+	var rpzZones RPZFlags
+	flag.Var(&rpzZones, "rpz", "Apply a response policy zone, as origin=path (repeatable, consulted in order before -blocklist)")
+	var blocklists BlocklistFlags
+	flag.Var(&blocklists, "blocklist", "Apply a hosts, adblock or plain domain list, as [action=]path with action nxdomain (default), nodata, passthru, drop or redirect:<ip> (repeatable)")
+	policyReload := flag.Duration("policy-reload-interval", 5*time.Minute, "Interval between checks for changed -rpz and -blocklist files")
+	dnstapTarget := flag.String("dnstap", "", "Write dnstap logs of every query and response to this file, or to a collector's socket given as unix:<path> (disabled if empty)")
+	flag.BoolVar(&verbose, "verbose", false, "Log every query and how it was answered")
+	tsigKeys := make(TSIGKeys)
+	flag.Var(tsigKeys, "tsig-key", "TSIG key allowed to send dynamic updates, as [algorithm:]name:secret (repeatable)")
+	dotListen := flag.String("dot-listen", "", "Address for the DNS over TLS listener, e.g. ':853' (disabled if empty)")
+	dohListen := flag.String("doh-listen", "", "Address for the DNS over HTTPS listener, e.g. ':443' (disabled if empty)")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate for DoT and DoH; generated into -tls-dir if unset")
+	tlsKey := flag.String("tls-key", "", "TLS private key for DoT and DoH; generated into -tls-dir if unset")
+	tlsDir := flag.String("tls-dir", "tls", "Directory holding the generated CA and server certificate when -tls-cert is unset")
+	tlsHost := flag.String("tls-host", "localhost", "Host name or IP the generated server certificate is issued for")
+	dnssecEnabled := flag.Bool("dnssec", false, "Sign the local domain with DNSSEC, answering clients that set the DO bit with signed records")
+	dnssecKeyDir := flag.String("dnssec-key-dir", "keys", "Directory holding the local domain's DNSSEC keys; keys are generated there on first use")
+	dnssecAlgorithm := flag.String("dnssec-algorithm", "ECDSAP256SHA256", "Algorithm for generated DNSSEC keys: ECDSAP256SHA256, ECDSAP384SHA384, ED25519 or RSASHA256")
+	dnssecDenial := flag.String("dnssec-denial", "nsec", "How nonexistence is proven in the signed local domain: nsec or nsec3")
+	dnssecValidate := flag.Bool("dnssec-validate", false, "Validate upstream answers with DNSSEC, answering SERVFAIL for bogus data")
+	trustAnchorFile := flag.String("trust-anchor", "", "File with the DS or DNSKEY records to trust for DNSSEC validation (default: the root zone's KSKs)")
+	recursive := flag.Bool("recursive", false, "Resolve queries iteratively from the root servers instead of forwarding them to -upstreams")
+	rootHintsFile := flag.String("root-hints", "", "named.root style file with the root server addresses for -recursive (default: the Internet's root servers)")
+	storeType := flag.String("store", "memory", "Where local records are kept: memory, bolt or etcd")
+	storePath := flag.String("store-path", "dns-go.db", "Database file for -store=bolt")
+	etcdEndpoints := flag.String("etcd-endpoints", "127.0.0.1:2379", "Comma-separated list of etcd endpoints for -store=etcd")
+	etcdPrefix := flag.String("etcd-prefix", "/dns-go/records/", "Key prefix of the local records in etcd for -store=etcd")
+	var viewConfigs ViewFlags
+	flag.Var(&viewConfigs, "view", "Answer clients from these networks from a view with its own local records and cache, as name=cidr[,cidr...] (repeatable)")
+	viewClientSubnet := flag.Bool("view-client-subnet", false, "Select views by the EDNS Client Subnet option of queries from -trusted-forwarders that carry one")
+	trustedForwarders := flag.String("trusted-forwarders", "none", "Forwarding resolvers whose EDNS Client Subnet options are believed for -view-client-subnet, as a comma-separated ACL (see -allow-recursion)")
 	flag.Parse()
 
-	localStore := NewMemoryStore()
-	cacheStore := NewMemoryStore()
+	if *configPath != "" {
+		cfg, err := LoadConfig(*configPath)
+		if err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+		set := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+		if !set["local-domain"] && cfg.LocalDomain != "" {
+			*localDomain = cfg.LocalDomain
+		}
+		if !set["synthesize-ptr"] && cfg.SynthesizePTR != nil {
+			*synthesizePTR = *cfg.SynthesizePTR
+		}
+		if !set["cache-size"] && cfg.CacheSize != nil {
+			*cacheSize = *cfg.CacheSize
+		}
+		if !set["ecs"] && cfg.ECS != "" {
+			*ecsPolicy = cfg.ECS
+		}
+		if !set["serve-stale"] && cfg.ServeStale != 0 {
+			*serveStale = time.Duration(cfg.ServeStale)
+		}
+		if !set["stale-answer-timeout"] && cfg.StaleAnswerTimeout != 0 {
+			*staleAnswerTimeout = time.Duration(cfg.StaleAnswerTimeout)
+		}
+		if !set["stale-recheck"] && cfg.StaleRecheck != 0 {
+			*staleRecheck = time.Duration(cfg.StaleRecheck)
+		}
+		if !set["prefetch-hits"] && cfg.PrefetchHits != nil {
+			*prefetchHits = *cfg.PrefetchHits
+		}
+		if !set["upstreams"] && len(cfg.Upstreams) > 0 {
+			*upstreamList = strings.Join(cfg.Upstreams, ",")
+		}
+		if !set["upstream-policy"] && cfg.UpstreamPolicy != "" {
+			*upstreamPolicy = cfg.UpstreamPolicy
+		}
+		if !set["upstream-timeout"] && cfg.UpstreamTimeout != 0 {
+			*upstreamTimeout = time.Duration(cfg.UpstreamTimeout)
+		}
+		if !set["health-check-interval"] && cfg.HealthCheckInterval != 0 {
+			*healthCheckInterval = time.Duration(cfg.HealthCheckInterval)
+		}
+		for zone, upstreams := range cfg.ForwardZones {
+			// Rules given as flags win over rules for the same zone from the file
+			if _, ok := forwardZones[dns.Fqdn(zone)]; !ok {
+				forwardZones[dns.Fqdn(zone)] = upstreams
+			}
+		}
+		for origin, path := range cfg.Zones {
+			if _, ok := zoneFiles[dns.Fqdn(origin)]; !ok {
+				zoneFiles[dns.Fqdn(origin)] = path
+			}
+		}
+		for zone, primaries := range cfg.Secondaries {
+			if _, ok := secondaryZones[dns.Fqdn(zone)]; !ok {
+				secondaryZones[dns.Fqdn(zone)] = primaries
+			}
+		}
+		if !set["allow-transfer"] && len(cfg.AllowTransfer) > 0 {
+			*allowTransfer = strings.Join(cfg.AllowTransfer, ",")
+		}
+		if !set["allow-recursion"] && len(cfg.AllowRecursion) > 0 {
+			*allowRecursion = strings.Join(cfg.AllowRecursion, ",")
+		}
+		if !set["allow-query"] && len(cfg.AllowQuery) > 0 {
+			*allowQuery = strings.Join(cfg.AllowQuery, ",")
+		}
+		if !set["allow-update"] && len(cfg.AllowUpdate) > 0 {
+			*allowUpdate = strings.Join(cfg.AllowUpdate, ",")
+		}
+		if !set["allow-api"] && len(cfg.AllowAPI) > 0 {
+			*allowAPI = strings.Join(cfg.AllowAPI, ",")
+		}
+		if !set["api-token"] && cfg.APIToken != "" {
+			*apiToken = cfg.APIToken
+		}
+		if !set["rate-limit-responses"] && cfg.RateLimitResponses != nil {
+			*rateLimitResponses = *cfg.RateLimitResponses
+		}
+		if !set["rate-limit-queries"] && cfg.RateLimitQueries != nil {
+			*rateLimitQueries = *cfg.RateLimitQueries
+		}
+		if !set["rate-limit-burst"] && cfg.RateLimitBurst != nil {
+			*rateLimitBurst = *cfg.RateLimitBurst
+		}
+		if !set["rate-limit-slip"] && cfg.RateLimitSlip != nil {
+			*rateLimitSlip = *cfg.RateLimitSlip
+		}
+		if !set["rate-limit-exempt"] && cfg.RateLimitExempt != nil {
+			*rateLimitExempt = strings.Join(cfg.RateLimitExempt, ",")
+		}
+		if !set["rpz"] {
+			rpzZones = append(rpzZones, cfg.RPZ...)
+		}
+		if !set["blocklist"] {
+			blocklists = append(blocklists, cfg.Blocklists...)
+		}
+		if !set["policy-reload-interval"] && cfg.PolicyReloadInterval != 0 {
+			*policyReload = time.Duration(cfg.PolicyReloadInterval)
+		}
+		if !set["dnstap"] && cfg.Dnstap != "" {
+			*dnstapTarget = cfg.Dnstap
+		}
+		if !set["verbose"] && cfg.Verbose {
+			verbose = true
+		}
+		if !set["notify"] && len(cfg.Notify) > 0 {
+			*notifyList = strings.Join(cfg.Notify, ",")
+		}
+		if !set["dot-listen"] && cfg.DoTListen != "" {
+			*dotListen = cfg.DoTListen
+		}
+		if !set["doh-listen"] && cfg.DoHListen != "" {
+			*dohListen = cfg.DoHListen
+		}
+		if !set["tls-cert"] && !set["tls-key"] && cfg.TLSCert != "" {
+			*tlsCert, *tlsKey = cfg.TLSCert, cfg.TLSKey
+		}
+		if !set["tls-dir"] && cfg.TLSDir != "" {
+			*tlsDir = cfg.TLSDir
+		}
+		if !set["tls-host"] && cfg.TLSHost != "" {
+			*tlsHost = cfg.TLSHost
+		}
+		if !set["dnssec"] && cfg.DNSSEC {
+			*dnssecEnabled = true
+		}
+		if !set["dnssec-key-dir"] && cfg.DNSSECKeyDir != "" {
+			*dnssecKeyDir = cfg.DNSSECKeyDir
+		}
+		if !set["dnssec-algorithm"] && cfg.DNSSECAlgorithm != "" {
+			*dnssecAlgorithm = cfg.DNSSECAlgorithm
+		}
+		if !set["dnssec-denial"] && cfg.DNSSECDenial != "" {
+			*dnssecDenial = cfg.DNSSECDenial
+		}
+		if !set["dnssec-validate"] && cfg.DNSSECValidate {
+			*dnssecValidate = true
+		}
+		if !set["trust-anchor"] && cfg.TrustAnchor != "" {
+			*trustAnchorFile = cfg.TrustAnchor
+		}
+		if !set["recursive"] && cfg.Recursive {
+			*recursive = true
+		}
+		if !set["root-hints"] && cfg.RootHints != "" {
+			*rootHintsFile = cfg.RootHints
+		}
+		if !set["store"] && cfg.Store != "" {
+			*storeType = cfg.Store
+		}
+		if !set["store-path"] && cfg.StorePath != "" {
+			*storePath = cfg.StorePath
+		}
+		if !set["etcd-endpoints"] && len(cfg.EtcdEndpoints) > 0 {
+			*etcdEndpoints = strings.Join(cfg.EtcdEndpoints, ",")
+		}
+		if !set["etcd-prefix"] && cfg.EtcdPrefix != "" {
+			*etcdPrefix = cfg.EtcdPrefix
+		}
+		if !set["view"] {
+			viewConfigs = append(viewConfigs, cfg.Views...)
+		}
+		if !set["view-client-subnet"] && cfg.ViewClientSubnet {
+			*viewClientSubnet = true
+		}
+		if !set["trusted-forwarders"] && len(cfg.TrustedForwarders) > 0 {
+			*trustedForwarders = strings.Join(cfg.TrustedForwarders, ",")
+		}
+		fileKeys := make(TSIGKeys)
+		for _, value := range cfg.TSIGKeys {
+			if err := fileKeys.Set(value); err != nil {
+				log.Fatalf("Invalid TSIG key in config: %v", err)
+			}
+		}
+		for name, key := range fileKeys {
+			if _, ok := tsigKeys[name]; !ok {
+				tsigKeys[name] = key
+			}
+		}
+	}
+
+	var recursor *Recursor
+	if *recursive {
+		roots, err := LoadRootHints(*rootHintsFile)
+		if err != nil {
+			log.Fatalf("Failed to load root hints: %v", err)
+		}
+		recursor = NewRecursor(roots, *upstreamTimeout)
+		log.Printf("Resolving recursively from %d root servers", len(roots))
+	}
+	var anchors []*dns.DS
+	if *dnssecValidate {
+		var err error
+		if anchors, err = LoadTrustAnchors(*trustAnchorFile); err != nil {
+			log.Fatalf("Failed to load trust anchors: %v", err)
+		}
+	}
+
+	// newForwarder builds the forwarding policy of a view. Views without upstreams of their own
+	// resolve like the default view; forward zones of the view add to the global ones.
+	newForwarder := func(view string, upstreamAddrs []string, viewZones ForwardZones) *Forwarder {
+		var resolver Resolver
+		if len(upstreamAddrs) == 0 && recursor != nil {
+			resolver = recursor
+		} else {
+			if len(upstreamAddrs) == 0 {
+				upstreamAddrs = splitList(*upstreamList)
+			}
+			upstreams, err := NewUpstreamPool(view, upstreamAddrs, *upstreamPolicy, *upstreamTimeout)
+			if err != nil {
+				log.Fatalf("Invalid upstream configuration for view %s: %v", view, err)
+			}
+			resolver = upstreams
+		}
+		forwarder := NewForwarder(resolver)
+		for _, rules := range []ForwardZones{forwardZones, viewZones} {
+			for zone, addrs := range rules {
+				pool, err := NewUpstreamPool(view+"/"+dns.CanonicalName(zone), addrs, *upstreamPolicy, *upstreamTimeout)
+				if err != nil {
+					log.Fatalf("Invalid upstream configuration for forward zone %s: %v", zone, err)
+				}
+				forwarder.AddZone(zone, pool)
+				log.Printf("Forwarding %s to %v in view %s", zone, addrs, view)
+			}
+		}
+		go forwarder.RunHealthChecks(*healthCheckInterval)
+		return forwarder
+	}
+
+	zones := NewZoneSet()
+	for origin, path := range zoneFiles {
+		if err := zones.LoadFile(origin, path); err != nil {
+			log.Fatalf("Failed to load zone %s: %v", origin, err)
+		}
+	}
+
+	// newStore opens the local record store of a view; views other than the default one get
+	// their own database file or etcd prefix
+	newStore := func(view string) DNSRecordStore {
+		switch *storeType {
+		case "memory":
+			return NewMemoryStore()
+		case "bolt":
+			path := *storePath
+			if view != defaultViewName {
+				ext := filepath.Ext(path)
+				path = strings.TrimSuffix(path, ext) + "-" + view + ext
+			}
+			store, err := NewBoltStore(path)
+			if err != nil {
+				log.Fatalf("Failed to open record store: %v", err)
+			}
+			log.Printf("Keeping local records of view %s in %s", view, path)
+			return store
+		case "etcd":
+			prefix := *etcdPrefix
+			if view != defaultViewName {
+				prefix = strings.TrimSuffix(prefix, "/") + "-" + view + "/"
+			}
+			store, err := NewEtcdStore(splitList(*etcdEndpoints), prefix)
+			if err != nil {
+				log.Fatalf("Failed to open record store: %v", err)
+			}
+			log.Printf("Keeping local records of view %s in etcd at %s under %s", view, *etcdEndpoints, prefix)
+			return store
+		}
+		log.Fatalf("Unknown -store %q, must be memory, bolt or etcd", *storeType)
+		return nil
+	}
+
+	var signer *Signer
+	if *dnssecEnabled {
+		algorithm, ok := dns.StringToAlgorithm[strings.ToUpper(*dnssecAlgorithm)]
+		if !ok {
+			log.Fatalf("Unknown DNSSEC algorithm %q", *dnssecAlgorithm)
+		}
+		if *dnssecDenial != "nsec" && *dnssecDenial != "nsec3" {
+			log.Fatalf("Invalid -dnssec-denial %q, must be nsec or nsec3", *dnssecDenial)
+		}
+		var err error
+		signer, err = LoadOrGenerateSigner(*localDomain, *dnssecKeyDir, algorithm, *dnssecDenial == "nsec3")
+		if err != nil {
+			log.Fatalf("Failed to load DNSSEC keys: %v", err)
+		}
+		if err := signer.WriteDSSet(*dnssecKeyDir); err != nil {
+			log.Fatalf("Failed to write DS records: %v", err)
+		}
+		for _, ds := range signer.DS() {
+			log.Printf("Publish in the parent zone of %s: %s", signer.Zone, ds)
+		}
+	}
+
+	if err := checkECSPolicy(*ecsPolicy); err != nil {
+		log.Fatalf("Invalid -ecs: %v", err)
+	}
+
+	// newView assembles a view with its own local records, cache and forwarding policy
+	newView := func(name string, networks []*net.IPNet, upstreamAddrs []string, viewZones ForwardZones) *View {
+		view := &View{Name: name, Networks: networks}
+		view.Local = NewLocalZone(*localDomain, newStore(name), zones)
+		view.Local.Signer = signer
+		view.Local.SynthesizePTR = *synthesizePTR
+		cache := NewCacheStore(*cacheSize)
+		cache.Prefetch, cache.PrefetchHits = view.prefetch, *prefetchHits
+		cache.StaleWindow = *serveStale
+		cache.StaleAnswerTimeout, cache.StaleRecheck = *staleAnswerTimeout, *staleRecheck
+		view.ECS = *ecsPolicy
+		go cache.RunJanitor(time.Minute)
+		view.Cache = cache
+		view.Forwarder = newForwarder(name, upstreamAddrs, viewZones)
+		if anchors != nil {
+			view.Validator = NewValidator(view.Forwarder, anchors)
+		}
+		view.Updater = NewUpdater(view.Local, tsigKeys)
+		return view
+	}
+
+	// parseACL parses the ACL given with the flag called name
+	parseACL := func(name, value string) *ACL {
+		acl, err := ParseACL(splitList(value))
+		if err != nil {
+			log.Fatalf("Invalid -%s: %v", name, err)
+		}
+		return acl
+	}
+
+	// Any client can put an ECS option in its query, so only those of known forwarders pick views
+	var clientSubnet *ACL
+	if *viewClientSubnet {
+		clientSubnet = parseACL("trusted-forwarders", *trustedForwarders)
+		if !clientSubnet.Any && len(clientSubnet.Networks) == 0 && len(clientSubnet.Keys) == 0 {
+			log.Fatalf("-view-client-subnet needs -trusted-forwarders to say whose queries to believe")
+		}
+	}
+
+	defaultView := newView(defaultViewName, nil, nil, nil)
+	localStore := defaultView.Local
+	views := NewViewSet(defaultView, clientSubnet)
+	for _, cfg := range viewConfigs {
+		if _, exists := views.Get(cfg.Name); exists {
+			log.Fatalf("Duplicate view %s", cfg.Name)
+		}
+		networks, err := parseNetworks(cfg.Networks)
+		if err != nil || len(networks) == 0 {
+			log.Fatalf("Invalid networks for view %s: %v", cfg.Name, err)
+		}
+		views.Add(newView(cfg.Name, networks, cfg.Upstreams, cfg.ForwardZones))
+		log.Printf("Serving view %s to %v", cfg.Name, cfg.Networks)
+	}
+
+	acls := &ACLs{
+		Recursion: parseACL("allow-recursion", *allowRecursion),
+		Query:     parseACL("allow-query", *allowQuery),
+		Update:    parseACL("allow-update", *allowUpdate),
+	}
+	transferACL := parseACL("allow-transfer", *allowTransfer)
+	// Zone transfers and NOTIFY serve the default view's copy of the local domain
+	transfers := NewTransfers(localStore, zones, transferACL, splitList(*notifyList))
+	for zone, primaries := range secondaryZones {
+		transfers.AddSecondary(zone, primaries)
+		log.Printf("Serving %s as a secondary of %v", zone, primaries)
+	}
+	zones.OnChange = transfers.Notify
+	localStore.OnChange = func() { transfers.Notify(localStore.Domain) }
+	for _, view := range views.Views() {
+		if store, ok := view.Local.store.(*EtcdStore); ok {
+			// Pick up records changed by other instances sharing the cluster
+			go store.Watch(view.Local.changed)
+		}
+	}
+	go transfers.RunSecondaries()
+	go zones.ReloadOnSIGHUP()
+
+	policies := NewPolicies()
+	for _, value := range rpzZones {
+		origin, path, _ := strings.Cut(value, "=")
+		if err := policies.AddRPZ(origin, path); err != nil {
+			log.Fatalf("Failed to load policy zone %s: %v", origin, err)
+		}
+	}
+	for _, value := range blocklists {
+		path, action, err := parseBlocklist(value)
+		if err == nil {
+			err = policies.AddBlocklist(path, action)
+		}
+		if err != nil {
+			log.Fatalf("Failed to load blocklist %s: %v", value, err)
+		}
+	}
+	go policies.RunReloader(*policyReload)
+
+	var handler dns.Handler = DNSHandler(views, zones, transfers, acls, policies)
+	if *dnstapTarget != "" {
+		tap, err := NewTap(*dnstapTarget)
+		if err != nil {
+			log.Fatalf("Failed to open dnstap output: %v", err)
+		}
+		handler = tap.Handler(handler)
+		go tap.CloseOnExit()
+		log.Printf("Writing dnstap logs to %s", *dnstapTarget)
+	}
+	handler = Instrument(handler)
+	if *rateLimitResponses > 0 || *rateLimitQueries > 0 {
+		limiter := NewRateLimiter(*rateLimitResponses, *rateLimitQueries, *rateLimitBurst, *rateLimitSlip, parseACL("rate-limit-exempt", *rateLimitExempt))
+		go limiter.RunJanitor(time.Minute)
+		handler = limiter.Handler(handler)
+	}
+
+	if *dotListen != "" || *dohListen != "" {
+		tlsConfig, err := LoadTLSConfig(*tlsCert, *tlsKey, *tlsDir, *tlsHost)
+		if err != nil {
+			log.Fatalf("Failed to set up TLS: %v", err)
+		}
+		if *dotListen != "" {
+			go StartDoTServer(*dotListen, handler, tsigKeys.Secrets(), tlsConfig)
+		}
+		if *dohListen != "" {
+			go StartDoHServer(*dohListen, handler, tsigKeys.Secrets(), tlsConfig)
+		}
+	}
 
-	go StartFrontendServer(*localDomain, localStore, cacheStore)
-	go StartDNSUDPServer(*localDomain, localStore, cacheStore)
-	StartDNSTCPServer(*localDomain, localStore, cacheStore)
+	go StartFrontendServer(*localDomain, localStore, defaultView.Cache, NewAPI(views, parseACL("allow-api", *allowAPI), *apiToken))
+	go StartDNSUDPServer(handler, tsigKeys.Secrets())
+	StartDNSTCPServer(handler, tsigKeys.Secrets())
 }
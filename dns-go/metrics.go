@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Instrument wraps next so every query it serves is counted and timed by transport, answer source,
+// query type and response code
+func Instrument(next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		dnsInFlight.Inc()
+		defer dnsInFlight.Dec()
+
+		mw := &metricsWriter{ResponseWriter: w}
+		start := time.Now()
+		next.ServeDNS(mw, r)
+
+		if len(r.Question) > 0 {
+			dnsQueries.WithLabelValues(typeName(r.Question[0].Qtype)).Inc()
+		}
+		source := mw.source
+		if source == "" {
+			source = "none"
+		}
+		dnsRequestDuration.WithLabelValues(transport(w), source).Observe(time.Since(start).Seconds())
+		if mw.written {
+			dnsResponses.WithLabelValues(dns.RcodeToString[mw.rcode]).Inc()
+		}
+	})
+}
+
+// metricsWriter records the response code and answer source of the query served through it
+type metricsWriter struct {
+	dns.ResponseWriter
+	source  string
+	rcode   int
+	written bool
+}
+
+// WriteMsg records the response code of msg and writes it
+func (w *metricsWriter) WriteMsg(msg *dns.Msg) error {
+	if !w.written {
+		w.written, w.rcode = true, msg.Rcode
+	}
+	return w.ResponseWriter.WriteMsg(msg)
+}
+
+// recordSource implements sourceRecorder
+func (w *metricsWriter) recordSource(source string) {
+	w.source = source
+	answeredBy(w.ResponseWriter, source)
+}
+
+// Unwrap returns the wrapped response writer
+func (w *metricsWriter) Unwrap() dns.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// transport returns the transport a query was received over: udp, tcp, dot or doh
+func transport(w dns.ResponseWriter) string {
+	for {
+		wrapper, ok := w.(interface{ Unwrap() dns.ResponseWriter })
+		if !ok {
+			break
+		}
+		w = wrapper.Unwrap()
+	}
+	if _, ok := w.(*dohResponseWriter); ok {
+		return "doh"
+	}
+	if stater, ok := w.(dns.ConnectionStater); ok && stater.ConnectionState() != nil {
+		return "dot"
+	}
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// typeName returns the name of a query type, grouping unknown types so they cannot blow up the
+// number of time series
+func typeName(qType uint16) string {
+	if name, ok := dns.TypeToString[qType]; ok {
+		return name
+	}
+	return "other"
+}
+
+var (
+	dnsRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "dns_request_duration_seconds",
+			Help:    "Time taken to answer DNS queries by transport and by what answered them",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 2, 16),
+		},
+		[]string{"transport", "source"},
+	)
+	dnsQueries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_queries_total",
+			Help: "Total number of DNS queries by query type",
+		},
+		[]string{"qtype"},
+	)
+	dnsResponses = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_responses_total",
+			Help: "Total number of DNS responses by response code",
+		},
+		[]string{"rcode"},
+	)
+	dnsInFlight = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "dns_queries_in_flight",
+			Help: "Number of DNS queries currently being answered",
+		},
+	)
+	cacheLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_cache_lookups_total",
+			Help: "Total number of cache lookups by result (hit or miss)",
+		},
+		[]string{"result"},
+	)
+	cacheEvictions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_cache_evictions_total",
+			Help: "Total number of cache entries evicted by reason (expired or capacity)",
+		},
+		[]string{"reason"},
+	)
+	cachePrefetches = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "dns_cache_prefetches_total",
+			Help: "Total number of popular cache entries refreshed before they expired",
+		},
+	)
+	upstreamCoalesced = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "dns_upstream_coalesced_total",
+			Help: "Total number of queries answered by an upstream exchange shared with identical queries",
+		},
+	)
+	cacheEntries = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "dns_cache_entries",
+			Help: "Number of entries held in the caches of all views",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(dnsRequestDuration, dnsQueries, dnsResponses, dnsInFlight, cacheLookups, cacheEvictions, cachePrefetches, upstreamCoalesced, cacheEntries)
+}
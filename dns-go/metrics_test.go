@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInstrumentCounters(t *testing.T) {
+	upstream := startUpstream(t)
+	upstream.rcode.Store(dns.RcodeNameError)
+	zones := NewZoneSet()
+	cache := NewCacheStore(100)
+	view := &View{
+		Name:      defaultViewName,
+		Local:     NewLocalZone("home.", NewMemoryStore(), zones),
+		Cache:     cache,
+		Forwarder: NewForwarder(testPool(t, upstream.addr)),
+	}
+	cache.Set("cached.example.test.", dns.TypeA, testRecord(t, "cached.example.test. 300 IN A 192.0.2.1"))
+	handler := Instrument(testHandler(view, zones))
+
+	// counts returns the counters a query is expected to move
+	counts := func() [6]float64 {
+		return [6]float64{
+			testutil.ToFloat64(dnsQueries.WithLabelValues("A")),
+			testutil.ToFloat64(dnsQueries.WithLabelValues("MX")),
+			testutil.ToFloat64(dnsResponses.WithLabelValues("NOERROR")),
+			testutil.ToFloat64(dnsResponses.WithLabelValues("NXDOMAIN")),
+			testutil.ToFloat64(cacheLookups.WithLabelValues("hit")),
+			testutil.ToFloat64(cacheLookups.WithLabelValues("miss")),
+		}
+	}
+	ask := func(name string, qType uint16) *dns.Msg {
+		t.Helper()
+		query := new(dns.Msg)
+		query.SetQuestion(name, qType)
+		w := writerFrom("192.0.2.53")
+		handler.ServeDNS(w, query)
+		if w.msg == nil {
+			t.Fatalf("No answer to %s %s", name, dns.TypeToString[qType])
+		}
+		return w.msg
+	}
+
+	before := counts()
+	if msg := ask("cached.example.test.", dns.TypeA); msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 1 {
+		t.Fatalf("Cached answer = %v", msg)
+	}
+	after := counts()
+	if want := [6]float64{1, 0, 1, 0, 1, 0}; delta(before, after) != want {
+		t.Errorf("Cache hit moved counters by %v, want %v", delta(before, after), want)
+	}
+
+	before = counts()
+	if msg := ask("missing.example.test.", dns.TypeMX); msg.Rcode != dns.RcodeNameError {
+		t.Fatalf("Upstream answer = %v", msg)
+	}
+	after = counts()
+	if want := [6]float64{0, 1, 0, 1, 0, 1}; delta(before, after) != want {
+		t.Errorf("Cache miss moved counters by %v, want %v", delta(before, after), want)
+	}
+	if upstream.queries.Load() != 1 {
+		t.Errorf("Upstream got %d queries, want 1", upstream.queries.Load())
+	}
+}
+
+// delta returns the difference between two sets of counter values
+func delta(before, after [6]float64) [6]float64 {
+	var d [6]float64
+	for i := range d {
+		d[i] = after[i] - before[i]
+	}
+	return d
+}
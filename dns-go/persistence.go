@@ -2,35 +2,91 @@ package main
 
 import (
 	"fmt"
+	"hash/fnv"
 	"strings"
+	"sync"
 
 	"github.com/miekg/dns"
 )
 
-// MemoryStore implements DNSRecordStore in memory
+// memoryShards is the number of independently locked shards of a MemoryStore
+const memoryShards = 32
+
+// MemoryStore implements DNSRecordStore in memory. Records are spread over shards with their own
+// locks so concurrent queries and updates rarely contend, and messages are copied on the way in and
+// out so callers never share them with the store.
 type MemoryStore struct {
+	shards [memoryShards]memoryShard
+}
+
+// memoryShard holds the records whose keys hash to it
+type memoryShard struct {
+	mu      sync.RWMutex
 	records map[string]*dns.Msg
 }
 
 // NewMemoryStore initializes and returns a new MemoryStore
 func NewMemoryStore() *MemoryStore {
-	return &MemoryStore{records: make(map[string]*dns.Msg)}
+	s := new(MemoryStore)
+	for i := range s.shards {
+		s.shards[i].records = make(map[string]*dns.Msg)
+	}
+	return s
+}
+
+// shard returns the shard responsible for k
+func (s *MemoryStore) shard(k string) *memoryShard {
+	h := fnv.New32a()
+	h.Write([]byte(k))
+	return &s.shards[h.Sum32()%memoryShards]
 }
 
 // Get retrieves a DNS record for a given domain and query type
 func (s *MemoryStore) Get(domain string, qType uint16) (*dns.Msg, bool) {
-	msg, ok := s.records[key(domain, qType)]
-	return msg, ok
+	k := key(domain, qType)
+	shard := s.shard(k)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	msg, ok := shard.records[k]
+	if !ok {
+		return nil, false
+	}
+	return msg.Copy(), true
+}
+
+// Set stores a DNS record for a given domain and query type. It never fails.
+func (s *MemoryStore) Set(domain string, qType uint16, msg *dns.Msg) error {
+	k := key(domain, qType)
+	msg = msg.Copy()
+	shard := s.shard(k)
+	shard.mu.Lock()
+	shard.records[k] = msg
+	shard.mu.Unlock()
+	return nil
 }
 
-// Set stores a DNS record for a given domain and query type
-func (s *MemoryStore) Set(domain string, qType uint16, msg *dns.Msg) {
-	s.records[key(domain, qType)] = msg
+// Delete removes the DNS record for a given domain and query type. It never fails.
+func (s *MemoryStore) Delete(domain string, qType uint16) error {
+	k := key(domain, qType)
+	shard := s.shard(k)
+	shard.mu.Lock()
+	delete(shard.records, k)
+	shard.mu.Unlock()
+	return nil
 }
 
-// GetAll retrieves all stored DNS records
+// GetAll retrieves a snapshot of all stored DNS records
 func (s *MemoryStore) GetAll() map[string]*dns.Msg {
-	return s.records
+	records := make(map[string]*dns.Msg)
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mu.RLock()
+		for k, msg := range shard.records {
+			records[k] = msg.Copy()
+		}
+		shard.mu.RUnlock()
+	}
+	return records
 }
 
 func key(domain string, qType uint16) string {
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestStoreConcurrentAccess(t *testing.T) {
+	const workers, rounds, names = 8, 200, 16
+
+	for storeName, newStore := range testStores() {
+		t.Run(storeName, func(t *testing.T) {
+			store := newStore(t)
+			var wg sync.WaitGroup
+			for worker := range workers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for round := range rounds {
+						domain := fmt.Sprintf("host%d.home.", (worker+round)%names)
+						switch round % 4 {
+						case 0, 1:
+							msg := testRecord(t, fmt.Sprintf("%s 300 IN A 192.0.2.%d", domain, worker))
+							if err := store.Set(domain, dns.TypeA, msg); err != nil {
+								t.Errorf("Set %s: %v", domain, err)
+								return
+							}
+						case 2:
+							if err := store.Delete(domain, dns.TypeA); err != nil {
+								t.Errorf("Delete %s: %v", domain, err)
+								return
+							}
+						}
+						// Whatever a reader gets is a whole record of its own to change
+						if msg, ok := store.Get(domain, dns.TypeA); ok {
+							if len(msg.Answer) != 1 {
+								t.Errorf("Got %v for %s, want a single record", msg, domain)
+								return
+							}
+							msg.Answer[0].Header().Ttl = 0
+						}
+						if round%16 == 0 {
+							for _, msg := range store.GetAll() {
+								msg.Answer = nil
+							}
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			// The records left are those last stored, intact
+			for k, msg := range store.GetAll() {
+				if len(msg.Answer) != 1 || msg.Answer[0].Header().Ttl != 300 {
+					t.Errorf("Got %v under %s, want a record as stored", msg, k)
+				}
+			}
+		})
+	}
+}
+
+// lockedStore is MemoryStore as it was before sharding, made safe for concurrent use with a
+// single lock, to measure sharding against
+type lockedStore struct {
+	mu      sync.RWMutex
+	records map[string]*dns.Msg
+}
+
+func (s *lockedStore) Get(domain string, qType uint16) (*dns.Msg, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	msg, ok := s.records[key(domain, qType)]
+	if !ok {
+		return nil, false
+	}
+	return msg.Copy(), true
+}
+
+func (s *lockedStore) Set(domain string, qType uint16, msg *dns.Msg) error {
+	msg = msg.Copy()
+	s.mu.Lock()
+	s.records[key(domain, qType)] = msg
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *lockedStore) Delete(domain string, qType uint16) error {
+	s.mu.Lock()
+	delete(s.records, key(domain, qType))
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *lockedStore) GetAll() map[string]*dns.Msg {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	records := make(map[string]*dns.Msg, len(s.records))
+	for k, msg := range s.records {
+		records[k] = msg.Copy()
+	}
+	return records
+}
+
+// benchmarkStore runs parallel lookups against store, with one write in every writeEvery operations
+func benchmarkStore(b *testing.B, store DNSRecordStore, writeEvery int) {
+	const names = 1024
+	domains := make([]string, names)
+	msgs := make([]*dns.Msg, names)
+	for i := range domains {
+		domains[i] = fmt.Sprintf("host%d.home.", i)
+		rr, _ := dns.NewRR(fmt.Sprintf("%s 300 IN A 192.0.2.%d", domains[i], i%256))
+		msgs[i] = &dns.Msg{Answer: []dns.RR{rr}}
+		store.Set(domains[i], dns.TypeA, msgs[i])
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			i++
+			n := i % names
+			if i%writeEvery == 0 {
+				store.Set(domains[n], dns.TypeA, msgs[n])
+			} else {
+				store.Get(domains[n], dns.TypeA)
+			}
+		}
+	})
+}
+
+func BenchmarkMemoryStore(b *testing.B) {
+	for _, writeEvery := range []int{1000, 10} {
+		b.Run(fmt.Sprintf("sharded/1-write-in-%d", writeEvery), func(b *testing.B) {
+			benchmarkStore(b, NewMemoryStore(), writeEvery)
+		})
+		b.Run(fmt.Sprintf("single-lock/1-write-in-%d", writeEvery), func(b *testing.B) {
+			benchmarkStore(b, &lockedStore{records: make(map[string]*dns.Msg)}, writeEvery)
+		})
+	}
+}
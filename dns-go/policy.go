@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Policy actions, named after the RPZ actions they implement
+const (
+	PolicyNXDOMAIN = "nxdomain" // answer that the name does not exist
+	PolicyNODATA   = "nodata"   // answer that the name has no records of the queried type
+	PolicyPassthru = "passthru" // answer normally, exempting the name from later policies
+	PolicyDrop     = "drop"     // do not answer at all
+	PolicyRedirect = "redirect" // answer with local data instead
+)
+
+// policyTTL is the TTL of answers synthesized from blocklists
+const policyTTL = 60
+
+// PolicyRule is what a policy does with the names it matches
+type PolicyRule struct {
+	Action string
+	// Records hold the local data of redirects. Owner names are replaced by the query name.
+	Records []dns.RR
+}
+
+// Answer builds the response the rule gives to a query for name and qType
+func (p *PolicyRule) Answer(name string, qType uint16) *dns.Msg {
+	msg := new(dns.Msg)
+	switch p.Action {
+	case PolicyNXDOMAIN:
+		msg.Rcode = dns.RcodeNameError
+	case PolicyRedirect:
+		for _, rr := range p.Records {
+			if rrType := rr.Header().Rrtype; rrType == qType || rrType == dns.TypeCNAME || qType == dns.TypeANY {
+				rr = dns.Copy(rr)
+				rr.Header().Name = name
+				msg.Answer = append(msg.Answer, rr)
+			}
+		}
+	}
+	return msg
+}
+
+// PolicySource is one RPZ zone or blocklist file. Exact names take precedence over wildcards,
+// and longer wildcards over shorter ones.
+type PolicySource struct {
+	Name string
+	path string
+	rpz  string // origin of an RPZ zone, empty for blocklists
+	// action is what a blocklist does with the names it lists
+	action *PolicyRule
+
+	modified  time.Time
+	exact     map[string]*PolicyRule
+	wildcards map[string]*PolicyRule // keyed by the parent of the wildcard
+}
+
+// Match returns the rule of the source for name, or nil
+func (s *PolicySource) Match(name string) *PolicyRule {
+	if rule, ok := s.exact[name]; ok {
+		return rule
+	}
+	for parent := name; parent != "."; {
+		parent = parentName(parent)
+		if rule, ok := s.wildcards[parent]; ok {
+			return rule
+		}
+	}
+	return nil
+}
+
+// load reads the source's file
+func (s *PolicySource) load() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s.exact = make(map[string]*PolicyRule)
+	s.wildcards = make(map[string]*PolicyRule)
+	if s.rpz != "" {
+		err = s.parseRPZ(f)
+	} else {
+		err = s.parseList(f)
+	}
+	if err != nil {
+		return err
+	}
+	s.modified = info.ModTime()
+	return nil
+}
+
+// add sets the rule for name, a wildcard if it starts with "*."
+func (s *PolicySource) add(name string, rule *PolicyRule) {
+	if parent, ok := strings.CutPrefix(name, "*."); ok {
+		s.wildcards[parent] = rule
+		return
+	}
+	s.exact[name] = rule
+}
+
+// parseRPZ reads QNAME triggers from an RPZ zone (draft-vixie-dnsop-dns-rpz). A CNAME to the root
+// means NXDOMAIN, to "*." NODATA, to rpz-passthru. or rpz-drop. the respective action, and any
+// other records are local data to answer with.
+func (s *PolicySource) parseRPZ(f io.Reader) error {
+	zp := dns.NewZoneParser(f, s.rpz, s.path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		hdr := rr.Header()
+		owner := dns.CanonicalName(hdr.Name)
+		if owner == s.rpz || hdr.Rrtype == dns.TypeSOA || hdr.Rrtype == dns.TypeNS {
+			continue
+		}
+		name, ok := strings.CutSuffix(owner, "."+s.rpz)
+		if !ok {
+			log.Printf("Ignoring record outside of policy zone %s: %s", s.rpz, owner)
+			continue
+		}
+		if trigger := dns.SplitDomainName(name); strings.HasPrefix(trigger[len(trigger)-1], "rpz-") {
+			log.Printf("Ignoring unsupported policy trigger %s in %s", owner, s.path)
+			continue
+		}
+		name = dns.Fqdn(name)
+
+		rule := &PolicyRule{Action: PolicyRedirect}
+		if cname, ok := rr.(*dns.CNAME); ok {
+			switch dns.CanonicalName(cname.Target) {
+			case ".":
+				rule.Action = PolicyNXDOMAIN
+			case "*.":
+				rule.Action = PolicyNODATA
+			case "rpz-passthru.":
+				rule.Action = PolicyPassthru
+			case "rpz-drop.":
+				rule.Action = PolicyDrop
+			}
+		}
+		if rule.Action == PolicyRedirect {
+			// Several records of local data make up a single rule
+			key := name
+			rules := s.exact
+			if parent, ok := strings.CutPrefix(name, "*."); ok {
+				key, rules = parent, s.wildcards
+			}
+			if existing, ok := rules[key]; ok && existing.Action == PolicyRedirect {
+				existing.Records = append(existing.Records, rr)
+				continue
+			}
+			rule.Records = []dns.RR{rr}
+		}
+		s.add(name, rule)
+	}
+	return zp.Err()
+}
+
+// parseList reads a blocklist in hosts file format ("0.0.0.0 ads.example"), adblock format
+// ("||ads.example^", which covers subdomains too) or with one name per line. Hosts entries with
+// a routable address redirect to it instead of applying the list's action.
+func (s *PolicySource) parseList(f io.Reader) error {
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		text = strings.TrimSpace(text)
+		if text == "" || strings.HasPrefix(text, "!") || strings.HasPrefix(text, "[") {
+			continue
+		}
+
+		rule := s.action
+		var names []string
+		switch fields := strings.Fields(text); {
+		case strings.HasPrefix(text, "||"):
+			name, ok := strings.CutSuffix(strings.TrimPrefix(text, "||"), "^")
+			if !ok || strings.ContainsAny(name, "/*$") {
+				// Only whole domain rules apply to DNS
+				continue
+			}
+			names = []string{name, "*." + name}
+		case len(fields) >= 2 && net.ParseIP(fields[0]) != nil:
+			names = fields[1:]
+			if ip := net.ParseIP(fields[0]); !ip.IsUnspecified() && !ip.IsLoopback() {
+				rule = redirectTo(ip)
+			}
+		case len(fields) == 1:
+			names = fields
+		default:
+			log.Printf("Ignoring invalid line %d in %s", line, s.path)
+			continue
+		}
+		for _, name := range names {
+			if _, ok := dns.IsDomainName(name); !ok || name == "localhost" {
+				continue
+			}
+			s.add(dns.CanonicalName(name), rule)
+		}
+	}
+	return scanner.Err()
+}
+
+// redirectTo returns a rule answering with an address record for ip
+func redirectTo(ip net.IP) *PolicyRule {
+	hdr := dns.RR_Header{Name: ".", Class: dns.ClassINET, Ttl: policyTTL}
+	if ip4 := ip.To4(); ip4 != nil {
+		hdr.Rrtype = dns.TypeA
+		return &PolicyRule{Action: PolicyRedirect, Records: []dns.RR{&dns.A{Hdr: hdr, A: ip4}}}
+	}
+	hdr.Rrtype = dns.TypeAAAA
+	return &PolicyRule{Action: PolicyRedirect, Records: []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: ip}}}
+}
+
+// parsePolicyAction parses a blocklist action: nxdomain, nodata, passthru, drop or redirect:<ip>
+func parsePolicyAction(value string) (*PolicyRule, error) {
+	switch value {
+	case PolicyNXDOMAIN, PolicyNODATA, PolicyPassthru, PolicyDrop:
+		return &PolicyRule{Action: value}, nil
+	}
+	if addr, ok := strings.CutPrefix(value, PolicyRedirect+":"); ok {
+		if ip := net.ParseIP(addr); ip != nil {
+			return redirectTo(ip), nil
+		}
+	}
+	return nil, fmt.Errorf("invalid policy action %q, must be nxdomain, nodata, passthru, drop or redirect:<ip>", value)
+}
+
+// Policies applies RPZ zones and blocklists to queries. Sources are consulted in order and the
+// first one matching a name decides, as with RPZ.
+type Policies struct {
+	mu      sync.RWMutex
+	sources []*PolicySource
+}
+
+// NewPolicies initializes and returns an empty Policies
+func NewPolicies() *Policies {
+	return &Policies{}
+}
+
+// AddRPZ loads the RPZ zone origin from path
+func (p *Policies) AddRPZ(origin, path string) error {
+	origin = dns.CanonicalName(origin)
+	return p.add(&PolicySource{Name: origin, path: path, rpz: origin})
+}
+
+// AddBlocklist loads the blocklist at path, applying action to the names it lists
+func (p *Policies) AddBlocklist(path string, action *PolicyRule) error {
+	return p.add(&PolicySource{Name: path, path: path, action: action})
+}
+
+func (p *Policies) add(source *PolicySource) error {
+	if err := source.load(); err != nil {
+		return err
+	}
+	log.Printf("Loaded policy %s with %d names and %d wildcards", source.Name, len(source.exact), len(source.wildcards))
+	p.mu.Lock()
+	p.sources = append(p.sources, source)
+	p.mu.Unlock()
+	return nil
+}
+
+// Match returns the rule applying to name and the source it comes from
+func (p *Policies) Match(name string) (*PolicyRule, string) {
+	name = dns.CanonicalName(name)
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, source := range p.sources {
+		if rule := source.Match(name); rule != nil {
+			return rule, source.Name
+		}
+	}
+	return nil, ""
+}
+
+// Reload rereads every source whose file changed, keeping the previous version of those that fail to load
+func (p *Policies) Reload() {
+	p.mu.RLock()
+	sources := append([]*PolicySource(nil), p.sources...)
+	p.mu.RUnlock()
+	for i, source := range sources {
+		info, err := os.Stat(source.path)
+		if err == nil && info.ModTime().Equal(source.modified) {
+			continue
+		}
+		reloaded := &PolicySource{Name: source.Name, path: source.path, rpz: source.rpz, action: source.action}
+		if err == nil {
+			err = reloaded.load()
+		}
+		if err != nil {
+			log.Printf("Failed to reload policy %s, keeping previous version: %v", source.Name, err)
+			continue
+		}
+		log.Printf("Reloaded policy %s with %d names and %d wildcards", reloaded.Name, len(reloaded.exact), len(reloaded.wildcards))
+		p.mu.Lock()
+		p.sources[i] = reloaded
+		p.mu.Unlock()
+	}
+}
+
+// RunReloader periodically reloads changed policy files
+func (p *Policies) RunReloader(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.Reload()
+	}
+}
+
+// RPZFlags lists RPZ zones in the order given. It implements flag.Value so zones can be given as
+// repeated -rpz flags of the form "rpz.example.=/etc/dns-go/rpz.zone".
+type RPZFlags []string
+
+// String returns the zones in flag syntax
+func (f *RPZFlags) String() string {
+	return fmt.Sprint([]string(*f))
+}
+
+// Set checks and appends a single "origin=path" zone
+func (f *RPZFlags) Set(value string) error {
+	if err := make(ZoneFiles).Set(value); err != nil {
+		return err
+	}
+	*f = append(*f, value)
+	return nil
+}
+
+// BlocklistFlags lists blocklists in the order given. It implements flag.Value so lists can be
+// given as repeated -blocklist flags of the form "[action=]path", e.g. "redirect:10.0.0.1=ads.txt".
+type BlocklistFlags []string
+
+// String returns the lists in flag syntax
+func (f *BlocklistFlags) String() string {
+	return fmt.Sprint([]string(*f))
+}
+
+// Set checks and appends a single "[action=]path" list
+func (f *BlocklistFlags) Set(value string) error {
+	if _, _, err := parseBlocklist(value); err != nil {
+		return err
+	}
+	*f = append(*f, value)
+	return nil
+}
+
+// parseBlocklist splits a blocklist given as "[action=]path", defaulting to NXDOMAIN
+func parseBlocklist(value string) (string, *PolicyRule, error) {
+	action, path, ok := strings.Cut(value, "=")
+	if !ok {
+		action, path = PolicyNXDOMAIN, value
+	}
+	if path == "" {
+		return "", nil, fmt.Errorf("blocklist %q must have the form [action=]path", value)
+	}
+	rule, err := parsePolicyAction(action)
+	return path, rule, err
+}
+
+var policyHits = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "dns_policy_hits_total",
+		Help: "Total number of queries matched by an RPZ zone or blocklist",
+	},
+	[]string{"policy", "action"},
+)
+
+func init() {
+	prometheus.MustRegister(policyHits)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// writePolicyFile writes text to a file named name in a temporary directory and returns its path
+func writePolicyFile(t *testing.T, name, text string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path
+}
+
+// policyAction returns the action policies take for name, or "" if none matches
+func policyAction(policies *Policies, name string) string {
+	rule, _ := policies.Match(name)
+	if rule == nil {
+		return ""
+	}
+	return rule.Action
+}
+
+func TestBlocklistHosts(t *testing.T) {
+	path := writePolicyFile(t, "hosts", `# hosts file
+127.0.0.1 localhost
+0.0.0.0 ads.example tracker.example # trailing comment
+:: ipv6.example
+192.0.2.9 moved.example
+
+not a valid line
+`)
+	policies := NewPolicies()
+	if err := policies.AddBlocklist(path, &PolicyRule{Action: PolicyNODATA}); err != nil {
+		t.Fatalf("AddBlocklist: %v", err)
+	}
+
+	for name, want := range map[string]string{
+		"ads.example.":     PolicyNODATA,
+		"Tracker.Example.": PolicyNODATA,
+		"ipv6.example.":    PolicyNODATA,
+		"moved.example.":   PolicyRedirect,
+		"localhost.":       "",
+		"sub.ads.example.": "",
+		"other.example.":   "",
+	} {
+		if got := policyAction(policies, name); got != want {
+			t.Errorf("Action for %s = %q, want %q", name, got, want)
+		}
+	}
+
+	// Routable addresses redirect to themselves
+	rule, _ := policies.Match("moved.example.")
+	msg := rule.Answer("moved.example.", dns.TypeA)
+	if len(msg.Answer) != 1 || msg.Answer[0].String() != "moved.example.\t60\tIN\tA\t192.0.2.9" {
+		t.Errorf("Redirect answer = %v", msg.Answer)
+	}
+}
+
+func TestBlocklistDomains(t *testing.T) {
+	path := writePolicyFile(t, "domains.txt", `! adblock header
+[Adblock Plus 2.0]
+||ads.example^
+||example.net/path^
+plain.example
+`)
+	policies := NewPolicies()
+	if err := policies.AddBlocklist(path, &PolicyRule{Action: PolicyNXDOMAIN}); err != nil {
+		t.Fatalf("AddBlocklist: %v", err)
+	}
+
+	for name, want := range map[string]string{
+		"ads.example.":       PolicyNXDOMAIN,
+		"deep.ads.example.":  PolicyNXDOMAIN,
+		"plain.example.":     PolicyNXDOMAIN,
+		"sub.plain.example.": "",
+		"example.net.":       "",
+	} {
+		if got := policyAction(policies, name); got != want {
+			t.Errorf("Action for %s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestParseBlocklist(t *testing.T) {
+	path, rule, err := parseBlocklist("ads.txt")
+	if err != nil || path != "ads.txt" || rule.Action != PolicyNXDOMAIN {
+		t.Errorf("parseBlocklist(ads.txt) = %q, %v, %v", path, rule, err)
+	}
+	path, rule, err = parseBlocklist("redirect:10.0.0.1=ads.txt")
+	if err != nil || path != "ads.txt" || rule.Action != PolicyRedirect || len(rule.Records) != 1 {
+		t.Errorf("parseBlocklist(redirect) = %q, %v, %v", path, rule, err)
+	}
+	for _, value := range []string{"block=ads.txt", "redirect:nowhere=ads.txt", "nodata="} {
+		if _, _, err := parseBlocklist(value); err == nil {
+			t.Errorf("parseBlocklist(%q) succeeded", value)
+		}
+	}
+}
+
+// rpzTestFile triggers every supported RPZ action
+const rpzTestFile = `$TTL 300
+@                  IN SOA localhost. hostmaster 1 3600 600 86400 60
+@                  IN NS  localhost.
+blocked            IN CNAME .
+*.blocked          IN CNAME .
+empty              IN CNAME *.
+allowed.blocked    IN CNAME rpz-passthru.
+dropped            IN CNAME rpz-drop.
+local              IN A    192.0.2.1
+local              IN AAAA 2001:db8::1
+alias              IN CNAME www.example.
+32.1.2.0.192.rpz-ip IN CNAME .
+`
+
+// testRPZ loads rpzTestFile as rpz.test. followed by a blocklist blocking every name it lists
+func testRPZ(t *testing.T, blocked string) *Policies {
+	t.Helper()
+	policies := NewPolicies()
+	if err := policies.AddRPZ("rpz.test", writePolicyFile(t, "rpz.zone", rpzTestFile)); err != nil {
+		t.Fatalf("AddRPZ: %v", err)
+	}
+	if err := policies.AddBlocklist(writePolicyFile(t, "blocked.txt", blocked), &PolicyRule{Action: PolicyNXDOMAIN}); err != nil {
+		t.Fatalf("AddBlocklist: %v", err)
+	}
+	return policies
+}
+
+func TestRPZActions(t *testing.T) {
+	policies := testRPZ(t, "allowed.blocked\n")
+
+	for name, want := range map[string]string{
+		"blocked.":         PolicyNXDOMAIN,
+		"sub.blocked.":     PolicyNXDOMAIN,
+		"empty.":           PolicyNODATA,
+		"dropped.":         PolicyDrop,
+		"local.":           PolicyRedirect,
+		"alias.":           PolicyRedirect,
+		"allowed.blocked.": PolicyPassthru, // the exact name wins over the wildcard and later sources
+		"unlisted.":        "",
+		"32.1.2.0.192.":    "", // IP triggers are not supported
+	} {
+		if got := policyAction(policies, name); got != want {
+			t.Errorf("Action for %s = %q, want %q", name, got, want)
+		}
+	}
+	if _, source := policies.Match("blocked."); source != "rpz.test." {
+		t.Errorf("Source for blocked. = %q", source)
+	}
+}
+
+func TestRPZAnswers(t *testing.T) {
+	policies := testRPZ(t, "")
+	answer := func(name string, qType uint16) *dns.Msg {
+		t.Helper()
+		rule, _ := policies.Match(name)
+		if rule == nil {
+			t.Fatalf("No rule for %s", name)
+		}
+		return rule.Answer(name, qType)
+	}
+
+	if msg := answer("blocked.", dns.TypeA); msg.Rcode != dns.RcodeNameError || len(msg.Answer) != 0 {
+		t.Errorf("NXDOMAIN answer = %v", msg)
+	}
+	if msg := answer("empty.", dns.TypeA); msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 0 {
+		t.Errorf("NODATA answer = %v", msg)
+	}
+
+	// Local data answers with the records of the queried type, owned by the query name
+	msg := answer("local.", dns.TypeAAAA)
+	if len(msg.Answer) != 1 || msg.Answer[0].String() != "local.\t300\tIN\tAAAA\t2001:db8::1" {
+		t.Errorf("Local data AAAA answer = %v", msg.Answer)
+	}
+	if msg := answer("local.", dns.TypeANY); len(msg.Answer) != 2 {
+		t.Errorf("Local data ANY answer = %v", msg.Answer)
+	}
+	if msg := answer("local.", dns.TypeMX); msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 0 {
+		t.Errorf("Local data MX answer = %v", msg)
+	}
+	msg = answer("alias.", dns.TypeA)
+	if len(msg.Answer) != 1 || msg.Answer[0].String() != "alias.\t300\tIN\tCNAME\twww.example." {
+		t.Errorf("Local CNAME answer = %v", msg.Answer)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Prefix lengths that group clients for rate limiting, so an attacker cannot escape the limits
+// by spreading spoofed sources over a network
+const (
+	rateLimitIPv4Prefix = 24
+	rateLimitIPv6Prefix = 56
+)
+
+// maxRateLimitBuckets caps the buckets a RateLimiter tracks, so a flood from many networks or for
+// many names cannot grow them without bound between janitor sweeps
+const maxRateLimitBuckets = 100000
+
+// RateLimiter implements response rate limiting (RRL) and per-client query throttling with token
+// buckets. Responses are limited per client network and identical response, so the same answer
+// cannot be reflected at a victim again and again while other answers flow freely. Over-limit UDP
+// responses are dropped, except that every Slip-th one is sent truncated so a legitimate client can
+// retry over TCP, which spoofed sources cannot. Queries are limited per client network on every transport.
+type RateLimiter struct {
+	// ResponsesPerSecond is the sustained rate of each response bucket, 0 to disable RRL
+	ResponsesPerSecond float64
+	// QueriesPerSecond is the sustained query rate of each client network, 0 to disable throttling
+	QueriesPerSecond float64
+	// Burst is how many seconds worth of tokens a bucket holds
+	Burst float64
+	// Slip sends every Slip-th limited UDP response truncated instead of dropping it; 0 drops them all
+	Slip int
+	// Exempt clients are never limited
+	Exempt *ACL
+
+	mu         sync.Mutex
+	buckets    map[string]*list.Element
+	lru        *list.List // of *tokenBucket, most recently used first
+	maxBuckets int
+	now        func() time.Time
+}
+
+// tokenBucket holds the tokens left for one client network and response
+type tokenBucket struct {
+	key     string
+	tokens  float64
+	updated time.Time
+	limited int // responses limited in a row, to pick the ones that slip
+}
+
+// NewRateLimiter initializes and returns a new RateLimiter
+func NewRateLimiter(responsesPerSecond, queriesPerSecond, burst float64, slip int, exempt *ACL) *RateLimiter {
+	return &RateLimiter{
+		ResponsesPerSecond: responsesPerSecond,
+		QueriesPerSecond:   queriesPerSecond,
+		Burst:              burst,
+		Slip:               slip,
+		Exempt:             exempt,
+		buckets:            make(map[string]*list.Element),
+		lru:                list.New(),
+		maxBuckets:         maxRateLimitBuckets,
+		now:                time.Now,
+	}
+}
+
+// take removes a token from the bucket called key, which refills at rate, and reports whether
+// there was one. For limited requests it also reports whether they are due to slip. When the table
+// is full the least recently used bucket is forgotten to make room.
+func (l *RateLimiter) take(key string, rate float64) (ok, slip bool) {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var bucket *tokenBucket
+	if elem, found := l.buckets[key]; found {
+		l.lru.MoveToFront(elem)
+		bucket = elem.Value.(*tokenBucket)
+	} else {
+		if l.lru.Len() >= l.maxBuckets {
+			oldest := l.lru.Back()
+			delete(l.buckets, oldest.Value.(*tokenBucket).key)
+			l.lru.Remove(oldest)
+		}
+		bucket = &tokenBucket{key: key, tokens: rate * l.Burst, updated: now}
+		l.buckets[key] = l.lru.PushFront(bucket)
+	}
+	bucket.tokens = min(rate*l.Burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*rate)
+	bucket.updated = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		bucket.limited = 0
+		return true, false
+	}
+	bucket.limited++
+	return false, l.Slip > 0 && bucket.limited%l.Slip == 0
+}
+
+// RunJanitor periodically forgets buckets that have been idle long enough to be full again
+func (l *RateLimiter) RunJanitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		idle := l.now().Add(-time.Duration(l.Burst * float64(time.Second)))
+		l.mu.Lock()
+		// Buckets are ordered by last use, so the idle ones are all at the back
+		for elem := l.lru.Back(); elem != nil && elem.Value.(*tokenBucket).updated.Before(idle); elem = l.lru.Back() {
+			delete(l.buckets, elem.Value.(*tokenBucket).key)
+			l.lru.Remove(elem)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// Handler wraps next so its queries and responses are rate limited
+func (l *RateLimiter) Handler(next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		if l.Exempt.Allows(w, r) {
+			next.ServeDNS(w, r)
+			return
+		}
+		_, isUDP := w.RemoteAddr().(*net.UDPAddr)
+		network := clientNetwork(w.RemoteAddr())
+		if l.QueriesPerSecond > 0 {
+			if ok, _ := l.take(network+"/query", l.QueriesPerSecond); !ok {
+				rateLimited.WithLabelValues("query", "dropped").Inc()
+				if !isUDP {
+					// Streams cannot be spoofed, so tell the client rather than leave it waiting
+					replyRcode(w, r, dns.RcodeRefused)
+				}
+				return
+			}
+		}
+		if l.ResponsesPerSecond > 0 && isUDP {
+			w = &rateLimitedWriter{ResponseWriter: w, limiter: l, network: network}
+		}
+		next.ServeDNS(w, r)
+	})
+}
+
+// rateLimitedWriter applies RRL to the responses written through it
+type rateLimitedWriter struct {
+	dns.ResponseWriter
+	limiter *RateLimiter
+	network string
+}
+
+// WriteMsg writes msg if its bucket has a token left, or slips or drops it otherwise
+func (w *rateLimitedWriter) WriteMsg(msg *dns.Msg) error {
+	class := responseClass(msg)
+	ok, slip := w.limiter.take(w.network+"/"+class+"/"+responseName(msg, class), w.limiter.ResponsesPerSecond)
+	if ok {
+		return w.ResponseWriter.WriteMsg(msg)
+	}
+	if !slip {
+		rateLimited.WithLabelValues(class, "dropped").Inc()
+		return nil
+	}
+	rateLimited.WithLabelValues(class, "slipped").Inc()
+	truncated := new(dns.Msg)
+	truncated.SetReply(msg)
+	truncated.Rcode = msg.Rcode
+	truncated.Truncated = true
+	return w.ResponseWriter.WriteMsg(truncated)
+}
+
+// recordSource implements sourceRecorder
+func (w *rateLimitedWriter) recordSource(source string) {
+	answeredBy(w.ResponseWriter, source)
+}
+
+// Unwrap returns the wrapped response writer
+func (w *rateLimitedWriter) Unwrap() dns.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// responseClass groups responses the way RRL limits them: answers, referrals, negative answers and errors
+// are limited separately, so a flood of one kind does not starve the others
+func responseClass(msg *dns.Msg) string {
+	switch {
+	case msg.Rcode == dns.RcodeNameError:
+		return "nxdomain"
+	case msg.Rcode != dns.RcodeSuccess:
+		return "error"
+	case len(msg.Answer) > 0:
+		return "answer"
+	case !msg.Authoritative && len(msg.Ns) > 0 && msg.Ns[0].Header().Rrtype == dns.TypeNS:
+		return "referral"
+	}
+	return "nodata"
+}
+
+// responseName returns what identifies a response within its class, as BIND's RRL does: the
+// question for answers, the zone for NXDOMAIN, so random subdomains of one zone share a bucket,
+// and nothing for errors
+func responseName(msg *dns.Msg, class string) string {
+	if len(msg.Question) == 0 {
+		return ""
+	}
+	q := msg.Question[0]
+	switch class {
+	case "error":
+		return ""
+	case "nxdomain":
+		for _, rr := range msg.Ns {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				return dns.CanonicalName(rr.Header().Name)
+			}
+		}
+		return dns.CanonicalName(q.Name)
+	}
+	return dns.CanonicalName(q.Name) + "/" + typeName(q.Qtype)
+}
+
+// clientNetwork returns the network a client address is rate limited with
+func clientNetwork(addr net.Addr) string {
+	ip := addrIP(addr)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(rateLimitIPv4Prefix, 32)).String()
+	}
+	if ip == nil {
+		return addr.String()
+	}
+	return ip.Mask(net.CIDRMask(rateLimitIPv6Prefix, 128)).String()
+}
+
+var rateLimited = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "dns_rate_limited_total",
+		Help: "Total number of queries and responses dropped or slipped by rate limiting",
+	},
+	[]string{"class", "action"},
+)
+
+func init() {
+	prometheus.MustRegister(rateLimited)
+}
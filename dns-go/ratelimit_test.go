@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testRateLimiter returns a RateLimiter with a stopped clock that limits responses to one per
+// second without burst and exempts private networks
+func testRateLimiter(t *testing.T, slip int) (*RateLimiter, *time.Time) {
+	t.Helper()
+	exempt, err := ParseACL([]string{"private"})
+	if err != nil {
+		t.Fatalf("ParseACL: %v", err)
+	}
+	limiter := NewRateLimiter(1, 0, 1, slip, exempt)
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+	return limiter, &now
+}
+
+// answerA answers every question with an address
+var answerA = dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+	msg := new(dns.Msg)
+	msg.SetReply(r)
+	rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 192.0.2.1")
+	msg.Answer = []dns.RR{rr}
+	w.WriteMsg(msg)
+})
+
+// rateLimitOutcome sends a query for name from client through handler and describes what came back
+func rateLimitOutcome(handler dns.Handler, w *testWriter, name string) string {
+	r := new(dns.Msg)
+	r.SetQuestion(name, dns.TypeA)
+	w.msg = nil
+	handler.ServeDNS(w, r)
+	switch {
+	case w.msg == nil:
+		return "dropped"
+	case w.msg.Truncated && len(w.msg.Answer) == 0:
+		return "slipped"
+	case w.msg.Rcode == dns.RcodeRefused:
+		return "refused"
+	}
+	return "answered"
+}
+
+func TestRateLimitSlip(t *testing.T) {
+	tests := []struct {
+		slip int
+		want []string
+	}{
+		{slip: 2, want: []string{"answered", "dropped", "slipped", "dropped", "slipped"}},
+		{slip: 1, want: []string{"answered", "slipped", "slipped"}},
+		{slip: 0, want: []string{"answered", "dropped", "dropped", "dropped"}},
+	}
+	for _, test := range tests {
+		limiter, _ := testRateLimiter(t, test.slip)
+		handler := limiter.Handler(answerA)
+		w := writerFrom("198.51.100.1")
+		for i, want := range test.want {
+			if got := rateLimitOutcome(handler, w, "www.example.test."); got != want {
+				t.Errorf("Slip %d: response %d %s, want %s", test.slip, i+1, got, want)
+			}
+		}
+	}
+}
+
+func TestRateLimitBuckets(t *testing.T) {
+	limiter, now := testRateLimiter(t, 0)
+	handler := limiter.Handler(answerA)
+	client := writerFrom("198.51.100.1")
+
+	steps := []struct {
+		w    *testWriter
+		name string
+		want string
+	}{
+		{client, "www.example.test.", "answered"},
+		{client, "www.example.test.", "dropped"},
+		// Other answers have buckets of their own
+		{client, "mail.example.test.", "answered"},
+		// The rest of the /24 shares the client's buckets, other networks do not
+		{writerFrom("198.51.100.200"), "www.example.test.", "dropped"},
+		{writerFrom("203.0.113.1"), "www.example.test.", "answered"},
+		// Private networks are exempt
+		{writerFrom("192.168.1.10"), "www.example.test.", "answered"},
+		{writerFrom("192.168.1.10"), "www.example.test.", "answered"},
+		// Streams cannot be spoofed, so responses over TCP are never limited
+		{&testWriter{remote: &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 5353}}, "www.example.test.", "answered"},
+	}
+	for i, step := range steps {
+		if got := rateLimitOutcome(handler, step.w, step.name); got != step.want {
+			t.Errorf("Step %d: %s for %s from %s, want %s", i+1, got, step.name, step.w.RemoteAddr(), step.want)
+		}
+	}
+
+	// The bucket refills with time
+	*now = now.Add(time.Second)
+	if got := rateLimitOutcome(handler, client, "www.example.test."); got != "answered" {
+		t.Errorf("Got %s after a second, want answered", got)
+	}
+}
+
+func TestRateLimitQueries(t *testing.T) {
+	limiter, _ := testRateLimiter(t, 0)
+	limiter.ResponsesPerSecond, limiter.QueriesPerSecond = 0, 1
+	handler := limiter.Handler(answerA)
+
+	udp := writerFrom("198.51.100.1")
+	tcp := &testWriter{remote: &net.TCPAddr{IP: net.ParseIP("203.0.113.1"), Port: 5353}}
+	for _, step := range []struct {
+		w    *testWriter
+		want string
+	}{{udp, "answered"}, {udp, "dropped"}, {tcp, "answered"}, {tcp, "refused"}} {
+		if got := rateLimitOutcome(handler, step.w, "www.example.test."); got != step.want {
+			t.Errorf("Query from %s %s, want %s", step.w.RemoteAddr(), got, step.want)
+		}
+	}
+}
+
+func TestRateLimitMaxBuckets(t *testing.T) {
+	limiter, _ := testRateLimiter(t, 0)
+	limiter.maxBuckets = 2
+	handler := limiter.Handler(answerA)
+
+	first := writerFrom("198.51.100.1")
+	rateLimitOutcome(handler, first, "www.example.test.")
+	rateLimitOutcome(handler, writerFrom("203.0.113.1"), "www.example.test.")
+	rateLimitOutcome(handler, writerFrom("192.0.2.1"), "www.example.test.")
+	if len(limiter.buckets) != 2 || limiter.lru.Len() != 2 {
+		t.Fatalf("Got %d buckets, want them capped at 2", len(limiter.buckets))
+	}
+	// The least recently used bucket made room and starts out full again
+	if got := rateLimitOutcome(handler, first, "www.example.test."); got != "answered" {
+		t.Errorf("Got %s from the network whose bucket was forgotten, want answered", got)
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// maxReferrals bounds the number of referrals followed resolving one name
+	maxReferrals = 30
+	// maxMinimiseCount bounds the minimised queries sent for one name, so long names such as
+	// ip6.arpa ones reveal several labels at a time (MAX_MINIMISE_COUNT, RFC 9156 section 2.3)
+	maxMinimiseCount = 10
+	// minimiseOneLabel is the number of minimised queries revealing a single label before the
+	// remaining labels are spread over the rest (MINIMISE_ONE_LAB, RFC 9156 section 2.3)
+	minimiseOneLabel = 4
+	// maxRecursionDepth bounds nested resolutions of name server addresses and CNAME targets
+	maxRecursionDepth = 6
+	// maxCNAMEChain bounds the number of CNAMEs followed for one query
+	maxCNAMEChain = 8
+	// recursorUDPSize is the EDNS buffer size advertised to authoritative servers (DNS flag day 2020)
+	recursorUDPSize = 1232
+	// recursiveUpstream labels the upstream metrics of queries to authoritative servers
+	recursiveUpstream = "recursive"
+)
+
+// rootHints are the addresses of the root servers, as published in IANA's named.root
+const rootHints = `
+.                  3600000  IN NS  a.root-servers.net.
+.                  3600000  IN NS  b.root-servers.net.
+.                  3600000  IN NS  c.root-servers.net.
+.                  3600000  IN NS  d.root-servers.net.
+.                  3600000  IN NS  e.root-servers.net.
+.                  3600000  IN NS  f.root-servers.net.
+.                  3600000  IN NS  g.root-servers.net.
+.                  3600000  IN NS  h.root-servers.net.
+.                  3600000  IN NS  i.root-servers.net.
+.                  3600000  IN NS  j.root-servers.net.
+.                  3600000  IN NS  k.root-servers.net.
+.                  3600000  IN NS  l.root-servers.net.
+.                  3600000  IN NS  m.root-servers.net.
+a.root-servers.net. 3600000 IN A    198.41.0.4
+b.root-servers.net. 3600000 IN A    170.247.170.2
+c.root-servers.net. 3600000 IN A    192.33.4.12
+d.root-servers.net. 3600000 IN A    199.7.91.13
+e.root-servers.net. 3600000 IN A    192.203.230.10
+f.root-servers.net. 3600000 IN A    192.5.5.241
+g.root-servers.net. 3600000 IN A    192.112.36.4
+h.root-servers.net. 3600000 IN A    198.97.190.53
+i.root-servers.net. 3600000 IN A    192.36.148.17
+j.root-servers.net. 3600000 IN A    192.58.128.30
+k.root-servers.net. 3600000 IN A    193.0.14.129
+l.root-servers.net. 3600000 IN A    199.7.83.42
+m.root-servers.net. 3600000 IN A    202.12.27.33
+`
+
+// errResolutionLoop is returned when resolving a name exceeds the recursor's limits
+var errResolutionLoop = errors.New("resolution loop or limit exceeded")
+
+// Recursor resolves queries iteratively, starting at the root servers and following referrals
+// down to the authoritative servers of each name (RFC 1034 section 5.3.3). It only sends each
+// server as much of the name as it needs to see (QNAME minimisation, RFC 9156).
+type Recursor struct {
+	roots  []string
+	client *dns.Client
+	port   string // port of the name servers found in referrals
+
+	mu          sync.Mutex
+	delegations map[string]*delegation
+}
+
+// delegation holds the name server addresses of a zone learned from a referral
+type delegation struct {
+	servers []string
+	expires time.Time
+}
+
+// NewRecursor initializes and returns a new Recursor that starts at the root servers in roots.
+// Each query to an authoritative server gives up after timeout.
+func NewRecursor(roots []string, timeout time.Duration) *Recursor {
+	return &Recursor{
+		roots:       roots,
+		client:      &dns.Client{Timeout: timeout, UDPSize: recursorUDPSize},
+		port:        "53",
+		delegations: make(map[string]*delegation),
+	}
+}
+
+// LoadRootHints reads root server addresses from a named.root style hints file at path.
+// With an empty path the addresses of the Internet's root servers are returned.
+func LoadRootHints(path string) ([]string, error) {
+	data := rootHints
+	if path != "" {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		data = string(raw)
+	}
+
+	var roots []string
+	parser := dns.NewZoneParser(strings.NewReader(data), ".", path)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		switch rr := rr.(type) {
+		case *dns.A:
+			roots = append(roots, net.JoinHostPort(rr.A.String(), "53"))
+		case *dns.AAAA:
+			roots = append(roots, net.JoinHostPort(rr.AAAA.String(), "53"))
+		}
+	}
+	if err := parser.Err(); err != nil {
+		return nil, err
+	}
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("%s: no root server addresses", path)
+	}
+	return roots, nil
+}
+
+// Exchange resolves the first question of r and returns the answer as a reply to r
+func (rc *Recursor) Exchange(r *dns.Msg) (*dns.Msg, error) {
+	if len(r.Question) == 0 {
+		return nil, errors.New("no question")
+	}
+	q := r.Question[0]
+	msg, err := rc.resolve(dns.CanonicalName(q.Name), q.Qtype, dnssecOK(r), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := new(dns.Msg)
+	reply.SetReply(r)
+	reply.RecursionAvailable = true
+	reply.Rcode = msg.Rcode
+	reply.Answer, reply.Ns, reply.Extra = msg.Answer, msg.Ns, msg.Extra
+	return reply, nil
+}
+
+// resolve answers name and qType, following CNAMEs to their targets
+func (rc *Recursor) resolve(name string, qType uint16, do bool, depth int) (*dns.Msg, error) {
+	if depth > maxRecursionDepth {
+		return nil, fmt.Errorf("%w: %s nested too deep", errResolutionLoop, name)
+	}
+
+	result := new(dns.Msg)
+	seen := map[string]bool{name: true}
+	for range maxCNAMEChain {
+		msg, err := rc.iterate(name, qType, do, depth)
+		if err != nil {
+			return nil, err
+		}
+		result.Rcode = msg.Rcode
+		result.Answer = append(result.Answer, msg.Answer...)
+		result.Ns, result.Extra = msg.Ns, msg.Extra
+		if qType == dns.TypeCNAME || hasRRset(msg.Answer, name, qType) {
+			return result, nil
+		}
+
+		// Servers follow CNAMEs within their own zones, continue from the end of the chain they gave
+		followed := false
+		for target := cnameTarget(msg.Answer, name); target != ""; target = cnameTarget(msg.Answer, name) {
+			if seen[target] {
+				return nil, fmt.Errorf("%w: CNAME loop at %s", errResolutionLoop, target)
+			}
+			seen[target] = true
+			name, followed = target, true
+		}
+		if !followed || hasRRset(msg.Answer, name, qType) || msg.Rcode != dns.RcodeSuccess {
+			return result, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: CNAME chain longer than %d", errResolutionLoop, maxCNAMEChain)
+}
+
+// iterate follows referrals from the closest known zone cut down to the servers authoritative for name
+func (rc *Recursor) iterate(name string, qType uint16, do bool, depth int) (*dns.Msg, error) {
+	zone, servers := rc.closestDelegation(name)
+	known := zone // the deepest ancestor of name known to exist, below which labels are hidden
+	minimise := true
+	steps := 0 // minimised queries sent
+
+	for referrals := 0; referrals < maxReferrals; {
+		qname, qt := name, qType
+		if minimise && known != name && steps < maxMinimiseCount {
+			// Reveal more of name, asking for A records as RFC 9156 section 3 recommends
+			// until the whole name is revealed
+			qname, steps = minimisedName(name, known, steps), steps+1
+			if qname != name {
+				qt = dns.TypeA
+			}
+		}
+
+		msg, err := rc.query(servers, qname, qt, do)
+		if err != nil {
+			return nil, fmt.Errorf("resolving %s in %s: %w", name, zone, err)
+		}
+
+		if cut, ns := referral(msg); cut != "" {
+			// The cut has to be below the zone we asked and at or above the name we are after (bailiwick)
+			if cut == zone || !dns.IsSubDomain(zone, cut) || !dns.IsSubDomain(cut, qname) {
+				return nil, fmt.Errorf("%s referred %s to %s, outside its bailiwick", zone, qname, cut)
+			}
+			addrs, err := rc.serverAddrs(zone, ns, msg.Extra, do, depth)
+			if err != nil {
+				return nil, err
+			}
+			rc.remember(cut, addrs, ns[0].Header().Ttl)
+			zone, servers, known = cut, addrs, cut
+			referrals++
+			continue
+		}
+
+		if qname != name {
+			switch {
+			case msg.Rcode == dns.RcodeSuccess && cnameTarget(msg.Answer, qname) == "":
+				// No zone cut at qname, keep descending within this zone
+				known = qname
+			default:
+				// NXDOMAIN, a CNAME or data for a hidden label: some servers answer these wrongly for
+				// minimised queries (RFC 9156 section 4), so ask for the full name instead
+				minimise = false
+			}
+			continue
+		}
+
+		return sanitize(msg, zone), nil
+	}
+	return nil, fmt.Errorf("%w: more than %d referrals for %s", errResolutionLoop, maxReferrals, name)
+}
+
+// query sends a non-recursive query to servers in turn until one gives a usable answer
+func (rc *Recursor) query(servers []string, name string, qType uint16, do bool) (*dns.Msg, error) {
+	query := new(dns.Msg)
+	query.SetQuestion(name, qType)
+	query.RecursionDesired = false
+	query.SetEdns0(recursorUDPSize, do)
+
+	var lastErr error
+	for _, server := range servers {
+		msg, rtt, err := rc.client.Exchange(query, server)
+		if err == nil && msg.Truncated {
+			tcp := &dns.Client{Net: "tcp", Timeout: rc.client.Timeout}
+			msg, rtt, err = tcp.Exchange(query, server)
+		}
+		// Authoritative servers are too many to label individually
+		if err != nil {
+			upstreamErrors.WithLabelValues(recursiveUpstream).Inc()
+		} else {
+			upstreamLatency.WithLabelValues(recursiveUpstream).Observe(rtt.Seconds())
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %w", server, err)
+			continue
+		}
+		if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+			lastErr = fmt.Errorf("%s answered %s", server, dns.RcodeToString[msg.Rcode])
+			continue
+		}
+		return msg, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no name server addresses")
+	}
+	return nil, lastErr
+}
+
+// serverAddrs returns the addresses of the name servers in a referral from zone. Glue is only
+// trusted for names inside zone; other name servers are resolved separately.
+func (rc *Recursor) serverAddrs(zone string, ns []dns.RR, extra []dns.RR, do bool, depth int) ([]string, error) {
+	var addrs, glueless []string
+	for _, rr := range ns {
+		host := dns.CanonicalName(rr.(*dns.NS).Ns)
+		found := false
+		for _, glue := range extra {
+			if !strings.EqualFold(glue.Header().Name, host) || !dns.IsSubDomain(zone, host) {
+				continue
+			}
+			switch glue := glue.(type) {
+			case *dns.A:
+				addrs = append(addrs, net.JoinHostPort(glue.A.String(), rc.port))
+				found = true
+			case *dns.AAAA:
+				addrs = append(addrs, net.JoinHostPort(glue.AAAA.String(), rc.port))
+				found = true
+			}
+		}
+		if !found {
+			glueless = append(glueless, host)
+		}
+	}
+
+	// Glueless name servers are only looked up when there is no glue to go on
+	var lastErr error
+	for _, host := range glueless {
+		if len(addrs) > 0 {
+			break
+		}
+		msg, err := rc.resolve(host, dns.TypeA, false, depth+1)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, rr := range msg.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				addrs = append(addrs, net.JoinHostPort(a.A.String(), rc.port))
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no usable name server addresses in delegation from %s: %v", zone, lastErr)
+	}
+	return addrs, nil
+}
+
+// closestDelegation returns the deepest zone cut above name with known name servers
+func (rc *Recursor) closestDelegation(name string) (string, []string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	now := time.Now()
+	for _, offset := range dns.Split(name) {
+		zone := name[offset:]
+		if d, ok := rc.delegations[zone]; ok {
+			if now.Before(d.expires) {
+				return zone, d.servers
+			}
+			delete(rc.delegations, zone)
+		}
+	}
+	return ".", rc.roots
+}
+
+// remember caches the name servers of zone for the TTL of its NS records
+func (rc *Recursor) remember(zone string, servers []string, ttl uint32) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.delegations[zone] = &delegation{servers: servers, expires: time.Now().Add(min(time.Duration(ttl)*time.Second, maxCacheTTL))}
+	if len(rc.delegations) > 10000 {
+		log.Printf("Delegation cache full, clearing it")
+		clear(rc.delegations)
+	}
+}
+
+// referral returns the zone cut and NS records of msg if it is a referral
+func referral(msg *dns.Msg) (string, []dns.RR) {
+	if msg.Authoritative || msg.Rcode != dns.RcodeSuccess || len(msg.Answer) > 0 {
+		return "", nil
+	}
+	var cut string
+	var ns []dns.RR
+	for _, rr := range msg.Ns {
+		if rr.Header().Rrtype != dns.TypeNS {
+			continue
+		}
+		owner := dns.CanonicalName(rr.Header().Name)
+		if cut != "" && owner != cut {
+			continue
+		}
+		cut = owner
+		ns = append(ns, rr)
+	}
+	return cut, ns
+}
+
+// sanitize drops records an authoritative answer from zone has no business vouching for
+func sanitize(msg *dns.Msg, zone string) *dns.Msg {
+	inZone := func(rrs []dns.RR) []dns.RR {
+		var kept []dns.RR
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeOPT || dns.IsSubDomain(zone, rr.Header().Name) {
+				kept = append(kept, rr)
+			}
+		}
+		return kept
+	}
+	msg.Answer, msg.Ns, msg.Extra = inZone(msg.Answer), inZone(msg.Ns), inZone(msg.Extra)
+	return msg
+}
+
+// minimisedName returns the ancestor of name to ask for in minimised query number step, known being
+// the deepest ancestor known to exist. The first minimiseOneLabel steps reveal one label each; the
+// labels still hidden after them are spread over the steps left up to maxMinimiseCount.
+func minimisedName(name, known string, step int) string {
+	hidden := dns.CountLabel(name) - dns.CountLabel(known)
+	reveal := 1
+	if step >= minimiseOneLabel {
+		left := max(maxMinimiseCount-step, 1)
+		reveal = (hidden + left - 1) / left
+	}
+	reveal = min(reveal, hidden)
+	labels := dns.Split(name)
+	return name[labels[len(labels)-dns.CountLabel(known)-reveal]:]
+}
+
+// cnameTarget returns the target of the CNAME for name in answer, if any
+func cnameTarget(answer []dns.RR, name string) string {
+	for _, rr := range answer {
+		if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+			return dns.CanonicalName(cname.Target)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testHierarchy is a small DNS tree served from loopback addresses: a root, a test. TLD with
+// example.test. below it, and arpa., ip6.arpa. and the reverse zone of 2001:db8::/32. The reverse
+// zone is delegated to a name server without glue.
+var testHierarchy = map[string][]string{
+	"127.0.0.2": {`
+. 3600 IN SOA ns.root. hostmaster.root. 1 3600 600 86400 60
+. 3600 IN NS ns.root.
+ns.root. 3600 IN A 127.0.0.2
+test. 3600 IN NS ns.test.
+ns.test. 3600 IN A 127.0.0.3
+arpa. 3600 IN NS ns.arpa.
+ns.arpa. 3600 IN A 127.0.0.5
+`},
+	"127.0.0.3": {`
+test. 3600 IN SOA ns.test. hostmaster.test. 1 3600 600 86400 60
+test. 3600 IN NS ns.test.
+ns.test. 3600 IN A 127.0.0.3
+example.test. 3600 IN NS ns.example.test.
+ns.example.test. 3600 IN A 127.0.0.4
+`},
+	"127.0.0.4": {`
+example.test. 3600 IN SOA ns.example.test. hostmaster.example.test. 1 3600 600 86400 60
+example.test. 3600 IN NS ns.example.test.
+example.test. 3600 IN MX 10 mail.example.test.
+ns.example.test. 3600 IN A 127.0.0.4
+www.example.test. 3600 IN A 192.0.2.1
+mail.example.test. 3600 IN A 192.0.2.2
+`, `
+8.b.d.0.1.0.0.2.ip6.arpa. 3600 IN SOA ns.example.test. hostmaster.example.test. 1 3600 600 86400 60
+8.b.d.0.1.0.0.2.ip6.arpa. 3600 IN NS ns.example.test.
+1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa. 3600 IN PTR www.example.test.
+`},
+	"127.0.0.5": {`
+arpa. 3600 IN SOA ns.arpa. hostmaster.arpa. 1 3600 600 86400 60
+arpa. 3600 IN NS ns.arpa.
+ns.arpa. 3600 IN A 127.0.0.5
+ip6.arpa. 3600 IN NS ns.ip6.arpa.
+ns.ip6.arpa. 3600 IN A 127.0.0.6
+`},
+	"127.0.0.6": {`
+ip6.arpa. 3600 IN SOA ns.ip6.arpa. hostmaster.ip6.arpa. 1 3600 600 86400 60
+ip6.arpa. 3600 IN NS ns.ip6.arpa.
+ns.ip6.arpa. 3600 IN A 127.0.0.6
+8.b.d.0.1.0.0.2.ip6.arpa. 3600 IN NS ns.example.test.
+`},
+}
+
+// fakeAuthorities answers queries from the zones of testHierarchy and records the names each
+// server is asked about
+type fakeAuthorities struct {
+	mu    sync.Mutex
+	asked map[string][]string // server address -> query names
+}
+
+// Asked returns the names the server at addr was asked about
+func (f *fakeAuthorities) Asked(addr string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.asked[addr]...)
+}
+
+// startHierarchy serves testHierarchy and returns a Recursor using it as the Internet
+func startHierarchy(t *testing.T) (*Recursor, *fakeAuthorities) {
+	t.Helper()
+	fake := &fakeAuthorities{asked: make(map[string][]string)}
+
+	// Every server listens on the same port, the one the recursor assumes for name servers in referrals
+	first, err := net.ListenPacket("udp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("Cannot listen on loopback: %v", err)
+	}
+	_, port, _ := net.SplitHostPort(first.LocalAddr().String())
+
+	for addr, zoneTexts := range testHierarchy {
+		var zones []*Zone
+		for _, text := range zoneTexts {
+			zones = append(zones, parseTestZone(t, text))
+		}
+		conn := first
+		if addr != "127.0.0.2" {
+			if conn, err = net.ListenPacket("udp", net.JoinHostPort(addr, port)); err != nil {
+				t.Skipf("Cannot listen on %s: %v", addr, err)
+			}
+		}
+		server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			q := r.Question[0]
+			fake.mu.Lock()
+			fake.asked[addr] = append(fake.asked[addr], dns.CanonicalName(q.Name))
+			fake.mu.Unlock()
+
+			// Answer from the deepest zone the server has for the name
+			var zone *Zone
+			for _, z := range zones {
+				if dns.IsSubDomain(z.Origin, dns.CanonicalName(q.Name)) && (zone == nil || dns.CountLabel(z.Origin) > dns.CountLabel(zone.Origin)) {
+					zone = z
+				}
+			}
+			reply := new(dns.Msg)
+			reply.SetReply(r)
+			if zone == nil {
+				reply.Rcode = dns.RcodeRefused
+				w.WriteMsg(reply)
+				return
+			}
+			msg := zone.Lookup(q.Name, q.Qtype)
+			reply.Authoritative, reply.Rcode = msg.Authoritative, msg.Rcode
+			reply.Answer, reply.Ns, reply.Extra = msg.Answer, msg.Ns, msg.Extra
+			w.WriteMsg(reply)
+		})}
+		go server.ActivateAndServe()
+		t.Cleanup(func() { server.Shutdown() })
+	}
+
+	rc := NewRecursor([]string{net.JoinHostPort("127.0.0.2", port)}, time.Second)
+	rc.port = port
+	return rc, fake
+}
+
+// parseTestZone builds a zone from records in master file format, the first one being its SOA
+func parseTestZone(t *testing.T, text string) *Zone {
+	t.Helper()
+	var zone *Zone
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		rr, err := dns.NewRR(line)
+		if err != nil {
+			t.Fatalf("Bad test record %q: %v", line, err)
+		}
+		if zone == nil {
+			zone = NewZone(rr.Header().Name)
+		}
+		if err := zone.Add(rr); err != nil {
+			t.Fatalf("Bad test record %q: %v", line, err)
+		}
+	}
+	return zone
+}
+
+// resolveTest resolves name and qType through rc and fails the test on error
+func resolveTest(t *testing.T, rc *Recursor, name string, qType uint16) *dns.Msg {
+	t.Helper()
+	query := new(dns.Msg)
+	query.SetQuestion(name, qType)
+	msg, err := rc.Exchange(query)
+	if err != nil {
+		t.Fatalf("Resolving %s %s: %v", name, dns.TypeToString[qType], err)
+	}
+	return msg
+}
+
+func TestRecursorResolve(t *testing.T) {
+	rc, fake := startHierarchy(t)
+
+	msg := resolveTest(t, rc, "www.example.test.", dns.TypeA)
+	if msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 1 {
+		t.Fatalf("Got %s with %d answers, want NOERROR with 1", dns.RcodeToString[msg.Rcode], len(msg.Answer))
+	}
+	if a, ok := msg.Answer[0].(*dns.A); !ok || a.A.String() != "192.0.2.1" {
+		t.Fatalf("Got answer %s, want the A record of www.example.test.", msg.Answer[0])
+	}
+
+	// The root and the TLD only ever see as much of the name as they need (RFC 9156)
+	for addr, labels := range map[string]int{"127.0.0.2": 1, "127.0.0.3": 2} {
+		for _, name := range fake.Asked(addr) {
+			if dns.CountLabel(name) > labels {
+				t.Errorf("%s was asked about %s, more than %d labels", addr, name, labels)
+			}
+		}
+	}
+}
+
+func TestRecursorNegative(t *testing.T) {
+	rc, _ := startHierarchy(t)
+
+	tests := []struct {
+		name  string
+		qType uint16
+		rcode int
+	}{
+		{"missing.example.test.", dns.TypeA, dns.RcodeNameError},
+		// The last minimised query asks for the full name, and must ask for the type wanted
+		{"mail.example.test.", dns.TypeMX, dns.RcodeSuccess},
+		{"example.test.", dns.TypeTXT, dns.RcodeSuccess},
+	}
+	for _, test := range tests {
+		msg := resolveTest(t, rc, test.name, test.qType)
+		if msg.Rcode != test.rcode || len(msg.Answer) != 0 {
+			t.Errorf("%s %s: got %s with answers %v, want %s without answers", test.name, dns.TypeToString[test.qType],
+				dns.RcodeToString[msg.Rcode], msg.Answer, dns.RcodeToString[test.rcode])
+		}
+	}
+}
+
+func TestRecursorLongName(t *testing.T) {
+	rc, fake := startHierarchy(t)
+
+	// 34 labels below a glueless delegation: more steps than maxReferrals if taken one label at a time
+	name, _ := dns.ReverseAddr("2001:db8::1")
+	msg := resolveTest(t, rc, name, dns.TypePTR)
+	if len(msg.Answer) != 1 {
+		t.Fatalf("Got answers %v, want the PTR record", msg.Answer)
+	}
+	if ptr, ok := msg.Answer[0].(*dns.PTR); !ok || ptr.Ptr != "www.example.test." {
+		t.Fatalf("Got answer %s, want a PTR to www.example.test.", msg.Answer[0])
+	}
+
+	var queries int
+	for addr := range testHierarchy {
+		queries += len(fake.Asked(addr))
+	}
+	if limit := maxMinimiseCount + 2*maxRecursionDepth; queries > limit {
+		t.Errorf("Resolving took %d queries, want at most %d", queries, limit)
+	}
+}
+
+func TestMinimisedName(t *testing.T) {
+	long, _ := dns.ReverseAddr("2001:db8::1")
+	tests := []struct {
+		name, known string
+		step        int
+		want        string
+	}{
+		{"www.example.test.", ".", 0, "test."},
+		{"www.example.test.", "test.", 1, "example.test."},
+		{"www.example.test.", "example.test.", 2, "www.example.test."},
+		// One label at a time for the first steps
+		{long, "ip6.arpa.", 0, "2.ip6.arpa."},
+		{long, "2.ip6.arpa.", 3, "0.2.ip6.arpa."},
+		// Then the 31 labels left are spread over the 6 steps left
+		{long, "2.ip6.arpa.", 4, "b.d.0.1.0.0.2.ip6.arpa."},
+		// And the last step reveals the rest
+		{long, "2.ip6.arpa.", maxMinimiseCount - 1, long},
+		{long, "2.ip6.arpa.", maxMinimiseCount + 3, long},
+	}
+	for _, test := range tests {
+		if got := minimisedName(test.name, test.known, test.step); got != test.want {
+			t.Errorf("minimisedName(%s, %s, %d) = %s, want %s", test.name, test.known, test.step, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// secondaryInitialRetry is how long to wait between attempts before a secondary zone has been loaded once
+	secondaryInitialRetry = 30 * time.Second
+	// secondaryMinInterval keeps zones with tiny SOA timers from hammering their primaries
+	secondaryMinInterval = 5 * time.Second
+)
+
+// Secondary keeps a copy of a zone pulled from its primaries by AXFR. It checks the primary's
+// SOA serial every refresh interval, retries failed checks every retry interval, stops serving
+// the zone once it could not be refreshed for the expire interval, and refreshes immediately on NOTIFY.
+type Secondary struct {
+	Origin    string
+	Primaries []string
+
+	zones       *ZoneSet
+	refresh     chan struct{}
+	lastSuccess time.Time
+	now         func() time.Time
+}
+
+// NewSecondary initializes and returns a new Secondary for origin that stores the zone in zones.
+// Primaries without a port default to port 53.
+func NewSecondary(origin string, primaries []string, zones *ZoneSet) *Secondary {
+	secondary := &Secondary{
+		Origin:  dns.CanonicalName(origin),
+		zones:   zones,
+		refresh: make(chan struct{}, 1),
+		now:     time.Now,
+	}
+	for _, primary := range primaries {
+		if _, _, err := net.SplitHostPort(primary); err != nil {
+			primary = net.JoinHostPort(primary, "53")
+		}
+		secondary.Primaries = append(secondary.Primaries, primary)
+	}
+	return secondary
+}
+
+// IsPrimary reports whether addr belongs to one of the zone's primaries
+func (s *Secondary) IsPrimary(addr net.Addr) bool {
+	ip := addrIP(addr)
+	for _, primary := range s.Primaries {
+		host, _, _ := net.SplitHostPort(primary)
+		if primaryIP := net.ParseIP(host); primaryIP != nil && primaryIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Refresh asks the secondary to check its primaries right away
+func (s *Secondary) Refresh() {
+	select {
+	case s.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// Run keeps the zone in sync with its primaries until the process exits
+func (s *Secondary) Run() {
+	for {
+		timer := time.NewTimer(s.poll())
+		select {
+		case <-timer.C:
+		case <-s.refresh:
+			timer.Stop()
+		}
+	}
+}
+
+// poll syncs the zone once, dropping it when it has expired, and returns how long to wait
+// before the next check
+func (s *Secondary) poll() time.Duration {
+	wait := secondaryInitialRetry
+	err := s.sync()
+	zone, loaded := s.zones.Get(s.Origin)
+	switch {
+	case err == nil:
+		s.lastSuccess = s.now()
+		wait = time.Duration(zone.SOA.Refresh) * time.Second
+	case loaded:
+		log.Printf("Failed to refresh secondary zone %s: %v", s.Origin, err)
+		wait = time.Duration(zone.SOA.Retry) * time.Second
+		if s.now().Sub(s.lastSuccess) > time.Duration(zone.SOA.Expire)*time.Second {
+			log.Printf("Secondary zone %s expired, no longer serving it", s.Origin)
+			s.zones.Remove(s.Origin)
+			wait = secondaryInitialRetry
+		}
+	default:
+		log.Printf("Failed to load secondary zone %s: %v", s.Origin, err)
+	}
+	return max(wait, secondaryMinInterval)
+}
+
+// sync transfers the zone from the first primary that has a newer serial than the copy we hold
+func (s *Secondary) sync() error {
+	current, loaded := s.zones.Get(s.Origin)
+
+	var errs []error
+	for _, primary := range s.Primaries {
+		serial, err := s.primarySerial(primary)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if loaded && !serialNewer(serial, current.SOA.Serial) {
+			return nil
+		}
+
+		zone, err := s.transfer(primary)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		s.zones.Put(zone)
+		log.Printf("Transferred secondary zone %s from %s (serial %d)", s.Origin, primary, zone.SOA.Serial)
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+// primarySerial asks primary for the zone's current SOA serial
+func (s *Secondary) primarySerial(primary string) (uint32, error) {
+	query := new(dns.Msg)
+	query.SetQuestion(s.Origin, dns.TypeSOA)
+	client := &dns.Client{Net: "tcp", Timeout: 5 * time.Second}
+	response, _, err := client.Exchange(query, primary)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", primary, err)
+	}
+	for _, rr := range response.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, nil
+		}
+	}
+	return 0, fmt.Errorf("%s: no SOA for %s (%s)", primary, s.Origin, dns.RcodeToString[response.Rcode])
+}
+
+// transfer pulls the whole zone from primary with AXFR
+func (s *Secondary) transfer(primary string) (*Zone, error) {
+	query := new(dns.Msg)
+	query.SetAxfr(s.Origin)
+	envelopes, err := new(dns.Transfer).In(query, primary)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", primary, err)
+	}
+
+	zone := NewZone(s.Origin)
+	var transferErr error
+	for envelope := range envelopes {
+		// After an error the rest is drained, so the transfer finishes and closes its connection
+		if transferErr != nil {
+			continue
+		}
+		if envelope.Error != nil {
+			transferErr = fmt.Errorf("%s: %w", primary, envelope.Error)
+			continue
+		}
+		for _, rr := range envelope.RR {
+			// The SOA opens and closes the transfer, keep only the first
+			if _, ok := rr.(*dns.SOA); ok && zone.SOA != nil {
+				continue
+			}
+			if err := zone.Add(rr); err != nil {
+				log.Printf("Ignoring record in transfer of %s: %v", s.Origin, err)
+			}
+		}
+	}
+	if transferErr != nil {
+		return nil, transferErr
+	}
+	if zone.SOA == nil {
+		return nil, fmt.Errorf("%s: transfer of %s contained no SOA", primary, s.Origin)
+	}
+	return zone, nil
+}
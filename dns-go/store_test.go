@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// testStores returns a constructor for every DNSRecordStore implementation, each making an empty
+// store cleaned up with the test. EtcdStore is only tested when DNSGO_TEST_ETCD names endpoints.
+func testStores() map[string]func(t *testing.T) DNSRecordStore {
+	return map[string]func(t *testing.T) DNSRecordStore{
+		"memory": func(t *testing.T) DNSRecordStore {
+			return NewMemoryStore()
+		},
+		"bolt": func(t *testing.T) DNSRecordStore {
+			store, err := NewBoltStore(filepath.Join(t.TempDir(), "records.db"))
+			if err != nil {
+				t.Fatalf("NewBoltStore: %v", err)
+			}
+			t.Cleanup(func() { store.Close() })
+			return store
+		},
+		"etcd": func(t *testing.T) DNSRecordStore {
+			return testEtcdStore(t, testEtcdPrefix(t))
+		},
+	}
+}
+
+// testEtcdPrefix returns a fresh etcd prefix for the test, deleted with it. It skips the test
+// unless DNSGO_TEST_ETCD names etcd endpoints.
+func testEtcdPrefix(t *testing.T) string {
+	t.Helper()
+	endpoints := os.Getenv("DNSGO_TEST_ETCD")
+	if endpoints == "" {
+		t.Skip("DNSGO_TEST_ETCD not set")
+	}
+	prefix := fmt.Sprintf("/dns-go-test/%d/", time.Now().UnixNano())
+	t.Cleanup(func() {
+		client, err := clientv3.New(clientv3.Config{Endpoints: splitList(endpoints), DialTimeout: etcdTimeout})
+		if err != nil {
+			return
+		}
+		defer client.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+		defer cancel()
+		client.Delete(ctx, prefix, clientv3.WithPrefix())
+	})
+	return prefix
+}
+
+// testEtcdStore opens an EtcdStore under prefix at the endpoints in DNSGO_TEST_ETCD, closed with the test
+func testEtcdStore(t *testing.T, prefix string) *EtcdStore {
+	t.Helper()
+	store, err := NewEtcdStore(splitList(os.Getenv("DNSGO_TEST_ETCD")), prefix)
+	if err != nil {
+		t.Fatalf("NewEtcdStore: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// testRecord returns a message holding the record given in master file format
+func testRecord(t *testing.T, record string) *dns.Msg {
+	t.Helper()
+	rr, err := dns.NewRR(record)
+	if err != nil {
+		t.Fatalf("Bad test record %q: %v", record, err)
+	}
+	msg := new(dns.Msg)
+	msg.Answer = []dns.RR{rr}
+	return msg
+}
+
+// setRecord stores msg in store and fails the test if that fails
+func setRecord(t *testing.T, store DNSRecordStore, domain string, qType uint16, msg *dns.Msg) {
+	t.Helper()
+	if err := store.Set(domain, qType, msg); err != nil {
+		t.Fatalf("Set %s %s: %v", domain, dns.TypeToString[qType], err)
+	}
+}
+
+// deleteRecord deletes a record from store and fails the test if that fails
+func deleteRecord(t *testing.T, store DNSRecordStore, domain string, qType uint16) {
+	t.Helper()
+	if err := store.Delete(domain, qType); err != nil {
+		t.Fatalf("Delete %s %s: %v", domain, dns.TypeToString[qType], err)
+	}
+}
+
+// answerOf returns the single answer of msg as text, or "" when there is none
+func answerOf(msg *dns.Msg) string {
+	if msg == nil || len(msg.Answer) != 1 {
+		return ""
+	}
+	return msg.Answer[0].String()
+}
+
+func TestStoreConformance(t *testing.T) {
+	www := "www.home.\t300\tIN\tA\t192.0.2.1"
+	moved := "www.home.\t300\tIN\tA\t192.0.2.2"
+	mail := "mail.home.\t300\tIN\tMX\t10 www.home."
+
+	tests := []struct {
+		name string
+		run  func(t *testing.T, store DNSRecordStore)
+	}{
+		{"get missing", func(t *testing.T, store DNSRecordStore) {
+			if msg, ok := store.Get("www.home.", dns.TypeA); ok {
+				t.Errorf("Got %v from an empty store", msg)
+			}
+		}},
+		{"set and get", func(t *testing.T, store DNSRecordStore) {
+			setRecord(t, store, "www.home.", dns.TypeA, testRecord(t, www))
+			if msg, ok := store.Get("www.home.", dns.TypeA); !ok || answerOf(msg) != www {
+				t.Errorf("Got %v, %t, want %s", msg, ok, www)
+			}
+			if msg, ok := store.Get("www.home.", dns.TypeAAAA); ok {
+				t.Errorf("Got %v for a type never set", msg)
+			}
+		}},
+		{"set replaces", func(t *testing.T, store DNSRecordStore) {
+			setRecord(t, store, "www.home.", dns.TypeA, testRecord(t, www))
+			setRecord(t, store, "www.home.", dns.TypeA, testRecord(t, moved))
+			if msg, _ := store.Get("www.home.", dns.TypeA); answerOf(msg) != moved {
+				t.Errorf("Got %v, want %s", msg, moved)
+			}
+		}},
+		{"delete", func(t *testing.T, store DNSRecordStore) {
+			setRecord(t, store, "www.home.", dns.TypeA, testRecord(t, www))
+			setRecord(t, store, "mail.home.", dns.TypeMX, testRecord(t, mail))
+			deleteRecord(t, store, "www.home.", dns.TypeA)
+			if msg, ok := store.Get("www.home.", dns.TypeA); ok {
+				t.Errorf("Got %v after deleting it", msg)
+			}
+			if _, ok := store.Get("mail.home.", dns.TypeMX); !ok {
+				t.Errorf("Deleting www.home. A removed mail.home. MX too")
+			}
+			// Deleting what is not there is not an error
+			deleteRecord(t, store, "www.home.", dns.TypeA)
+		}},
+		{"case-insensitive keys", func(t *testing.T, store DNSRecordStore) {
+			setRecord(t, store, "WWW.Home.", dns.TypeA, testRecord(t, www))
+			if msg, ok := store.Get("www.HOME.", dns.TypeA); !ok || answerOf(msg) != www {
+				t.Errorf("Got %v, %t, want %s", msg, ok, www)
+			}
+			deleteRecord(t, store, "www.home.", dns.TypeA)
+			if msg, ok := store.Get("WWW.Home.", dns.TypeA); ok {
+				t.Errorf("Got %v after deleting it under another case", msg)
+			}
+		}},
+		{"get all", func(t *testing.T, store DNSRecordStore) {
+			setRecord(t, store, "WWW.home.", dns.TypeA, testRecord(t, www))
+			setRecord(t, store, "mail.home.", dns.TypeMX, testRecord(t, mail))
+			all := store.GetAll()
+			want := map[string]string{key("www.home.", dns.TypeA): www, key("mail.home.", dns.TypeMX): mail}
+			if len(all) != len(want) {
+				t.Fatalf("Got %d records, want %d: %v", len(all), len(want), all)
+			}
+			for k, record := range want {
+				if answerOf(all[k]) != record {
+					t.Errorf("Got %v under %s, want %s", all[k], k, record)
+				}
+			}
+		}},
+		{"copies in and out", func(t *testing.T, store DNSRecordStore) {
+			msg := testRecord(t, www)
+			setRecord(t, store, "www.home.", dns.TypeA, msg)
+			msg.Answer[0].(*dns.A).A[3] = 99
+
+			got, _ := store.Get("www.home.", dns.TypeA)
+			if answerOf(got) != www {
+				t.Fatalf("Changing a message after Set changed the store: got %v", got)
+			}
+			got.Answer[0].(*dns.A).A[3] = 99
+			if again, _ := store.Get("www.home.", dns.TypeA); answerOf(again) != www {
+				t.Errorf("Changing a message from Get changed the store: got %v", again)
+			}
+			all := store.GetAll()
+			all[key("www.home.", dns.TypeA)].Answer[0].(*dns.A).A[3] = 99
+			if again, _ := store.Get("www.home.", dns.TypeA); answerOf(again) != www {
+				t.Errorf("Changing a message from GetAll changed the store: got %v", again)
+			}
+		}},
+	}
+
+	for storeName, newStore := range testStores() {
+		t.Run(storeName, func(t *testing.T) {
+			for _, test := range tests {
+				t.Run(test.name, func(t *testing.T) {
+					test.run(t, newStore(t))
+				})
+			}
+		})
+	}
+}
+
+func TestEtcdStoreWatch(t *testing.T) {
+	prefix := testEtcdPrefix(t)
+	www := "www.home.\t300\tIN\tA\t192.0.2.1"
+
+	// Records stored before a store opens are there from the start
+	first := testEtcdStore(t, prefix)
+	setRecord(t, first, "www.home.", dns.TypeA, testRecord(t, www))
+	second := testEtcdStore(t, prefix)
+	if msg, ok := second.Get("www.home.", dns.TypeA); !ok || answerOf(msg) != www {
+		t.Fatalf("Got %v, %t from a store opened later, want %s", msg, ok, www)
+	}
+
+	changes := make(chan string, 10)
+	for name, store := range map[string]*EtcdStore{"first": first, "second": second} {
+		go store.Watch(func() { changes <- name })
+	}
+	// Let both watches start before changing anything
+	time.Sleep(200 * time.Millisecond)
+
+	// A change made through one store reaches the other, which alone reports it
+	deleteRecord(t, first, "www.home.", dns.TypeA)
+	select {
+	case name := <-changes:
+		if name != "second" {
+			t.Fatalf("The %s store reported its own change", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The second store did not report the change of the first")
+	}
+	if msg, ok := second.Get("www.home.", dns.TypeA); ok {
+		t.Errorf("Got %v after the first store deleted it", msg)
+	}
+	select {
+	case name := <-changes:
+		t.Errorf("The %s store reported a change twice or reported its own", name)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestEtcdStoreFailedWrite(t *testing.T) {
+	store := testEtcdStore(t, testEtcdPrefix(t))
+	store.Close()
+
+	// Writes etcd did not take are reported and leave the records as they were
+	if err := store.Set("www.home.", dns.TypeA, testRecord(t, "www.home. 300 IN A 192.0.2.1")); err == nil {
+		t.Error("Set succeeded with etcd closed")
+	}
+	if _, ok := store.Get("www.home.", dns.TypeA); ok {
+		t.Error("A failed Set changed the records")
+	}
+}
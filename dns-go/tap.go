@@ -0,0 +1,232 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/proto"
+)
+
+// Answer sources recorded in dnstap messages and metrics, telling which part of dns-go answered a query
+const (
+	SourceLocal    = "local"
+	SourceZone     = "zone"
+	SourceCache    = "cache"
+	SourceStale    = "stale"
+	SourceUpstream = "upstream"
+	SourcePolicy   = "policy"
+	SourceTransfer = "transfer"
+	SourceUpdate   = "update"
+	SourceRefused  = "refused"
+	SourceFailed   = "failed"
+)
+
+// Tap writes every query and its response as dnstap messages (protobuf over Frame Streams) to a
+// file or a Unix socket. Messages are dropped rather than delay queries when the reader falls behind.
+type Tap struct {
+	output   dnstap.Output
+	identity []byte
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewTap starts writing dnstap messages to target, a file path or "unix:" followed by the path of
+// a socket a dnstap collector listens on
+func NewTap(target string) (*Tap, error) {
+	var output dnstap.Output
+	if path, ok := strings.CutPrefix(target, "unix:"); ok {
+		sock, err := dnstap.NewFrameStreamSockOutput(&net.UnixAddr{Name: path, Net: "unix"})
+		if err != nil {
+			return nil, err
+		}
+		sock.SetLogger(log.Default())
+		output = sock
+	} else {
+		file, err := dnstap.NewFrameStreamOutputFromFilename(target)
+		if err != nil {
+			return nil, err
+		}
+		output = file
+	}
+	go output.RunOutputLoop()
+
+	identity, _ := os.Hostname()
+	if identity == "" {
+		identity = "dns-go"
+	}
+	return &Tap{output: output, identity: []byte(identity)}, nil
+}
+
+// Close flushes outstanding messages and closes the output
+func (t *Tap) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.closed {
+		t.closed = true
+		t.output.Close()
+	}
+}
+
+// CloseOnExit closes the tap and exits when the process is interrupted or terminated, so
+// messages still buffered for a file are not lost
+func (t *Tap) CloseOnExit() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	t.Close()
+	os.Exit(0)
+}
+
+// Handler wraps next so every query it serves and the response it gives are tapped
+func (t *Tap) Handler(next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		tw := &tapWriter{ResponseWriter: w, start: time.Now()}
+		next.ServeDNS(tw, r)
+		t.send(dnstap.Message_CLIENT_QUERY, w, r, tw.start, time.Time{}, "")
+		if tw.response != nil {
+			t.send(dnstap.Message_CLIENT_RESPONSE, w, tw.response, tw.start, tw.end, tw.source)
+		}
+	})
+}
+
+// send encodes a single dnstap message and queues it for the output
+func (t *Tap) send(kind dnstap.Message_Type, w dns.ResponseWriter, msg *dns.Msg, queried, responded time.Time, source string) {
+	packed, err := msg.Pack()
+	if err != nil {
+		return
+	}
+	message := &dnstap.Message{
+		Type:           &kind,
+		SocketFamily:   dnstap.SocketFamily_INET.Enum(),
+		SocketProtocol: tapProtocol(w).Enum(),
+		QueryTimeSec:   proto.Uint64(uint64(queried.Unix())),
+		QueryTimeNsec:  proto.Uint32(uint32(queried.Nanosecond())),
+	}
+	if ip, port := tapAddr(w.RemoteAddr()); ip != nil {
+		if len(ip) == net.IPv6len {
+			message.SocketFamily = dnstap.SocketFamily_INET6.Enum()
+		}
+		message.QueryAddress, message.QueryPort = ip, proto.Uint32(port)
+	}
+	if ip, port := tapAddr(w.LocalAddr()); ip != nil {
+		message.ResponseAddress, message.ResponsePort = ip, proto.Uint32(port)
+	}
+	if kind == dnstap.Message_CLIENT_QUERY {
+		message.QueryMessage = packed
+	} else {
+		message.ResponseMessage = packed
+		message.ResponseTimeSec = proto.Uint64(uint64(responded.Unix()))
+		message.ResponseTimeNsec = proto.Uint32(uint32(responded.Nanosecond()))
+	}
+
+	frame := &dnstap.Dnstap{
+		Type:     dnstap.Dnstap_MESSAGE.Enum(),
+		Identity: t.identity,
+		Version:  []byte("dns-go"),
+		Message:  message,
+	}
+	if source != "" {
+		// Which part of dns-go answered goes into the free-form extra field
+		frame.Extra = []byte("source=" + source)
+	}
+	data, err := proto.Marshal(frame)
+	if err != nil {
+		log.Printf("Failed to encode dnstap message: %v", err)
+		return
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.output.GetOutputChannel() <- data:
+	default:
+		tapDropped.Inc()
+	}
+}
+
+// tapWriter records the response written through it and when it was written
+type tapWriter struct {
+	dns.ResponseWriter
+	start    time.Time
+	end      time.Time
+	response *dns.Msg
+	source   string
+}
+
+// WriteMsg records and writes msg. Zone transfers write many messages; the last one is tapped.
+func (w *tapWriter) WriteMsg(msg *dns.Msg) error {
+	w.response, w.end = msg, time.Now()
+	return w.ResponseWriter.WriteMsg(msg)
+}
+
+// recordSource implements sourceRecorder
+func (w *tapWriter) recordSource(source string) {
+	w.source = source
+	answeredBy(w.ResponseWriter, source)
+}
+
+// Unwrap returns the wrapped response writer
+func (w *tapWriter) Unwrap() dns.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// sourceRecorder is implemented by response writers that keep track of which part of dns-go
+// answered, for dnstap and metrics
+type sourceRecorder interface {
+	recordSource(source string)
+}
+
+// answeredBy records which part of dns-go answers the query served through w
+func answeredBy(w dns.ResponseWriter, source string) {
+	if recorder, ok := w.(sourceRecorder); ok {
+		recorder.recordSource(source)
+	}
+}
+
+// tapProtocol returns the transport a query was received over
+func tapProtocol(w dns.ResponseWriter) dnstap.SocketProtocol {
+	switch transport(w) {
+	case "doh":
+		return dnstap.SocketProtocol_DOH
+	case "dot":
+		return dnstap.SocketProtocol_DOT
+	case "udp":
+		return dnstap.SocketProtocol_UDP
+	}
+	return dnstap.SocketProtocol_TCP
+}
+
+// tapAddr returns the IP and port of addr
+func tapAddr(addr net.Addr) (net.IP, uint32) {
+	ip := addrIP(addr)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	_, port, _ := net.SplitHostPort(addr.String())
+	p, _ := strconv.ParseUint(port, 10, 16)
+	return ip, uint32(p)
+}
+
+var tapDropped = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "dns_dnstap_dropped_total",
+		Help: "Total number of dnstap messages dropped because the output fell behind",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(tapDropped)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/proto"
+)
+
+// readTapFile decodes every dnstap frame written to path
+func readTapFile(t *testing.T, path string) []*dnstap.Dnstap {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+	reader, err := dnstap.NewReader(f, nil)
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+
+	var frames []*dnstap.Dnstap
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := reader.ReadFrame(buf)
+		if errors.Is(err, io.EOF) {
+			return frames
+		}
+		if err != nil {
+			t.Fatalf("ReadFrame: %v", err)
+		}
+		frame := new(dnstap.Dnstap)
+		if err := proto.Unmarshal(buf[:n], frame); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		frames = append(frames, frame)
+	}
+}
+
+func TestTapQuery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnstap.fstrm")
+	tap, err := NewTap(path)
+	if err != nil {
+		t.Fatalf("NewTap: %v", err)
+	}
+	zones := NewZoneSet()
+	view := &View{Name: defaultViewName, Local: NewLocalZone("home.", NewMemoryStore(), zones)}
+	view.Local.Set("www.home.", dns.TypeA, testRecord(t, "www.home. 300 IN A 192.0.2.1"))
+	handler := tap.Handler(testHandler(view, zones))
+
+	query := new(dns.Msg)
+	query.SetQuestion("www.home.", dns.TypeA)
+	w := writerFrom("192.0.2.53")
+	handler.ServeDNS(w, query)
+	if w.msg == nil || len(w.msg.Answer) != 1 {
+		t.Fatalf("Answer = %v", w.msg)
+	}
+	tap.Close()
+
+	frames := readTapFile(t, path)
+	if len(frames) != 2 {
+		t.Fatalf("Got %d dnstap frames, want a query and a response", len(frames))
+	}
+	queryFrame, responseFrame := frames[0].GetMessage(), frames[1].GetMessage()
+	if queryFrame.GetType() != dnstap.Message_CLIENT_QUERY || responseFrame.GetType() != dnstap.Message_CLIENT_RESPONSE {
+		t.Errorf("Message types = %v, %v", queryFrame.GetType(), responseFrame.GetType())
+	}
+	if queryFrame.GetSocketProtocol() != dnstap.SocketProtocol_UDP || queryFrame.GetSocketFamily() != dnstap.SocketFamily_INET {
+		t.Errorf("Socket = %v %v", queryFrame.GetSocketFamily(), queryFrame.GetSocketProtocol())
+	}
+	if got := string(queryFrame.GetQueryAddress()); got != string([]byte{192, 0, 2, 53}) || queryFrame.GetQueryPort() != 5353 {
+		t.Errorf("Query address = %v port %d", queryFrame.GetQueryAddress(), queryFrame.GetQueryPort())
+	}
+
+	tapped := new(dns.Msg)
+	if err := tapped.Unpack(queryFrame.GetQueryMessage()); err != nil || tapped.Question[0].Name != "www.home." {
+		t.Errorf("Tapped query = %v, %v", tapped, err)
+	}
+	tapped = new(dns.Msg)
+	if err := tapped.Unpack(responseFrame.GetResponseMessage()); err != nil || len(tapped.Answer) != 1 || tapped.Id != query.Id {
+		t.Errorf("Tapped response = %v, %v", tapped, err)
+	}
+	if extra := string(frames[1].GetExtra()); extra != "source="+SourceLocal {
+		t.Errorf("Response extra = %q, want source=%s", extra, SourceLocal)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// TLSBundle holds a CA and a server certificate signed by it, all PEM encoded
+type TLSBundle struct {
+	CACert     []byte
+	CAKey      []byte
+	ServerCert []byte
+	ServerKey  []byte
+}
+
+// GenerateTLSBundle creates a self-signed CA and a server certificate for host, the same way
+// controlplane-go does. host may be a DNS name or an IP address.
+func GenerateTLSBundle(host string) (*TLSBundle, error) {
+	// CA
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	caTemplate := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			CommonName: "dns-go-ca",
+		},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caCertDER, err := x509.CreateCertificate(rand.Reader, &caTemplate, &caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Server cert
+	serverKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	serverTemplate := x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject: pkix.Name{
+			CommonName: host,
+		},
+		NotBefore:   time.Now(),
+		NotAfter:    time.Now().Add(5 * 365 * 24 * time.Hour),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		serverTemplate.IPAddresses = []net.IP{ip}
+	} else {
+		serverTemplate.DNSNames = []string{host}
+	}
+	serverCertDER, err := x509.CreateCertificate(rand.Reader, &serverTemplate, &caTemplate, &serverKey.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TLSBundle{
+		CACert:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCertDER}),
+		CAKey:      pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(caKey)}),
+		ServerCert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: serverCertDER}),
+		ServerKey:  pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(serverKey)}),
+	}, nil
+}
+
+// LoadTLSConfig builds the TLS configuration for the encrypted DNS listeners. With certFile and keyFile
+// set the certificate is loaded from them. Otherwise a bundle for host is generated into dir on first
+// use and reused afterwards, so clients only have to trust dir/ca.crt once.
+func LoadTLSConfig(certFile, keyFile, dir, host string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		certFile, keyFile = filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+		if err := ensureTLSBundle(dir, host); err != nil {
+			return nil, err
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// ensureTLSBundle generates a TLS bundle for host into dir unless a server certificate is already there
+func ensureTLSBundle(dir, host string) error {
+	if _, err := os.Stat(filepath.Join(dir, "server.crt")); err == nil {
+		return nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	bundle, err := GenerateTLSBundle(host)
+	if err != nil {
+		return fmt.Errorf("generating TLS bundle: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	files := []struct {
+		name string
+		data []byte
+		perm os.FileMode
+	}{
+		{"ca.crt", bundle.CACert, 0o644},
+		{"ca.key", bundle.CAKey, 0o600},
+		{"server.crt", bundle.ServerCert, 0o644},
+		{"server.key", bundle.ServerKey, 0o600},
+	}
+	for _, f := range files {
+		if err := os.WriteFile(filepath.Join(dir, f.name), f.data, f.perm); err != nil {
+			return err
+		}
+	}
+	log.Printf("Generated TLS certificate for %s in %s, clients should trust %s", host, dir, filepath.Join(dir, "ca.crt"))
+	return nil
+}
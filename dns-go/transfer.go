@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// transferChunkSize is the number of records sent per message during an outgoing zone transfer
+const transferChunkSize = 500
+
+// Transfers serves AXFR and IXFR for the zones dns-go is authoritative for, sends NOTIFY
+// to secondaries when a zone changes and accepts NOTIFY for the zones it is a secondary of
+type Transfers struct {
+	local       *LocalZone
+	zones       *ZoneSet
+	allow       *ACL
+	notify      []string
+	secondaries map[string]*Secondary
+}
+
+// NewTransfers initializes and returns a new Transfers. Only clients allowed by allow may transfer
+// zones, and every address in notify is sent a NOTIFY whenever one of our zones changes.
+func NewTransfers(local *LocalZone, zones *ZoneSet, allow *ACL, notify []string) *Transfers {
+	return &Transfers{
+		local:       local,
+		zones:       zones,
+		allow:       allow,
+		notify:      notify,
+		secondaries: make(map[string]*Secondary),
+	}
+}
+
+// AddSecondary makes dns-go a secondary for origin, pulling it from the given primaries
+func (t *Transfers) AddSecondary(origin string, primaries []string) *Secondary {
+	secondary := NewSecondary(origin, primaries, t.zones)
+	t.secondaries[secondary.Origin] = secondary
+	return secondary
+}
+
+// RunSecondaries starts keeping every secondary zone in sync with its primaries
+func (t *Transfers) RunSecondaries() {
+	for _, secondary := range t.secondaries {
+		go secondary.Run()
+	}
+}
+
+// zone returns the zone with the given origin that we can hand out, or nil
+func (t *Transfers) zone(origin string) *Zone {
+	origin = dns.CanonicalName(origin)
+	if origin == t.local.Domain {
+		return t.local.Snapshot()
+	}
+	zone, _ := t.zones.Get(origin)
+	return zone
+}
+
+// ServeTransfer answers an AXFR or IXFR request. IXFR is answered with the full zone
+// (RFC 1995 section 4 allows this when no history is kept), or with just the SOA when
+// the client is already up to date or asked over UDP.
+func (t *Transfers) ServeTransfer(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	zone := t.zone(q.Name)
+	switch {
+	case zone == nil:
+		log.Printf("Refusing transfer of %s to %s: not authoritative", q.Name, w.RemoteAddr())
+		replyRcode(w, r, dns.RcodeNotAuth)
+		return
+	case !t.allow.Allows(w, r):
+		log.Printf("Refusing transfer of %s to %s: not in allow-list", q.Name, w.RemoteAddr())
+		replyRcode(w, r, dns.RcodeRefused)
+		return
+	}
+
+	soa := dns.Copy(zone.SOA)
+	_, isTCP := w.RemoteAddr().(*net.TCPAddr)
+	if q.Qtype == dns.TypeIXFR {
+		upToDate := len(r.Ns) > 0 && r.Ns[0].Header().Rrtype == dns.TypeSOA &&
+			!serialNewer(zone.SOA.Serial, r.Ns[0].(*dns.SOA).Serial)
+		if upToDate || !isTCP {
+			response := new(dns.Msg)
+			response.SetReply(r)
+			response.Authoritative = true
+			response.Answer = []dns.RR{soa}
+			w.WriteMsg(response)
+			return
+		}
+	} else if !isTCP {
+		replyRcode(w, r, dns.RcodeRefused)
+		return
+	}
+
+	records := []dns.RR{soa}
+	for _, rr := range zone.Records() {
+		if rr.Header().Rrtype != dns.TypeSOA {
+			records = append(records, rr)
+		}
+	}
+	records = append(records, soa)
+
+	ch := make(chan *dns.Envelope)
+	go func() {
+		defer close(ch)
+		for start := 0; start < len(records); start += transferChunkSize {
+			end := min(start+transferChunkSize, len(records))
+			ch <- &dns.Envelope{RR: records[start:end]}
+		}
+	}()
+	if err := new(dns.Transfer).Out(w, r, ch); err != nil {
+		log.Printf("Transfer of %s to %s failed: %v", zone.Origin, w.RemoteAddr(), err)
+		for range ch {
+		}
+		return
+	}
+	log.Printf("Transferred %s (serial %d, %d records) to %s", zone.Origin, zone.SOA.Serial, len(records)-1, w.RemoteAddr())
+}
+
+// ServeNotify acknowledges a NOTIFY and, if it comes from a primary of one of our secondary zones,
+// triggers an immediate refresh of that zone (RFC 1996)
+func (t *Transfers) ServeNotify(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	secondary, ok := t.secondaries[dns.CanonicalName(q.Name)]
+	if !ok {
+		log.Printf("Ignoring NOTIFY for %s from %s: not a secondary zone", q.Name, w.RemoteAddr())
+		replyRcode(w, r, dns.RcodeNotAuth)
+		return
+	}
+	if !secondary.IsPrimary(w.RemoteAddr()) {
+		log.Printf("Refusing NOTIFY for %s from %s: not a primary", q.Name, w.RemoteAddr())
+		replyRcode(w, r, dns.RcodeRefused)
+		return
+	}
+
+	response := new(dns.Msg)
+	response.SetReply(r)
+	response.Authoritative = true
+	w.WriteMsg(response)
+
+	log.Printf("Received NOTIFY for %s from %s", q.Name, w.RemoteAddr())
+	secondary.Refresh()
+}
+
+// Notify sends a NOTIFY for origin to every configured secondary
+func (t *Transfers) Notify(origin string) {
+	zone := t.zone(origin)
+	if zone == nil {
+		return
+	}
+	for _, addr := range t.notify {
+		go func(addr string) {
+			msg := new(dns.Msg)
+			msg.SetNotify(zone.Origin)
+			msg.Answer = []dns.RR{dns.Copy(zone.SOA)}
+			client := &dns.Client{Timeout: 2 * time.Second}
+			if _, _, err := client.Exchange(msg, addr); err != nil {
+				log.Printf("Failed to send NOTIFY for %s to %s: %v", zone.Origin, addr, err)
+			}
+		}(addr)
+	}
+}
+
+// replyRcode answers r with an empty response carrying rcode
+func replyRcode(w dns.ResponseWriter, r *dns.Msg, rcode int) {
+	response := new(dns.Msg)
+	response.SetRcode(r, rcode)
+	w.WriteMsg(response)
+}
+
+// addrIP returns the IP address of a UDP or TCP client address
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// parseNetworks parses a list of CIDRs or plain IP addresses
+func parseNetworks(items []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, item := range items {
+		if ip := net.ParseIP(item); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", item)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
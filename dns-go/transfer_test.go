@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// transferTestZone returns example.test. with the given SOA serial; its refresh, retry and expire
+// timers are 100, 10 and 1000 seconds
+func transferTestZone(t *testing.T, serial uint32) *Zone {
+	t.Helper()
+	return parseTestZone(t, fmt.Sprintf(`
+example.test. 3600 IN SOA ns.example.test. hostmaster.example.test. %d 100 10 1000 60
+example.test. 3600 IN NS ns.example.test.
+ns.example.test. 3600 IN A 192.0.2.1
+www.example.test. 3600 IN A 192.0.2.2
+mail.example.test. 3600 IN MX 10 www.example.test.
+`, serial))
+}
+
+// testTransfers returns Transfers serving zones, next to an empty local domain home.
+func testTransfers(zones *ZoneSet, allow *ACL) *Transfers {
+	return NewTransfers(NewLocalZone("home.", NewMemoryStore(), zones), zones, allow, nil)
+}
+
+// startPrimary serves the zones in zones over TCP on loopback, with transfers open to allow,
+// and returns its address and a function that stops it
+func startPrimary(t *testing.T, zones *ZoneSet, allow *ACL) (string, func()) {
+	t.Helper()
+	transfers := testTransfers(zones, allow)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Cannot listen on loopback: %v", err)
+	}
+	server := &dns.Server{Listener: listener, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		q := r.Question[0]
+		if q.Qtype == dns.TypeAXFR || q.Qtype == dns.TypeIXFR {
+			transfers.ServeTransfer(w, r)
+			return
+		}
+		zone := zones.Find(q.Name)
+		if zone == nil {
+			replyRcode(w, r, dns.RcodeRefused)
+			return
+		}
+		msg := zone.Lookup(q.Name, q.Qtype)
+		msg.SetReply(r)
+		w.WriteMsg(msg)
+	})}
+	go server.ActivateAndServe()
+	stop := func() { server.Shutdown() }
+	t.Cleanup(stop)
+	return listener.Addr().String(), stop
+}
+
+// transferIn runs an AXFR or IXFR of example.test. from addr and returns the records received
+func transferIn(t *testing.T, addr string, query *dns.Msg) ([]dns.RR, error) {
+	t.Helper()
+	envelopes, err := new(dns.Transfer).In(query, addr)
+	if err != nil {
+		return nil, err
+	}
+	var rrs []dns.RR
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			err = envelope.Error
+			continue
+		}
+		rrs = append(rrs, envelope.RR...)
+	}
+	return rrs, err
+}
+
+func TestTransferAXFR(t *testing.T) {
+	zones := NewZoneSet()
+	zones.Put(transferTestZone(t, 7))
+	addr, _ := startPrimary(t, zones, &ACL{Any: true})
+
+	query := new(dns.Msg)
+	query.SetAxfr("example.test.")
+	rrs, err := transferIn(t, addr, query)
+	if err != nil {
+		t.Fatalf("AXFR: %v", err)
+	}
+	// The SOA opens and closes the transfer, with every other record in between
+	if len(rrs) != 6 || rrs[0].Header().Rrtype != dns.TypeSOA || rrs[5].Header().Rrtype != dns.TypeSOA {
+		t.Fatalf("Got %v, want the 4 records of the zone between two SOAs", rrs)
+	}
+
+	// Zones we do not serve are not transferred, and AXFR needs TCP
+	query.SetAxfr("other.test.")
+	if _, err := transferIn(t, addr, query); err == nil {
+		t.Errorf("Transferred a zone that is not served")
+	}
+	w := writerFrom("127.0.0.1")
+	query.SetAxfr("example.test.")
+	testTransfers(zones, &ACL{Any: true}).ServeTransfer(w, query)
+	if w.msg == nil || w.msg.Rcode != dns.RcodeRefused {
+		t.Errorf("Got %v for AXFR over UDP, want REFUSED", w.msg)
+	}
+}
+
+func TestTransferRefused(t *testing.T) {
+	zones := NewZoneSet()
+	zones.Put(transferTestZone(t, 7))
+	addr, _ := startPrimary(t, zones, &ACL{})
+
+	query := new(dns.Msg)
+	query.SetAxfr("example.test.")
+	if rrs, err := transferIn(t, addr, query); err == nil {
+		t.Errorf("Got %v for a client not allowed to transfer, want an error", rrs)
+	}
+}
+
+func TestTransferIXFR(t *testing.T) {
+	zones := NewZoneSet()
+	zones.Put(transferTestZone(t, 7))
+	addr, _ := startPrimary(t, zones, &ACL{Any: true})
+
+	ixfr := func(serial uint32) *dns.Msg {
+		query := new(dns.Msg)
+		query.SetIxfr("example.test.", serial, "ns.example.test.", "hostmaster.example.test.")
+		return query
+	}
+
+	// A client that is up to date gets just the SOA
+	rrs, err := transferIn(t, addr, ixfr(7))
+	if err != nil {
+		t.Fatalf("IXFR: %v", err)
+	}
+	if len(rrs) != 1 || rrs[0].(*dns.SOA).Serial != 7 {
+		t.Errorf("Got %v for an up to date client, want the SOA only", rrs)
+	}
+
+	// Without history an outdated client gets the full zone
+	rrs, err = transferIn(t, addr, ixfr(6))
+	if err != nil {
+		t.Fatalf("IXFR: %v", err)
+	}
+	if len(rrs) != 6 {
+		t.Errorf("Got %v for an outdated client, want the whole zone", rrs)
+	}
+
+	// Over UDP the client is told the serial and left to retry over TCP
+	w := writerFrom("127.0.0.1")
+	testTransfers(zones, &ACL{Any: true}).ServeTransfer(w, ixfr(6))
+	if w.msg == nil || len(w.msg.Answer) != 1 || w.msg.Answer[0].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("Got %v for IXFR over UDP, want the SOA only", w.msg)
+	}
+}
+
+func TestSecondaryRefreshAndExpiry(t *testing.T) {
+	primaryZones := NewZoneSet()
+	primaryZones.Put(transferTestZone(t, 7))
+	addr, stop := startPrimary(t, primaryZones, &ACL{Any: true})
+
+	zones := NewZoneSet()
+	secondary := NewSecondary("example.test.", []string{addr}, zones)
+	now := time.Now()
+	secondary.now = func() time.Time { return now }
+	serial := func() uint32 {
+		zone, ok := zones.Get("example.test.")
+		if !ok {
+			return 0
+		}
+		return zone.SOA.Serial
+	}
+
+	// The first poll loads the zone and waits for the refresh timer
+	if wait := secondary.poll(); wait != 100*time.Second || serial() != 7 {
+		t.Fatalf("Got serial %d and a wait of %v, want serial 7 and the refresh time", serial(), wait)
+	}
+
+	// A new serial on the primary is picked up, an old one is not
+	primaryZones.Put(transferTestZone(t, 8))
+	secondary.poll()
+	if serial() != 8 {
+		t.Errorf("Got serial %d after the primary moved to 8", serial())
+	}
+	primaryZones.Put(transferTestZone(t, 5))
+	secondary.poll()
+	if serial() != 8 {
+		t.Errorf("Got serial %d after the primary went back to 5, want 8 kept", serial())
+	}
+
+	// While the primary is down the zone is served and retried until it expires
+	stop()
+	now = now.Add(500 * time.Second)
+	if wait := secondary.poll(); wait != 10*time.Second || serial() != 8 {
+		t.Errorf("Got serial %d and a wait of %v with the primary down, want 8 kept and the retry time", serial(), wait)
+	}
+	now = now.Add(501 * time.Second)
+	if wait := secondary.poll(); wait != secondaryInitialRetry || serial() != 0 {
+		t.Errorf("Got serial %d and a wait of %v past the expire time, want the zone dropped", serial(), wait)
+	}
+}
+
+func TestSecondaryTransferError(t *testing.T) {
+	primaryZones := NewZoneSet()
+	primaryZones.Put(transferTestZone(t, 7))
+	addr, _ := startPrimary(t, primaryZones, &ACL{})
+
+	secondary := NewSecondary("example.test.", []string{addr}, NewZoneSet())
+	if zone, err := secondary.transfer(addr); err == nil {
+		t.Errorf("Got %v from a primary refusing the transfer, want an error", zone)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	transfers := testTransfers(NewZoneSet(), &ACL{})
+	secondary := transfers.AddSecondary("example.test.", []string{"127.0.0.1"})
+
+	notify := func(zone, from string) int {
+		t.Helper()
+		r := new(dns.Msg)
+		r.SetNotify(zone)
+		w := writerFrom(from)
+		transfers.ServeNotify(w, r)
+		if w.msg == nil {
+			t.Fatalf("No response to NOTIFY for %s from %s", zone, from)
+		}
+		return w.msg.Rcode
+	}
+	refreshed := func() bool {
+		select {
+		case <-secondary.refresh:
+			return true
+		default:
+			return false
+		}
+	}
+
+	if rcode := notify("example.test.", "192.0.2.1"); rcode != dns.RcodeRefused || refreshed() {
+		t.Errorf("Got %s for NOTIFY from a stranger, want REFUSED and no refresh", dns.RcodeToString[rcode])
+	}
+	if rcode := notify("other.test.", "127.0.0.1"); rcode != dns.RcodeNotAuth {
+		t.Errorf("Got %s for NOTIFY of a zone we are no secondary for, want NOTAUTH", dns.RcodeToString[rcode])
+	}
+	if rcode := notify("example.test.", "127.0.0.1"); rcode != dns.RcodeSuccess || !refreshed() {
+		t.Errorf("Got %s for NOTIFY from the primary, want NOERROR and a refresh", dns.RcodeToString[rcode])
+	}
+}
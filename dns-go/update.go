@@ -0,0 +1,485 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TSIGKey is a shared secret used to authenticate messages with TSIG (RFC 8945)
+type TSIGKey struct {
+	Name      string
+	Algorithm string
+	Secret    string // base64 encoded
+}
+
+// TSIGKeys maps canonical key names to keys. It implements flag.Value so keys can be given as
+// repeated -tsig-key flags in dig's "[algorithm:]name:secret" form, defaulting to hmac-sha256.
+type TSIGKeys map[string]TSIGKey
+
+// String returns the key names, leaving out the secrets
+func (k TSIGKeys) String() string {
+	var names []string
+	for name := range k {
+		names = append(names, name)
+	}
+	return strings.Join(names, ",")
+}
+
+// Set parses a single "[algorithm:]name:secret" key
+func (k TSIGKeys) Set(value string) error {
+	parts := strings.Split(value, ":")
+	key := TSIGKey{Algorithm: dns.HmacSHA256}
+	switch len(parts) {
+	case 2:
+		key.Name, key.Secret = parts[0], parts[1]
+	case 3:
+		key.Algorithm, key.Name, key.Secret = dns.Fqdn(strings.ToLower(parts[0])), parts[1], parts[2]
+	default:
+		return fmt.Errorf("TSIG key must have the form [algorithm:]name:secret")
+	}
+	switch key.Algorithm {
+	case dns.HmacSHA1, dns.HmacSHA224, dns.HmacSHA256, dns.HmacSHA384, dns.HmacSHA512:
+	default:
+		return fmt.Errorf("unsupported TSIG algorithm %q", key.Algorithm)
+	}
+	if key.Name == "" || key.Secret == "" {
+		return fmt.Errorf("TSIG key must have a name and a secret")
+	}
+	key.Name = dns.CanonicalName(key.Name)
+	k[key.Name] = key
+	return nil
+}
+
+// Secrets returns the keys in the form dns.Server expects for TsigSecret
+func (k TSIGKeys) Secrets() map[string]string {
+	secrets := make(map[string]string, len(k))
+	for name, key := range k {
+		secrets[name] = key.Secret
+	}
+	return secrets
+}
+
+// Verify checks that r carries a valid TSIG signature made with one of the keys. The signature
+// itself is verified by the server, which reports the outcome through w.TsigStatus.
+func (k TSIGKeys) Verify(w dns.ResponseWriter, r *dns.Msg) (TSIGKey, error) {
+	tsig := r.IsTsig()
+	if tsig == nil {
+		return TSIGKey{}, fmt.Errorf("message is not signed")
+	}
+	key, ok := k[dns.CanonicalName(tsig.Hdr.Name)]
+	if !ok {
+		return TSIGKey{}, fmt.Errorf("unknown TSIG key %s", tsig.Hdr.Name)
+	}
+	if !strings.EqualFold(tsig.Algorithm, key.Algorithm) {
+		return TSIGKey{}, fmt.Errorf("TSIG key %s used with algorithm %s instead of %s", key.Name, tsig.Algorithm, key.Algorithm)
+	}
+	if err := w.TsigStatus(); err != nil {
+		return TSIGKey{}, fmt.Errorf("TSIG verification failed for key %s: %w", key.Name, err)
+	}
+	return key, nil
+}
+
+// Updater applies RFC 2136 dynamic updates signed with a known TSIG key to the local store.
+// Updates are accepted for the local domain and for reverse zones, so hosts can register
+// their own A, AAAA and PTR records.
+type Updater struct {
+	local *LocalZone
+	keys  TSIGKeys
+	mu    sync.Mutex // serializes updates so prerequisites and changes apply atomically
+}
+
+// NewUpdater initializes and returns a new Updater that writes into local
+func NewUpdater(local *LocalZone, keys TSIGKeys) *Updater {
+	return &Updater{local: local, keys: keys}
+}
+
+// ServeUpdate authenticates, checks and applies an UPDATE message, replying with the resulting rcode
+func (u *Updater) ServeUpdate(w dns.ResponseWriter, r *dns.Msg) {
+	response := new(dns.Msg)
+	response.SetReply(r)
+
+	key, err := u.keys.Verify(w, r)
+	if err != nil {
+		log.Printf("Refusing update from %s: %v", w.RemoteAddr(), err)
+		response.Rcode = dns.RcodeRefused
+		if r.IsTsig() != nil {
+			response.Rcode = dns.RcodeNotAuth
+		}
+		w.WriteMsg(response)
+		return
+	}
+
+	response.Rcode = u.apply(r)
+	log.Printf("Update of %s with key %s from %s: %s", r.Question[0].Name, key.Name, w.RemoteAddr(), dns.RcodeToString[response.Rcode])
+	response.SetTsig(key.Name, key.Algorithm, 300, time.Now().Unix())
+	w.WriteMsg(response)
+}
+
+// updatableZone reports whether dynamic updates are accepted for zone
+func (u *Updater) updatableZone(zone string) bool {
+	return dns.CanonicalName(zone) == u.local.Domain || isReverseName(zone)
+}
+
+// apply checks the prerequisites of r and performs its updates, following RFC 2136 section 3
+func (u *Updater) apply(r *dns.Msg) int {
+	zone := r.Question[0]
+	if zone.Qtype != dns.TypeSOA || zone.Qclass != dns.ClassINET {
+		return dns.RcodeFormatError
+	}
+	if !u.updatableZone(zone.Name) {
+		return dns.RcodeNotAuth
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	batch := u.newBatch()
+	if rcode := u.checkPrerequisites(batch, zone.Name, r.Answer); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+	if rcode := u.prescan(zone.Name, r.Ns); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+	// The changes are staged and written together, so the update applies entirely or not at all
+	for _, rr := range r.Ns {
+		batch.update(zone.Name, rr)
+	}
+	if err := batch.commit(); err != nil {
+		log.Printf("Failed to apply update of %s: %v", zone.Name, err)
+		return dns.RcodeServerFailure
+	}
+	return dns.RcodeSuccess
+}
+
+// checkPrerequisites evaluates the prerequisite section (RFC 2136 section 3.2)
+func (u *Updater) checkPrerequisites(batch *updateBatch, zone string, prereqs []dns.RR) int {
+	// Value-dependent prerequisites are grouped per RRset and compared as a whole
+	expected := make(map[string][]dns.RR)
+
+	for _, rr := range prereqs {
+		hdr := rr.Header()
+		if hdr.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+		if !dns.IsSubDomain(zone, hdr.Name) {
+			return dns.RcodeNotZone
+		}
+		switch hdr.Class {
+		case dns.ClassANY:
+			if hdr.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if hdr.Rrtype == dns.TypeANY {
+				if !batch.nameInUse(hdr.Name) {
+					return dns.RcodeNameError
+				}
+			} else if len(batch.rrset(hdr.Name, hdr.Rrtype)) == 0 {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if hdr.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if hdr.Rrtype == dns.TypeANY {
+				if batch.nameInUse(hdr.Name) {
+					return dns.RcodeYXDomain
+				}
+			} else if len(batch.rrset(hdr.Name, hdr.Rrtype)) > 0 {
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			k := key(hdr.Name, hdr.Rrtype)
+			expected[k] = append(expected[k], rr)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	for _, rrs := range expected {
+		hdr := rrs[0].Header()
+		if !sameRRset(batch.rrset(hdr.Name, hdr.Rrtype), rrs) {
+			return dns.RcodeNXRrset
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// prescan validates the update section before anything is changed (RFC 2136 section 3.4.1)
+func (u *Updater) prescan(zone string, updates []dns.RR) int {
+	for _, rr := range updates {
+		hdr := rr.Header()
+		if !dns.IsSubDomain(zone, hdr.Name) {
+			return dns.RcodeNotZone
+		}
+		switch hdr.Class {
+		case dns.ClassINET:
+			if isMetaType(hdr.Rrtype) || hdr.Rrtype == dns.TypeANY {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassANY:
+			if hdr.Ttl != 0 || hdr.Rdlength != 0 || isMetaType(hdr.Rrtype) {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassNONE:
+			if hdr.Ttl != 0 || hdr.Rrtype == dns.TypeANY || isMetaType(hdr.Rrtype) {
+				return dns.RcodeFormatError
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// updateBatch stages the changes of one update over the local store. Reads see the staged
+// changes, and nothing is written until commit.
+type updateBatch struct {
+	local  *LocalZone
+	staged map[string]*stagedRRset
+	order  []*stagedRRset
+}
+
+// stagedRRset is the new content of one RRset, empty when it is to be deleted
+type stagedRRset struct {
+	name   string
+	rrType uint16
+	rrs    []dns.RR
+}
+
+// newBatch starts staging an update of the local store
+func (u *Updater) newBatch() *updateBatch {
+	return &updateBatch{local: u.local, staged: make(map[string]*stagedRRset)}
+}
+
+// update stages a single record from the update section (RFC 2136 section 3.4.2).
+// The zone's own SOA and NS records are managed by dns-go and are left untouched, and
+// a CNAME, which could not coexist with them, is never added at the apex.
+func (b *updateBatch) update(zone string, rr dns.RR) {
+	hdr := rr.Header()
+	name := dns.CanonicalName(hdr.Name)
+	if name == dns.CanonicalName(zone) && (hdr.Rrtype == dns.TypeSOA || hdr.Rrtype == dns.TypeNS || hdr.Rrtype == dns.TypeCNAME) {
+		return
+	}
+
+	switch hdr.Class {
+	case dns.ClassINET:
+		// Add to an RRset. A CNAME cannot coexist with other data, so whichever
+		// arrives second is ignored, and a new CNAME replaces the old one.
+		existing := b.rrset(name, hdr.Rrtype)
+		types := b.storedTypes(name)
+		if hdr.Rrtype == dns.TypeCNAME {
+			if len(types) > 0 && len(existing) == 0 {
+				return
+			}
+			existing = nil
+		} else if slices.Contains(types, dns.TypeCNAME) {
+			return
+		}
+		for _, rr2 := range existing {
+			if dns.IsDuplicate(rr, rr2) {
+				return
+			}
+		}
+		record := dns.Copy(rr)
+		record.Header().Name = name
+		b.set(name, hdr.Rrtype, append(existing, record))
+	case dns.ClassANY:
+		if hdr.Rrtype == dns.TypeANY {
+			for _, rrType := range b.storedTypes(name) {
+				b.set(name, rrType, nil)
+			}
+			return
+		}
+		b.set(name, hdr.Rrtype, nil)
+	case dns.ClassNONE:
+		// Delete an RR from an RRset, comparing as if it were in class IN
+		target := dns.Copy(rr)
+		target.Header().Class = dns.ClassINET
+		var kept []dns.RR
+		for _, rr2 := range b.rrset(name, hdr.Rrtype) {
+			if !dns.IsDuplicate(target, rr2) {
+				kept = append(kept, rr2)
+			}
+		}
+		b.set(name, hdr.Rrtype, kept)
+	}
+}
+
+// set stages the records of the given type at name, deleting the RRset when rrs is empty
+func (b *updateBatch) set(name string, rrType uint16, rrs []dns.RR) {
+	k := key(name, rrType)
+	if staged, ok := b.staged[k]; ok {
+		staged.rrs = rrs
+		return
+	}
+	staged := &stagedRRset{name: name, rrType: rrType, rrs: rrs}
+	b.staged[k] = staged
+	b.order = append(b.order, staged)
+}
+
+// rrset returns the records of the given type at name, as staged or else as stored
+func (b *updateBatch) rrset(name string, rrType uint16) []dns.RR {
+	if staged, ok := b.staged[key(name, rrType)]; ok {
+		return slices.Clone(staged.rrs)
+	}
+	msg, ok := b.local.Get(name, rrType)
+	if !ok {
+		return nil
+	}
+	rrs := make([]dns.RR, 0, len(msg.Answer))
+	for _, rr := range msg.Answer {
+		rr = dns.Copy(rr)
+		if rr.Header().Class == 0 {
+			rr.Header().Class = dns.ClassINET
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+// storedTypes returns the record types at name. The store is keyed by name and type,
+// so every storable type is looked up rather than scanning the whole store.
+func (b *updateBatch) storedTypes(name string) []uint16 {
+	var types []uint16
+	for _, rrType := range storableTypes {
+		if len(b.rrset(name, rrType)) > 0 {
+			types = append(types, rrType)
+		}
+	}
+	return types
+}
+
+// nameInUse reports whether any record is stored at name
+func (b *updateBatch) nameInUse(name string) bool {
+	return len(b.storedTypes(dns.CanonicalName(name))) > 0
+}
+
+// commit writes the staged RRsets to the local store. Should a write fail, the RRsets written
+// before it are restored so the store is left as it was before the update.
+func (b *updateBatch) commit() error {
+	var written []*stagedRRset
+	previous := make(map[*stagedRRset]*dns.Msg)
+	for _, staged := range b.order {
+		if msg, ok := b.local.Get(staged.name, staged.rrType); ok {
+			previous[staged] = msg.Copy()
+		}
+		var err error
+		if len(staged.rrs) == 0 {
+			err = b.local.Delete(staged.name, staged.rrType)
+		} else {
+			msg := new(dns.Msg)
+			msg.Answer = staged.rrs
+			err = b.local.Set(staged.name, staged.rrType, msg)
+		}
+		if err == nil {
+			written = append(written, staged)
+			continue
+		}
+
+		for i := len(written) - 1; i >= 0; i-- {
+			restore := written[i]
+			var rollbackErr error
+			if msg, ok := previous[restore]; ok {
+				rollbackErr = b.local.Set(restore.name, restore.rrType, msg)
+			} else {
+				rollbackErr = b.local.Delete(restore.name, restore.rrType)
+			}
+			if rollbackErr != nil {
+				log.Printf("Failed to restore %s %s after failed update: %v", restore.name, dns.TypeToString[restore.rrType], rollbackErr)
+			}
+		}
+		return fmt.Errorf("%s %s: %w", staged.name, dns.TypeToString[staged.rrType], err)
+	}
+	return nil
+}
+
+// rrset returns the records of the given type stored at name
+func (u *Updater) rrset(name string, rrType uint16) []dns.RR {
+	return u.newBatch().rrset(name, rrType)
+}
+
+// setRRset replaces the records of the given type at name, deleting the RRset when rrs is empty
+func (u *Updater) setRRset(name string, rrType uint16, rrs []dns.RR) error {
+	batch := u.newBatch()
+	batch.set(name, rrType, rrs)
+	return batch.commit()
+}
+
+// storedTypes returns the record types stored at name
+func (u *Updater) storedTypes(name string) []uint16 {
+	return u.newBatch().storedTypes(name)
+}
+
+// storableTypes are the record types that can be stored, in numeric order
+var storableTypes = func() []uint16 {
+	var types []uint16
+	for rrType := range dns.TypeToString {
+		if !isMetaType(rrType) && rrType != dns.TypeANY && rrType != dns.TypeNone && rrType != dns.TypeReserved {
+			types = append(types, rrType)
+		}
+	}
+	slices.Sort(types)
+	return types
+}()
+
+// isMetaType reports whether rrType is a query or transport type that cannot be stored
+func isMetaType(rrType uint16) bool {
+	switch rrType {
+	case dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB, dns.TypeOPT, dns.TypeTSIG, dns.TypeTKEY:
+		return true
+	}
+	return false
+}
+
+// sameRRset reports whether two RRsets hold the same records, ignoring order and TTLs
+func sameRRset(a, b []dns.RR) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, rr := range a {
+		found := false
+		for _, rr2 := range b {
+			if dns.IsDuplicate(rr, rr2) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// acceptMsg extends dns.DefaultMsgAcceptFunc to let dynamic updates through, which
+// carry any number of records in their prerequisite and update sections, and queries
+// with up to maxQuestions questions, which DNSHandler answers one by one
+func acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	const qrBit = 1 << 15
+	opcode := int(dh.Bits>>11) & 0xF
+	if dh.Bits&qrBit != 0 {
+		return dns.DefaultMsgAcceptFunc(dh)
+	}
+	switch opcode {
+	case dns.OpcodeUpdate:
+		if dh.Qdcount != 1 {
+			return dns.MsgReject
+		}
+		return dns.MsgAccept
+	case dns.OpcodeQuery:
+		if dh.Qdcount > maxQuestions {
+			return dns.MsgReject
+		}
+		if dh.Qdcount > 1 {
+			// Check the other sections as for a single question
+			dh.Qdcount = 1
+		}
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
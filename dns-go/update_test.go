@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testUpdateKey is the TSIG key updates in tests are signed with
+var testUpdateKey = TSIGKey{Name: "update.", Algorithm: dns.HmacSHA256, Secret: "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0"}
+
+// failingStore is a MemoryStore that fails to write the names in failNames
+type failingStore struct {
+	*MemoryStore
+	failNames map[string]bool
+}
+
+func (s *failingStore) Set(domain string, qType uint16, msg *dns.Msg) error {
+	if s.failNames[dns.CanonicalName(domain)] {
+		return errors.New("store unavailable")
+	}
+	return s.MemoryStore.Set(domain, qType, msg)
+}
+
+// testUpdater returns an Updater for home. over store holding records in master file format
+func testUpdater(t *testing.T, store DNSRecordStore, records ...string) *Updater {
+	t.Helper()
+	local := NewLocalZone("home.", store, NewZoneSet())
+	for _, record := range records {
+		msg := testRecord(t, record)
+		rr := msg.Answer[0].Header()
+		setRecord(t, local, rr.Name, rr.Rrtype, msg)
+	}
+	return NewUpdater(local, TSIGKeys{testUpdateKey.Name: testUpdateKey})
+}
+
+// mustRR parses a record in master file format
+func mustRR(t *testing.T, record string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(record)
+	if err != nil {
+		t.Fatalf("Bad test record %q: %v", record, err)
+	}
+	return rr
+}
+
+func TestUpdatePrerequisites(t *testing.T) {
+	www := "www.home. 300 IN A 192.0.2.1"
+	tests := []struct {
+		name    string
+		prereqs func(t *testing.T, m *dns.Msg)
+		rcode   int
+	}{
+		{"name in use", func(t *testing.T, m *dns.Msg) { m.NameUsed([]dns.RR{mustRR(t, "www.home. 0 IN A")}) }, dns.RcodeSuccess},
+		{"name not in use", func(t *testing.T, m *dns.Msg) { m.NameUsed([]dns.RR{mustRR(t, "nope.home. 0 IN A")}) }, dns.RcodeNameError},
+		{"name unused", func(t *testing.T, m *dns.Msg) { m.NameNotUsed([]dns.RR{mustRR(t, "nope.home. 0 IN A")}) }, dns.RcodeSuccess},
+		{"name not unused", func(t *testing.T, m *dns.Msg) { m.NameNotUsed([]dns.RR{mustRR(t, "www.home. 0 IN A")}) }, dns.RcodeYXDomain},
+		{"RRset exists", func(t *testing.T, m *dns.Msg) { m.RRsetUsed([]dns.RR{mustRR(t, "www.home. 0 IN A")}) }, dns.RcodeSuccess},
+		{"RRset missing", func(t *testing.T, m *dns.Msg) { m.RRsetUsed([]dns.RR{mustRR(t, "www.home. 0 IN AAAA")}) }, dns.RcodeNXRrset},
+		{"RRset absent", func(t *testing.T, m *dns.Msg) { m.RRsetNotUsed([]dns.RR{mustRR(t, "www.home. 0 IN AAAA")}) }, dns.RcodeSuccess},
+		{"RRset present", func(t *testing.T, m *dns.Msg) { m.RRsetNotUsed([]dns.RR{mustRR(t, "www.home. 0 IN A")}) }, dns.RcodeYXRrset},
+		{"RRset has value", func(t *testing.T, m *dns.Msg) { m.Used([]dns.RR{mustRR(t, "www.home. 0 IN A 192.0.2.1")}) }, dns.RcodeSuccess},
+		{"RRset has other value", func(t *testing.T, m *dns.Msg) { m.Used([]dns.RR{mustRR(t, "www.home. 0 IN A 192.0.2.9")}) }, dns.RcodeNXRrset},
+		{"RRset has fewer values", func(t *testing.T, m *dns.Msg) {
+			m.Used([]dns.RR{mustRR(t, "www.home. 0 IN A 192.0.2.1"), mustRR(t, "www.home. 0 IN A 192.0.2.9")})
+		}, dns.RcodeNXRrset},
+		{"prerequisite with TTL", func(t *testing.T, m *dns.Msg) { m.Answer = append(m.Answer, mustRR(t, "www.home. 60 IN A 192.0.2.1")) }, dns.RcodeFormatError},
+		{"prerequisite out of zone", func(t *testing.T, m *dns.Msg) { m.NameUsed([]dns.RR{mustRR(t, "www.example.test. 0 IN A")}) }, dns.RcodeNotZone},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			updater := testUpdater(t, NewMemoryStore(), www)
+			m := new(dns.Msg)
+			m.SetUpdate("home.")
+			test.prereqs(t, m)
+			m.Insert([]dns.RR{mustRR(t, "new.home. 300 IN A 192.0.2.2")})
+
+			if rcode := updater.apply(m); rcode != test.rcode {
+				t.Fatalf("Got %s, want %s", dns.RcodeToString[rcode], dns.RcodeToString[test.rcode])
+			}
+			_, added := updater.local.Get("new.home.", dns.TypeA)
+			if added != (test.rcode == dns.RcodeSuccess) {
+				t.Errorf("new.home. stored: %t, want the update applied only when the prerequisites hold", added)
+			}
+		})
+	}
+}
+
+func TestUpdateZones(t *testing.T) {
+	tests := []struct {
+		name   string
+		zone   string
+		record string
+		rcode  int
+	}{
+		{"local domain", "home.", "new.home. 300 IN A 192.0.2.2", dns.RcodeSuccess},
+		{"reverse zone", "2.0.192.in-addr.arpa.", "2.2.0.192.in-addr.arpa. 300 IN PTR new.home.", dns.RcodeSuccess},
+		{"zone not served", "example.test.", "www.example.test. 300 IN A 192.0.2.2", dns.RcodeNotAuth},
+		{"record out of zone", "home.", "www.example.test. 300 IN A 192.0.2.2", dns.RcodeNotZone},
+		{"meta type", "home.", "new.home. 300 IN AXFR", dns.RcodeFormatError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			updater := testUpdater(t, NewMemoryStore())
+			m := new(dns.Msg)
+			m.SetUpdate(test.zone)
+			rr := mustRR(t, test.record)
+			m.Insert([]dns.RR{rr})
+			if rcode := updater.apply(m); rcode != test.rcode {
+				t.Errorf("Got %s, want %s", dns.RcodeToString[rcode], dns.RcodeToString[test.rcode])
+			}
+			if _, ok := updater.local.Get(rr.Header().Name, rr.Header().Rrtype); ok != (test.rcode == dns.RcodeSuccess) {
+				t.Errorf("%s stored: %t, want it stored only when the update succeeds", rr.Header().Name, ok)
+			}
+		})
+	}
+}
+
+func TestUpdateAtomic(t *testing.T) {
+	store := &failingStore{MemoryStore: NewMemoryStore(), failNames: map[string]bool{}}
+	updater := testUpdater(t, store, "www.home. 300 IN A 192.0.2.1", "old.home. 300 IN TXT \"old\"")
+
+	// The update moves www, deletes old and adds bad, whose write fails last
+	store.failNames["bad.home."] = true
+	m := new(dns.Msg)
+	m.SetUpdate("home.")
+	m.RemoveRRset([]dns.RR{mustRR(t, "www.home. 0 IN A")})
+	m.Insert([]dns.RR{mustRR(t, "www.home. 300 IN A 192.0.2.9")})
+	m.RemoveName([]dns.RR{mustRR(t, "old.home. 0 IN ANY")})
+	m.Insert([]dns.RR{mustRR(t, "bad.home. 300 IN A 192.0.2.3")})
+	if rcode := updater.apply(m); rcode != dns.RcodeServerFailure {
+		t.Fatalf("Got %s, want SERVFAIL", dns.RcodeToString[rcode])
+	}
+
+	// Nothing of it remains
+	msg, _ := updater.local.Get("www.home.", dns.TypeA)
+	if got := answerOf(msg); got != "www.home.\t300\tIN\tA\t192.0.2.1" {
+		t.Errorf("Got www.home. %q, want the address from before the update", got)
+	}
+	if _, ok := updater.local.Get("old.home.", dns.TypeTXT); !ok {
+		t.Errorf("old.home. was deleted by a failed update")
+	}
+
+	// Later records in the same update see the changes staged before them
+	store.failNames = map[string]bool{}
+	m = new(dns.Msg)
+	m.SetUpdate("home.")
+	m.Insert([]dns.RR{mustRR(t, "alias.home. 300 IN CNAME www.home.")})
+	m.Insert([]dns.RR{mustRR(t, "alias.home. 300 IN A 192.0.2.4")})
+	if rcode := updater.apply(m); rcode != dns.RcodeSuccess {
+		t.Fatalf("Got %s, want NOERROR", dns.RcodeToString[rcode])
+	}
+	if _, ok := updater.local.Get("alias.home.", dns.TypeA); ok {
+		t.Errorf("An address was added next to a CNAME added by the same update")
+	}
+}
+
+func TestUpdateAuthentication(t *testing.T) {
+	updater := testUpdater(t, NewMemoryStore())
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Cannot listen on loopback: %v", err)
+	}
+	server := &dns.Server{
+		PacketConn:    conn,
+		Handler:       dns.HandlerFunc(updater.ServeUpdate),
+		TsigSecret:    updater.keys.Secrets(),
+		MsgAcceptFunc: acceptMsg,
+	}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+
+	tests := []struct {
+		name   string
+		key    string
+		secret string
+		rcode  int
+	}{
+		{"unsigned", "", "", dns.RcodeRefused},
+		{"unknown key", "other.", testUpdateKey.Secret, dns.RcodeNotAuth},
+		{"bad signature", testUpdateKey.Name, "d3JvbmdzZWNyZXR3cm9uZ3NlY3JldA==", dns.RcodeNotAuth},
+		{"signed", testUpdateKey.Name, testUpdateKey.Secret, dns.RcodeSuccess},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := new(dns.Msg)
+			m.SetUpdate("home.")
+			m.Insert([]dns.RR{mustRR(t, "new.home. 300 IN A 192.0.2.2")})
+			client := new(dns.Client)
+			if test.key != "" {
+				m.SetTsig(test.key, dns.HmacSHA256, 300, time.Now().Unix())
+				client.TsigSecret = map[string]string{test.key: test.secret}
+			}
+			reply, _, err := client.Exchange(m, conn.LocalAddr().String())
+			if err != nil {
+				t.Fatalf("Exchange: %v", err)
+			}
+			if reply.Rcode != test.rcode {
+				t.Errorf("Got %s, want %s", dns.RcodeToString[reply.Rcode], dns.RcodeToString[test.rcode])
+			}
+			if _, ok := updater.local.Get("new.home.", dns.TypeA); ok != (test.rcode == dns.RcodeSuccess) {
+				t.Errorf("new.home. stored: %t, want it stored only by the signed update", ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Upstream selection policies
+const (
+	PolicySequential    = "sequential"
+	PolicyRoundRobin    = "round-robin"
+	PolicyLowestLatency = "lowest-latency"
+)
+
+// latencyWeight is the weight given to the newest sample in the latency moving average
+const latencyWeight = 0.3
+
+// Upstream is a single forwarding resolver together with its health and latency state
+type Upstream struct {
+	Addr string
+	// Pool names the pool the upstream belongs to, as the same address may serve in several
+	Pool string
+
+	healthy atomic.Bool
+	latency atomic.Int64 // moving average of successful exchanges, in nanoseconds
+}
+
+// Healthy reports whether the upstream answered its last exchange or probe
+func (u *Upstream) Healthy() bool {
+	return u.healthy.Load()
+}
+
+// Latency returns the moving average of the upstream's response time
+func (u *Upstream) Latency() time.Duration {
+	return time.Duration(u.latency.Load())
+}
+
+func (u *Upstream) observe(rtt time.Duration) {
+	prev := u.latency.Load()
+	if prev == 0 {
+		u.latency.Store(int64(rtt))
+		return
+	}
+	u.latency.Store(int64(latencyWeight*float64(rtt) + (1-latencyWeight)*float64(prev)))
+}
+
+func (u *Upstream) setHealthy(healthy bool) {
+	u.healthy.Store(healthy)
+	value := 0.0
+	if healthy {
+		value = 1
+	}
+	upstreamHealthy.WithLabelValues(u.Pool, u.Addr).Set(value)
+}
+
+// UpstreamPool forwards queries to a set of upstream resolvers, failing over between them
+type UpstreamPool struct {
+	upstreams []*Upstream
+	policy    string
+	client    *dns.Client
+	tcp       *dns.Client
+	next      atomic.Uint64
+}
+
+// NewUpstreamPool initializes and returns a new UpstreamPool called name for the given addresses.
+// Addresses without a port default to port 53.
+func NewUpstreamPool(name string, addrs []string, policy string, timeout time.Duration) (*UpstreamPool, error) {
+	switch policy {
+	case PolicySequential, PolicyRoundRobin, PolicyLowestLatency:
+	default:
+		return nil, fmt.Errorf("unknown upstream policy %q", policy)
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no upstream servers configured")
+	}
+
+	pool := &UpstreamPool{
+		policy: policy,
+		client: &dns.Client{Timeout: timeout},
+		tcp:    &dns.Client{Net: "tcp", Timeout: timeout},
+	}
+	for _, addr := range addrs {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "53")
+		}
+		upstream := &Upstream{Addr: addr, Pool: name}
+		upstream.setHealthy(true)
+		pool.upstreams = append(pool.upstreams, upstream)
+	}
+	if len(pool.upstreams) == 0 {
+		return nil, errors.New("no upstream servers configured")
+	}
+	return pool, nil
+}
+
+// Upstreams returns the upstreams in the pool in configuration order
+func (p *UpstreamPool) Upstreams() []*Upstream {
+	return p.upstreams
+}
+
+// Exchange sends r to the upstreams in the order chosen by the pool policy and returns the first usable answer.
+// Upstreams that time out or fail are marked unhealthy and the next one is tried. SERVFAIL and REFUSED answers
+// also cause a failover, but are returned if no other upstream does better.
+func (p *UpstreamPool) Exchange(r *dns.Msg) (*dns.Msg, error) {
+	var fallback *dns.Msg
+	var lastErr error
+	for _, upstream := range p.order() {
+		msg, err := p.exchange(upstream, r)
+		if err != nil {
+			log.Printf("Upstream %s failed: %v", upstream.Addr, err)
+			lastErr = err
+			continue
+		}
+		if msg.Rcode == dns.RcodeServerFailure || msg.Rcode == dns.RcodeRefused {
+			if fallback == nil {
+				fallback = msg
+			}
+			continue
+		}
+		return msg, nil
+	}
+	if fallback != nil {
+		return fallback, nil
+	}
+	return nil, fmt.Errorf("all upstreams failed: %w", lastErr)
+}
+
+func (p *UpstreamPool) exchange(upstream *Upstream, r *dns.Msg) (*dns.Msg, error) {
+	msg, rtt, err := p.client.Exchange(r, upstream.Addr)
+	if err == nil && msg.Truncated {
+		// Fetch the whole answer over TCP, it is cut down to size for each client later
+		msg, rtt, err = p.tcp.Exchange(r, upstream.Addr)
+	}
+	if err != nil {
+		upstreamErrors.WithLabelValues(upstream.Addr).Inc()
+		upstream.setHealthy(false)
+		return nil, err
+	}
+	upstreamLatency.WithLabelValues(upstream.Addr).Observe(rtt.Seconds())
+	upstream.observe(rtt)
+	upstream.setHealthy(true)
+	return msg, nil
+}
+
+// order returns the upstreams in the order they should be tried. Healthy upstreams
+// come first in policy order, followed by unhealthy ones as a last resort.
+func (p *UpstreamPool) order() []*Upstream {
+	ordered := make([]*Upstream, len(p.upstreams))
+	copy(ordered, p.upstreams)
+
+	switch p.policy {
+	case PolicyRoundRobin:
+		start := int(p.next.Add(1)-1) % len(ordered)
+		ordered = append(ordered[start:], ordered[:start]...)
+	case PolicyLowestLatency:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return ordered[i].Latency() < ordered[j].Latency()
+		})
+	}
+
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Healthy() && !ordered[j].Healthy()
+	})
+	return ordered
+}
+
+// RunHealthChecks actively probes every upstream at the given interval, so failed upstreams are
+// brought back into rotation once they recover and latency figures stay current
+func (p *UpstreamPool) RunHealthChecks(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, upstream := range p.upstreams {
+			go p.probe(upstream)
+		}
+	}
+}
+
+// probe asks the upstream for the root NS set; any answer other than SERVFAIL or REFUSED counts as healthy
+func (p *UpstreamPool) probe(upstream *Upstream) {
+	probe := new(dns.Msg)
+	probe.SetQuestion(".", dns.TypeNS)
+	msg, err := p.exchange(upstream, probe)
+	if err == nil && (msg.Rcode == dns.RcodeServerFailure || msg.Rcode == dns.RcodeRefused) {
+		err = fmt.Errorf("probe answered %s", dns.RcodeToString[msg.Rcode])
+		upstream.setHealthy(false)
+	}
+	if err != nil {
+		log.Printf("Health check for upstream %s failed: %v", upstream.Addr, err)
+	}
+}
+
+var (
+	upstreamLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "dns_upstream_request_duration_seconds",
+			Help:    "Latency of exchanges with upstream DNS servers",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+		},
+		[]string{"upstream"},
+	)
+	upstreamErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_upstream_errors_total",
+			Help: "Total number of failed exchanges with upstream DNS servers",
+		},
+		[]string{"upstream"},
+	)
+	upstreamHealthy = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dns_upstream_healthy",
+			Help: "Whether an upstream DNS server is considered healthy (1) or not (0) by a pool",
+		},
+		[]string{"pool", "upstream"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(upstreamLatency, upstreamErrors, upstreamHealthy)
+}
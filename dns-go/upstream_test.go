@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testUpstream is a fake upstream resolver on loopback answering with the rcode it is set to
+type testUpstream struct {
+	addr    string
+	rcode   atomic.Int32
+	queries atomic.Int32
+}
+
+// startUpstream starts a testUpstream answering NOERROR
+func startUpstream(t *testing.T) *testUpstream {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Cannot listen on loopback: %v", err)
+	}
+	upstream := &testUpstream{addr: conn.LocalAddr().String()}
+	server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		upstream.queries.Add(1)
+		msg := new(dns.Msg)
+		msg.SetRcode(r, int(upstream.rcode.Load()))
+		w.WriteMsg(msg)
+	})}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	return upstream
+}
+
+// deadUpstream returns the address of a loopback port nobody answers on
+func deadUpstream(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Cannot listen on loopback: %v", err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+	return addr
+}
+
+// testQuery returns a query for www.example.test. A
+func testQuery() *dns.Msg {
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.test.", dns.TypeA)
+	return query
+}
+
+// upstreamAddrs returns the addresses of upstreams in order
+func upstreamAddrs(upstreams []*Upstream) []string {
+	var addrs []string
+	for _, upstream := range upstreams {
+		addrs = append(addrs, upstream.Addr)
+	}
+	return addrs
+}
+
+func TestUpstreamFailover(t *testing.T) {
+	dead := deadUpstream(t)
+	failing, working := startUpstream(t), startUpstream(t)
+	failing.rcode.Store(dns.RcodeServerFailure)
+	pool, err := NewUpstreamPool("test-failover", []string{dead, failing.addr, working.addr}, PolicySequential, 500*time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewUpstreamPool: %v", err)
+	}
+
+	// The dead upstream fails and the SERVFAIL is passed over for the working upstream's answer
+	msg, err := pool.Exchange(testQuery())
+	if err != nil || msg.Rcode != dns.RcodeSuccess {
+		t.Fatalf("Got %v, %v, want the NOERROR answer of the last upstream", msg, err)
+	}
+	if failing.queries.Load() != 1 || working.queries.Load() != 1 {
+		t.Errorf("Got %d and %d queries at the failing and working upstreams, want 1 each", failing.queries.Load(), working.queries.Load())
+	}
+
+	// The dead upstream is marked unhealthy and tried last from now on
+	upstreams := pool.Upstreams()
+	if upstreams[0].Healthy() || !upstreams[1].Healthy() || !upstreams[2].Healthy() {
+		t.Errorf("Got health %t %t %t, want only the dead upstream unhealthy", upstreams[0].Healthy(), upstreams[1].Healthy(), upstreams[2].Healthy())
+	}
+	if order := upstreamAddrs(pool.order()); order[2] != dead {
+		t.Errorf("Got order %v, want the dead upstream last", order)
+	}
+	if value := testutil.ToFloat64(upstreamHealthy.WithLabelValues("test-failover", dead)); value != 0 {
+		t.Errorf("Got health gauge %v for the dead upstream, want 0", value)
+	}
+
+	// When no upstream does better, the SERVFAIL is the answer
+	working.rcode.Store(dns.RcodeRefused)
+	msg, err = pool.Exchange(testQuery())
+	if err != nil || msg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Got %v, %v, want the SERVFAIL of the failing upstream", msg, err)
+	}
+}
+
+func TestUpstreamAllFailed(t *testing.T) {
+	pool, err := NewUpstreamPool("test-all-failed", []string{deadUpstream(t), deadUpstream(t)}, PolicySequential, 500*time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewUpstreamPool: %v", err)
+	}
+	if msg, err := pool.Exchange(testQuery()); err == nil {
+		t.Errorf("Got %v from dead upstreams, want an error", msg)
+	}
+}
+
+func TestUpstreamOrder(t *testing.T) {
+	addrs := []string{"192.0.2.1:53", "192.0.2.2:53", "192.0.2.3:53"}
+
+	pool, _ := NewUpstreamPool("test-order", addrs, PolicyRoundRobin, time.Second)
+	for i := range 4 {
+		if first := pool.order()[0].Addr; first != addrs[i%3] {
+			t.Errorf("Round robin turn %d starts at %s, want %s", i, first, addrs[i%3])
+		}
+	}
+
+	pool, _ = NewUpstreamPool("test-order", addrs, PolicyLowestLatency, time.Second)
+	upstreams := pool.Upstreams()
+	upstreams[0].observe(30 * time.Millisecond)
+	upstreams[1].observe(10 * time.Millisecond)
+	upstreams[2].observe(20 * time.Millisecond)
+	want := []string{addrs[1], addrs[2], addrs[0]}
+	if order := upstreamAddrs(pool.order()); !slices.Equal(order, want) {
+		t.Errorf("Got lowest latency order %v, want %v", order, want)
+	}
+	// Unhealthy upstreams go last whatever their latency
+	upstreams[1].setHealthy(false)
+	want = []string{addrs[2], addrs[0], addrs[1]}
+	if order := upstreamAddrs(pool.order()); !slices.Equal(order, want) {
+		t.Errorf("Got order %v with the fastest upstream unhealthy, want %v", order, want)
+	}
+}
+
+func TestUpstreamHealthCheck(t *testing.T) {
+	upstream := startUpstream(t)
+	pool, err := NewUpstreamPool("test-health", []string{upstream.addr}, PolicySequential, 500*time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewUpstreamPool: %v", err)
+	}
+	health := func() (bool, float64) {
+		return pool.Upstreams()[0].Healthy(), testutil.ToFloat64(upstreamHealthy.WithLabelValues("test-health", upstream.addr))
+	}
+
+	// A probe answered with REFUSED marks the upstream unhealthy
+	upstream.rcode.Store(dns.RcodeRefused)
+	pool.probe(pool.Upstreams()[0])
+	if healthy, gauge := health(); healthy || gauge != 0 {
+		t.Errorf("Got healthy %t (gauge %v) after a refused probe, want unhealthy", healthy, gauge)
+	}
+
+	// It recovers with the first probe it answers again
+	upstream.rcode.Store(dns.RcodeSuccess)
+	pool.probe(pool.Upstreams()[0])
+	if healthy, gauge := health(); !healthy || gauge != 1 {
+		t.Errorf("Got healthy %t (gauge %v) after an answered probe, want healthy", healthy, gauge)
+	}
+	if pool.Upstreams()[0].Latency() <= 0 {
+		t.Error("The answered probe did not record a latency")
+	}
+}
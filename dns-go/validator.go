@@ -0,0 +1,483 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxKeyCacheTTL caps how long validated DNSKEY sets are trusted before being fetched again
+const maxKeyCacheTTL = time.Hour
+
+// rootTrustAnchors are the DS records of the root zone's key signing keys, as published by IANA
+const rootTrustAnchors = `
+. 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D
+. 172800 IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16
+`
+
+// errBogus marks answers that failed DNSSEC validation
+var errBogus = errors.New("bogus DNSSEC data")
+
+// Validator checks upstream answers against the DNSSEC chain of trust (RFC 4035 section 5).
+// Starting from the configured trust anchors it fetches and verifies the DS and DNSKEY records of
+// every zone on the way down, using the same upstreams answers are forwarded to.
+type Validator struct {
+	forwarder *Forwarder
+	anchors   map[string][]*dns.DS
+
+	mu    sync.Mutex
+	keys  map[string]*zoneKeys
+	zones map[string]*zoneOf // zones of the owners of unsigned RRsets, as found by findZone
+	now   func() time.Time
+}
+
+// zoneOf caches the zone a name lives in
+type zoneOf struct {
+	zone    string
+	expires time.Time
+}
+
+// zoneKeys is the validated outcome of following the chain of trust down to a zone
+type zoneKeys struct {
+	keys    []*dns.DNSKEY
+	secure  bool // false when the zone is provably unsigned or outside every trust anchor
+	expires time.Time
+}
+
+// NewValidator initializes and returns a new Validator that trusts anchors and queries through forwarder
+func NewValidator(forwarder *Forwarder, anchors []*dns.DS) *Validator {
+	v := &Validator{
+		forwarder: forwarder,
+		anchors:   make(map[string][]*dns.DS),
+		keys:      make(map[string]*zoneKeys),
+		zones:     make(map[string]*zoneOf),
+		now:       time.Now,
+	}
+	for _, ds := range anchors {
+		zone := dns.CanonicalName(ds.Hdr.Name)
+		v.anchors[zone] = append(v.anchors[zone], ds)
+	}
+	return v
+}
+
+// LoadTrustAnchors reads DS or DNSKEY records in master file format from path.
+// With an empty path the root zone's published trust anchors are returned.
+func LoadTrustAnchors(path string) ([]*dns.DS, error) {
+	data := rootTrustAnchors
+	if path != "" {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		data = string(raw)
+	}
+
+	var anchors []*dns.DS
+	parser := dns.NewZoneParser(strings.NewReader(data), ".", path)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		switch rr := rr.(type) {
+		case *dns.DS:
+			anchors = append(anchors, rr)
+		case *dns.DNSKEY:
+			anchors = append(anchors, rr.ToDS(dns.SHA256))
+		}
+	}
+	if err := parser.Err(); err != nil {
+		return nil, err
+	}
+	if len(anchors) == 0 {
+		return nil, fmt.Errorf("%s: no DS or DNSKEY records", path)
+	}
+	return anchors, nil
+}
+
+// Exchange forwards r with the DO and CD bits set so upstreams return DNSSEC records without validating
+// themselves, then validates the answer. Secure answers come back with AD set, bogus ones are replaced
+// by SERVFAIL unless the client set CD itself to get the data regardless.
+func (v *Validator) Exchange(r *dns.Msg) (*dns.Msg, error) {
+	query := r.Copy()
+	if opt := query.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		query.SetEdns0(dns.DefaultMsgSize, true)
+	}
+	query.CheckingDisabled = true
+
+	msg, err := v.forwarder.Exchange(query)
+	if err != nil {
+		return nil, err
+	}
+	msg.AuthenticatedData = false
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		return msg, nil
+	}
+
+	secure, err := v.Validate(msg)
+	switch {
+	case err != nil && r.CheckingDisabled:
+		log.Printf("Passing bogus answer for %s on to client with CD set: %v", r.Question[0].Name, err)
+	case err != nil:
+		log.Printf("DNSSEC validation failed for %s: %v", r.Question[0].Name, err)
+		failed := new(dns.Msg)
+		failed.SetRcode(r, dns.RcodeServerFailure)
+		return failed, nil
+	default:
+		msg.AuthenticatedData = secure
+	}
+	return msg, nil
+}
+
+// Validate checks every RRset in the answer and authority sections of msg and, for negative answers,
+// the proof of nonexistence. It reports whether the whole answer is secure; an error means it is bogus.
+func (v *Validator) Validate(msg *dns.Msg) (bool, error) {
+	if len(msg.Question) == 0 {
+		return false, nil
+	}
+	q := msg.Question[0]
+
+	secure := true
+	wildcards := make(map[string]int) // owners of answers expanded from wildcards -> labels of the wildcard
+	for i, section := range [][]dns.RR{msg.Answer, msg.Ns} {
+		for _, rrset := range groupRRsets(section) {
+			if rrset[0].Header().Rrtype == dns.TypeRRSIG {
+				continue
+			}
+			sigs := signaturesFor(section, rrset)
+			ok, err := v.verifyRRset(rrset, sigs)
+			if err != nil {
+				return false, err
+			}
+			secure = secure && ok
+			if labels, expanded := wildcardLabels(rrset, sigs); expanded && i == 0 {
+				wildcards[dns.CanonicalName(rrset[0].Header().Name)] = labels
+			}
+		}
+	}
+	if !secure {
+		return false, nil
+	}
+
+	// Answers expanded from a wildcard are only valid for names that do not exist themselves
+	for name, labels := range wildcards {
+		ok, err := checkWildcardAnswer(msg.Ns, name, labels)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+
+	// Follow CNAMEs to the name the negative answer is about
+	name := dns.CanonicalName(q.Name)
+	for _, rr := range msg.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok && dns.CanonicalName(cname.Hdr.Name) == name {
+			name = dns.CanonicalName(cname.Target)
+		}
+	}
+	nodata := msg.Rcode == dns.RcodeSuccess && !hasRRset(msg.Answer, name, q.Qtype)
+	if msg.Rcode == dns.RcodeNameError || nodata {
+		return checkDenial(msg.Ns, name, q.Qtype, msg.Rcode == dns.RcodeNameError)
+	}
+	return true, nil
+}
+
+// verifyRRset validates one RRset against its signatures. Unsigned RRsets are fine in unsigned zones
+// but bogus in signed ones.
+func (v *Validator) verifyRRset(rrset []dns.RR, sigs []*dns.RRSIG) (bool, error) {
+	owner := dns.CanonicalName(rrset[0].Header().Name)
+	rrType := dns.TypeToString[rrset[0].Header().Rrtype]
+
+	if len(sigs) == 0 {
+		if v.insecureAncestor(owner) {
+			return false, nil
+		}
+		zone, err := v.findZone(owner)
+		if err != nil {
+			return false, err
+		}
+		keys, err := v.keysFor(zone)
+		if err != nil {
+			return false, err
+		}
+		if keys.secure {
+			return false, fmt.Errorf("%w: %s %s is not signed", errBogus, owner, rrType)
+		}
+		return false, nil
+	}
+
+	var lastErr error
+	for _, sig := range sigs {
+		signer := dns.CanonicalName(sig.SignerName)
+		if !dns.IsSubDomain(signer, owner) {
+			lastErr = fmt.Errorf("%w: %s %s signed by unrelated zone %s", errBogus, owner, rrType, signer)
+			continue
+		}
+		keys, err := v.keysFor(signer)
+		if err != nil {
+			return false, err
+		}
+		if !keys.secure {
+			return false, nil
+		}
+		if err := v.verifyWith(keys.keys, rrset, sig); err != nil {
+			lastErr = err
+			continue
+		}
+		return true, nil
+	}
+	return false, lastErr
+}
+
+// verifyWith checks sig over rrset with the key among keys that made it
+func (v *Validator) verifyWith(keys []*dns.DNSKEY, rrset []dns.RR, sig *dns.RRSIG) error {
+	owner := rrset[0].Header().Name
+	rrType := dns.TypeToString[rrset[0].Header().Rrtype]
+	if !sig.ValidityPeriod(v.now()) {
+		return fmt.Errorf("%w: signature over %s %s is outside its validity period", errBogus, owner, rrType)
+	}
+	for _, key := range keys {
+		if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+			continue
+		}
+		if err := sig.Verify(key, rrset); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: no key of %s verifies the signature over %s %s", errBogus, sig.SignerName, owner, rrType)
+}
+
+// keysFor returns the validated DNSKEYs of zone, following the chain of trust down from the nearest
+// trust anchor. Zones below an unsigned delegation, or outside every trust anchor, are insecure.
+func (v *Validator) keysFor(zone string) (*zoneKeys, error) {
+	zone = dns.CanonicalName(zone)
+
+	v.mu.Lock()
+	cached, ok := v.keys[zone]
+	v.mu.Unlock()
+	if ok && v.now().Before(cached.expires) {
+		return cached, nil
+	}
+
+	keys, err := v.fetchKeys(zone)
+	if err != nil {
+		return nil, err
+	}
+	v.mu.Lock()
+	v.keys[zone] = keys
+	v.mu.Unlock()
+	return keys, nil
+}
+
+// fetchKeys does the work of keysFor for a zone that is not cached
+func (v *Validator) fetchKeys(zone string) (*zoneKeys, error) {
+	insecure := &zoneKeys{expires: v.now().Add(maxKeyCacheTTL)}
+
+	dsSet, anchored := v.anchors[zone]
+	if !anchored {
+		if zone == "." || !v.underAnchor(zone) {
+			return insecure, nil
+		}
+
+		response, err := v.query(zone, dns.TypeDS)
+		if err != nil {
+			return nil, err
+		}
+		var rrset []dns.RR
+		for _, rr := range response.Answer {
+			if ds, ok := rr.(*dns.DS); ok && dns.CanonicalName(ds.Hdr.Name) == zone {
+				rrset = append(rrset, ds)
+				dsSet = append(dsSet, ds)
+			}
+		}
+		if len(rrset) == 0 {
+			// No DS: the delegation must be provably unsigned, or the zone is bogus
+			return insecure, v.checkNoDS(zone, response)
+		}
+		for _, sig := range signaturesFor(response.Answer, rrset) {
+			if dns.CanonicalName(sig.SignerName) == zone {
+				return nil, fmt.Errorf("%w: DS of %s signed by the zone itself", errBogus, zone)
+			}
+		}
+		secure, err := v.verifyRRset(rrset, signaturesFor(response.Answer, rrset))
+		if err != nil || !secure {
+			return insecure, err
+		}
+	}
+
+	response, err := v.query(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	var rrset []dns.RR
+	var all, trusted []*dns.DNSKEY
+	for _, rr := range response.Answer {
+		key, ok := rr.(*dns.DNSKEY)
+		if !ok || dns.CanonicalName(key.Hdr.Name) != zone || key.Flags&dns.ZONE == 0 {
+			continue
+		}
+		rrset = append(rrset, key)
+		all = append(all, key)
+		for _, ds := range dsSet {
+			if digest := key.ToDS(ds.DigestType); digest != nil && strings.EqualFold(digest.Digest, ds.Digest) && digest.KeyTag == ds.KeyTag {
+				trusted = append(trusted, key)
+				break
+			}
+		}
+	}
+	if len(trusted) == 0 {
+		return nil, fmt.Errorf("%w: no DNSKEY of %s matches its DS records", errBogus, zone)
+	}
+
+	// The DNSKEY set has to be signed by a key the parent vouches for
+	var verifyErr error
+	for _, sig := range signaturesFor(response.Answer, rrset) {
+		if verifyErr = v.verifyWith(trusted, rrset, sig); verifyErr == nil {
+			ttl := min(time.Duration(rrset[0].Header().Ttl)*time.Second, maxKeyCacheTTL)
+			return &zoneKeys{keys: all, secure: true, expires: v.now().Add(ttl)}, nil
+		}
+	}
+	if verifyErr == nil {
+		verifyErr = fmt.Errorf("%w: DNSKEY set of %s is not signed", errBogus, zone)
+	}
+	return nil, verifyErr
+}
+
+// checkNoDS validates a negative answer to a DS query for zone, proving the delegation is unsigned
+func (v *Validator) checkNoDS(zone string, response *dns.Msg) error {
+	var parent string
+	for _, rr := range response.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			parent = dns.CanonicalName(soa.Hdr.Name)
+		}
+	}
+	if parent == "" || parent == zone || !dns.IsSubDomain(parent, zone) {
+		return fmt.Errorf("%w: cannot tell the parent of %s from the answer to its DS query", errBogus, zone)
+	}
+	keys, err := v.keysFor(parent)
+	if err != nil || !keys.secure {
+		return err
+	}
+	for _, rrset := range groupRRsets(response.Ns) {
+		if rrset[0].Header().Rrtype == dns.TypeRRSIG {
+			continue
+		}
+		sigs := signaturesFor(response.Ns, rrset)
+		if len(sigs) == 0 {
+			return fmt.Errorf("%w: denial of the DS of %s is not signed", errBogus, zone)
+		}
+		var verifyErr error
+		for _, sig := range sigs {
+			if verifyErr = v.verifyWith(keys.keys, rrset, sig); verifyErr == nil {
+				break
+			}
+		}
+		if verifyErr != nil {
+			return verifyErr
+		}
+	}
+	// An opt-out span proves the delegation unsigned as well, so only errors matter
+	_, err = checkDenial(response.Ns, zone, dns.TypeDS, response.Rcode == dns.RcodeNameError)
+	return err
+}
+
+// underAnchor reports whether a trust anchor covers zone
+func (v *Validator) underAnchor(zone string) bool {
+	for anchor := range v.anchors {
+		if dns.IsSubDomain(anchor, zone) {
+			return true
+		}
+	}
+	return false
+}
+
+// insecureAncestor reports whether name lies at or below a zone already known to be insecure, which
+// makes it insecure too unless a trust anchor lies in between
+func (v *Validator) insecureAncestor(name string) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	now := v.now()
+	for n := name; ; n = parentName(n) {
+		if _, anchored := v.anchors[n]; anchored {
+			return false
+		}
+		if keys, ok := v.keys[n]; ok && !keys.secure && now.Before(keys.expires) {
+			return true
+		}
+		if n == "." {
+			return false
+		}
+	}
+}
+
+// findZone returns the zone name lives in, as told by the SOA record in the answer to an SOA query.
+// Answers are cached for the TTL of the SOA record.
+func (v *Validator) findZone(name string) (string, error) {
+	v.mu.Lock()
+	cached, ok := v.zones[name]
+	v.mu.Unlock()
+	if ok && v.now().Before(cached.expires) {
+		return cached.zone, nil
+	}
+
+	response, err := v.query(name, dns.TypeSOA)
+	if err != nil {
+		return "", err
+	}
+	for _, rr := range append(response.Answer, response.Ns...) {
+		if soa, ok := rr.(*dns.SOA); ok && dns.IsSubDomain(soa.Hdr.Name, name) {
+			zone := dns.CanonicalName(soa.Hdr.Name)
+			ttl := min(time.Duration(soa.Hdr.Ttl)*time.Second, maxKeyCacheTTL)
+			v.mu.Lock()
+			if len(v.zones) > 10000 {
+				log.Printf("Validator zone cache full, clearing it")
+				clear(v.zones)
+			}
+			v.zones[name] = &zoneOf{zone: zone, expires: v.now().Add(ttl)}
+			v.mu.Unlock()
+			return zone, nil
+		}
+	}
+	return "", fmt.Errorf("cannot find the zone of %s", name)
+}
+
+// query asks the upstreams for name and qType with DNSSEC records but without upstream validation
+func (v *Validator) query(name string, qType uint16) (*dns.Msg, error) {
+	query := new(dns.Msg)
+	query.SetQuestion(name, qType)
+	query.SetEdns0(dns.DefaultMsgSize, true)
+	query.CheckingDisabled = true
+	response, err := v.forwarder.Exchange(query)
+	if err != nil {
+		return nil, err
+	}
+	if response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("%s %s: %s", name, dns.TypeToString[qType], dns.RcodeToString[response.Rcode])
+	}
+	return response, nil
+}
+
+// signaturesFor returns the RRSIGs in section that cover rrset
+func signaturesFor(section []dns.RR, rrset []dns.RR) []*dns.RRSIG {
+	hdr := rrset[0].Header()
+	var sigs []*dns.RRSIG
+	for _, rr := range section {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == hdr.Rrtype && strings.EqualFold(sig.Hdr.Name, hdr.Name) {
+			sigs = append(sigs, sig)
+		}
+	}
+	return sigs
+}
+
+// hasRRset reports whether section holds records of qType for name
+func hasRRset(section []dns.RR, name string, qType uint16) bool {
+	for _, rr := range section {
+		if hdr := rr.Header(); strings.EqualFold(hdr.Name, name) && (hdr.Rrtype == qType || qType == dns.TypeANY) {
+			return true
+		}
+	}
+	return false
+}
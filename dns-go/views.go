@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
+)
+
+// defaultViewName names the view serving clients that match no other view
+const defaultViewName = "default"
+
+// View is one horizon of a split-horizon setup: the local records, cache and forwarding policy
+// used to answer the clients whose addresses fall into its networks
+type View struct {
+	Name     string
+	Networks []*net.IPNet
+
+	Local     *LocalZone
+	Cache     *CacheStore
+	Forwarder *Forwarder
+	Validator *Validator
+	Updater   *Updater
+	// ECS is the policy for the EDNS Client Subnet option of queries forwarded upstream
+	ECS string
+
+	flight singleflight.Group // upstream exchanges in flight, by question
+}
+
+// Matches reports whether ip lies in one of the view's networks
+func (v *View) Matches(ip net.IP) bool {
+	for _, network := range v.Networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve answers r from upstream, through the validator when DNSSEC validation is enabled.
+// Identical questions already in flight share a single upstream exchange.
+func (v *View) Resolve(r *dns.Msg) (*dns.Msg, error) {
+	q := r.Question[0]
+	query := upstreamQuery(r, v.ECS)
+	// Answers differ with the CD bit and the client subnet, so they are part of the question
+	key := fmt.Sprintf("%s/%d/%d/%t", strings.ToLower(q.Name), q.Qtype, q.Qclass, r.CheckingDisabled)
+	if subnet := subnetOption(query); subnet != nil {
+		key += "/" + subnet.String()
+	}
+	result, err, shared := v.flight.Do(key, func() (any, error) {
+		if v.Validator != nil {
+			return v.Validator.Exchange(query)
+		}
+		return v.Forwarder.Exchange(query)
+	})
+	if err != nil {
+		return nil, err
+	}
+	msg := result.(*dns.Msg)
+	if shared {
+		upstreamCoalesced.Inc()
+		msg = msg.Copy()
+	}
+	return msg, nil
+}
+
+// prefetch resolves a popular cached name again before its answer expires. The answer is fetched
+// with DNSSEC records so it serves clients that set DO as well as those that do not.
+func (v *View) prefetch(domain string, qType uint16) {
+	query := new(dns.Msg)
+	query.SetQuestion(domain, qType)
+	query.SetEdns0(dns.DefaultMsgSize, true)
+	msg, err := v.Resolve(query)
+	if err != nil {
+		log.Printf("Failed to prefetch %s: %v", domain, err)
+		return
+	}
+	v.Cache.Set(domain, qType, msg)
+}
+
+// ViewSet selects the view answering a query. Views are tried in the order they were added and
+// the default view answers everyone else.
+type ViewSet struct {
+	Default *View
+	// ClientSubnet, if set, lists the forwarding resolvers in front of dns-go whose queries select
+	// views by their EDNS Client Subnet option (RFC 7871), passing on where their clients are
+	ClientSubnet *ACL
+
+	views []*View
+}
+
+// NewViewSet initializes and returns a new ViewSet with defaultView as its fallback, selecting
+// views by ECS for queries from clientSubnet if not nil
+func NewViewSet(defaultView *View, clientSubnet *ACL) *ViewSet {
+	return &ViewSet{Default: defaultView, ClientSubnet: clientSubnet}
+}
+
+// Add appends a view, which takes precedence over the default view and views added after it
+func (s *ViewSet) Add(view *View) {
+	s.views = append(s.views, view)
+}
+
+// Views returns every view, the default view last
+func (s *ViewSet) Views() []*View {
+	return append(append([]*View(nil), s.views...), s.Default)
+}
+
+// Get returns the view called name
+func (s *ViewSet) Get(name string) (*View, bool) {
+	for _, view := range s.Views() {
+		if view.Name == name {
+			return view, true
+		}
+	}
+	return nil, false
+}
+
+// Select returns the view for a query received through w
+func (s *ViewSet) Select(w dns.ResponseWriter, r *dns.Msg) *View {
+	ip := addrIP(w.RemoteAddr())
+	if s.ClientSubnet != nil && s.ClientSubnet.Allows(w, r) {
+		if subnet := clientSubnet(r); subnet != nil {
+			ip = subnet
+		}
+	}
+	for _, view := range s.views {
+		if view.Matches(ip) {
+			return view
+		}
+	}
+	return s.Default
+}
+
+// clientSubnet returns the address in the EDNS Client Subnet option of r, if any
+func clientSubnet(r *dns.Msg) net.IP {
+	if subnet := subnetOption(r); subnet != nil {
+		return subnet.Address
+	}
+	return nil
+}
+
+// ViewConfig describes a view in the config file
+type ViewConfig struct {
+	Name         string       `json:"name"`
+	Networks     []string     `json:"networks"`
+	Upstreams    []string     `json:"upstreams"`
+	ForwardZones ForwardZones `json:"forward_zones"`
+}
+
+// ViewFlags maps view names to their networks. It implements flag.Value so views can be given
+// as repeated -view flags of the form "vpn=10.8.0.0/16,10.9.0.0/16". Views given this way
+// forward like the default view.
+type ViewFlags []ViewConfig
+
+// String returns the views in flag syntax
+func (v *ViewFlags) String() string {
+	var views []string
+	for _, view := range *v {
+		views = append(views, view.Name+"="+strings.Join(view.Networks, ","))
+	}
+	return fmt.Sprint(views)
+}
+
+// Set parses a single "name=cidr[,cidr...]" view
+func (v *ViewFlags) Set(value string) error {
+	name, networks, ok := strings.Cut(value, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("view must be name=cidr[,cidr...], got %q", value)
+	}
+	*v = append(*v, ViewConfig{Name: name, Networks: splitList(networks)})
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testWriter is a dns.ResponseWriter for a client at a given address that keeps what is written
+type testWriter struct {
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *testWriter) LocalAddr() net.Addr         { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53} }
+func (w *testWriter) RemoteAddr() net.Addr        { return w.remote }
+func (w *testWriter) WriteMsg(msg *dns.Msg) error { w.msg = msg; return nil }
+func (w *testWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *testWriter) Close() error                { return nil }
+func (w *testWriter) TsigStatus() error           { return nil }
+func (w *testWriter) TsigTimersOnly(bool)         {}
+func (w *testWriter) Hijack()                     {}
+
+// writerFrom returns a testWriter for a UDP client at ip
+func writerFrom(ip string) *testWriter {
+	return &testWriter{remote: &net.UDPAddr{IP: net.ParseIP(ip), Port: 5353}}
+}
+
+func TestViewSelectClientSubnet(t *testing.T) {
+	_, office, _ := net.ParseCIDR("10.1.0.0/16")
+	views := NewViewSet(&View{Name: defaultViewName}, &ACL{Networks: []*net.IPNet{{IP: net.IPv4(192, 168, 0, 53), Mask: net.CIDRMask(32, 32)}}})
+	views.Add(&View{Name: "office", Networks: []*net.IPNet{office}})
+
+	// query returns a query carrying an ECS option for subnet, if not empty
+	query := func(subnet string) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion("www.example.test.", dns.TypeA)
+		if subnet != "" {
+			r.SetEdns0(1232, false)
+			r.IsEdns0().Option = append(r.IsEdns0().Option, &dns.EDNS0_SUBNET{
+				Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP(subnet),
+			})
+		}
+		return r
+	}
+
+	tests := []struct {
+		name, client, subnet, want string
+	}{
+		{"client address", "10.1.2.3", "", "office"},
+		{"ECS from a trusted forwarder", "192.168.0.53", "10.1.2.0", "office"},
+		{"trusted forwarder without ECS", "192.168.0.53", "", defaultViewName},
+		{"ECS from anyone else", "192.0.2.1", "10.1.2.0", defaultViewName},
+		{"ECS claiming to be elsewhere", "10.1.2.3", "192.0.2.0", "office"},
+	}
+	for _, test := range tests {
+		if view := views.Select(writerFrom(test.client), query(test.subnet)); view.Name != test.want {
+			t.Errorf("%s: got view %s, want %s", test.name, view.Name, test.want)
+		}
+	}
+
+	// Without trusted forwarders ECS is ignored altogether
+	views.ClientSubnet = nil
+	if view := views.Select(writerFrom("192.168.0.53"), query("10.1.2.0")); view.Name != defaultViewName {
+		t.Errorf("Got view %s from ECS with no trusted forwarders, want %s", view.Name, defaultViewName)
+	}
+}
+
+func TestViewResolveCoalesces(t *testing.T) {
+	// The upstream is slow enough for every question to arrive while the first is in flight
+	var queries atomic.Int32
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Cannot listen on loopback: %v", err)
+	}
+	server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		time.Sleep(200 * time.Millisecond)
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 192.0.2.1")
+		msg.Answer = []dns.RR{rr}
+		w.WriteMsg(msg)
+	})}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+
+	view := &View{Name: defaultViewName, Forwarder: NewForwarder(testPool(t, conn.LocalAddr().String()))}
+	coalesced := testutil.ToFloat64(upstreamCoalesced)
+
+	const clients = 5
+	var wg sync.WaitGroup
+	answers := make([]*dns.Msg, clients)
+	for i := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			query := testQuery()
+			if i == 0 {
+				// The question is the same whatever the case of the name
+				query.Question[0].Name = "WWW.example.test."
+			}
+			msg, err := view.Resolve(query)
+			if err != nil {
+				t.Errorf("Resolve: %v", err)
+			}
+			answers[i] = msg
+		}()
+	}
+	wg.Wait()
+
+	if n := queries.Load(); n != 1 {
+		t.Errorf("Upstream got %d queries, want 1", n)
+	}
+	// Every query answered by the shared exchange counts, the one that started it included
+	if got := testutil.ToFloat64(upstreamCoalesced) - coalesced; got != clients {
+		t.Errorf("Coalesced %v queries, want %d", got, clients)
+	}
+	for i, msg := range answers {
+		if msg == nil || len(msg.Answer) != 1 {
+			t.Errorf("Answer %d = %v", i, msg)
+		}
+	}
+	// Answers are copied so clients cannot change each other's
+	if len(answers[0].Answer) == 1 && answers[0] == answers[1] {
+		t.Error("Clients share a single answer message")
+	}
+
+	// Different questions are not coalesced
+	query := testQuery()
+	query.Question[0].Qtype = dns.TypeAAAA
+	if _, err := view.Resolve(query); err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if n := queries.Load(); n != 2 {
+		t.Errorf("Upstream got %d queries after a different question, want 2", n)
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/miekg/dns"
+)
+
+// Zone is an authoritative zone loaded from an RFC 1035 master file
+type Zone struct {
+	Origin string
+	SOA    *dns.SOA
+	NS     []dns.RR
+
+	file  string
+	nodes map[string][]dns.RR // canonical owner name -> records
+	names map[string]bool     // every name that exists: the owners and the empty non-terminals above them
+}
+
+// LoadZone parses the master file at path. Relative names resolve against origin unless
+// the file sets its own $ORIGIN, and records without a TTL use $TTL or the SOA minimum.
+func LoadZone(origin, path string) (*Zone, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	zone, err := ParseZone(origin, f, path)
+	if err != nil {
+		return nil, err
+	}
+	zone.file = path
+	return zone, nil
+}
+
+// ParseZone parses a zone in master file format from r. The file name is only used in error messages.
+func ParseZone(origin string, r io.Reader, file string) (*Zone, error) {
+	zone := NewZone(origin)
+	zp := dns.NewZoneParser(r, zone.Origin, file)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if err := zone.Add(rr); err != nil {
+			log.Printf("Ignoring record in %s: %v", file, err)
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if zone.SOA == nil {
+		return nil, fmt.Errorf("zone %s has no SOA record at its apex", zone.Origin)
+	}
+	if len(zone.NS) == 0 {
+		return nil, fmt.Errorf("zone %s has no NS records at its apex", zone.Origin)
+	}
+	return zone, nil
+}
+
+// NewZone initializes and returns an empty zone for origin
+func NewZone(origin string) *Zone {
+	return &Zone{Origin: dns.CanonicalName(origin), nodes: make(map[string][]dns.RR), names: make(map[string]bool)}
+}
+
+// Add inserts a record into the zone, keeping the apex SOA and NS sets up to date
+func (z *Zone) Add(rr dns.RR) error {
+	hdr := rr.Header()
+	hdr.Name = dns.CanonicalName(hdr.Name)
+	if !dns.IsSubDomain(z.Origin, hdr.Name) {
+		return fmt.Errorf("%s is outside of zone %s", hdr.Name, z.Origin)
+	}
+	if hdr.Name == z.Origin {
+		switch rr := rr.(type) {
+		case *dns.SOA:
+			if z.SOA != nil {
+				return errors.New("duplicate SOA record")
+			}
+			z.SOA = rr
+		case *dns.NS:
+			z.NS = append(z.NS, rr)
+		case *dns.CNAME:
+			// The apex owns the SOA and NS records, which a CNAME cannot coexist with (RFC 1034 section 3.6.2)
+			return errors.New("CNAME record at the zone apex")
+		}
+	}
+	z.nodes[hdr.Name] = append(z.nodes[hdr.Name], rr)
+	for name := hdr.Name; !z.names[name]; name = parentName(name) {
+		z.names[name] = true
+		if name == z.Origin {
+			break
+		}
+	}
+	return nil
+}
+
+// Records returns every record in the zone
+func (z *Zone) Records() []dns.RR {
+	var records []dns.RR
+	for _, rrs := range z.nodes {
+		records = append(records, rrs...)
+	}
+	return records
+}
+
+// Lookup answers a query for name and qType from the zone data, following RFC 1034 section 4.3.2:
+// names below a delegation get a referral, existing names get their RRset (or CNAME), names that do
+// not exist get the records of a matching wildcard, and missing data gets an authoritative NXDOMAIN
+// or NODATA with the SOA in the authority section.
+func (z *Zone) Lookup(name string, qType uint16) *dns.Msg {
+	name = dns.CanonicalName(name)
+	msg := new(dns.Msg)
+
+	if cut := z.delegation(name, qType); cut != "" {
+		msg.Ns = z.rrset(cut, dns.TypeNS)
+		msg.Extra = z.glue(msg.Ns)
+		return msg
+	}
+
+	msg.Authoritative = true
+	if dname := z.dname(name); dname != nil {
+		// Names below a DNAME are redirected to the same names below its target (RFC 6672 section 3.2)
+		target := dnameTarget(dname, name)
+		if _, ok := dns.IsDomainName(target); !ok {
+			msg.Rcode = dns.RcodeYXDomain
+			msg.Answer = []dns.RR{dname}
+			return msg
+		}
+		msg.Answer = []dns.RR{dname, &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dname.Hdr.Class, Ttl: dname.Hdr.Ttl},
+			Target: target,
+		}}
+		return msg
+	}
+
+	// owner is the node answering, a wildcard standing in for a name that does not exist
+	owner := name
+	node, exists := z.nodes[name]
+	if !z.exists(name) {
+		if wildcard := z.wildcard(name); wildcard != "" {
+			owner, node, exists = wildcard, z.nodes[wildcard], true
+		}
+	}
+	switch {
+	case !exists && z.exists(name):
+		// Empty non-terminal, the name exists but owns no data
+		msg.Ns = []dns.RR{z.negativeSOA()}
+	case !exists:
+		msg.Rcode = dns.RcodeNameError
+		msg.Ns = []dns.RR{z.negativeSOA()}
+	case qType == dns.TypeANY:
+		msg.Answer = copyRRs(node)
+	default:
+		msg.Answer = z.rrset(owner, qType)
+		if len(msg.Answer) == 0 && qType != dns.TypeCNAME {
+			msg.Answer = z.rrset(owner, dns.TypeCNAME)
+		}
+		if len(msg.Answer) == 0 {
+			msg.Ns = []dns.RR{z.negativeSOA()}
+			break
+		}
+		msg.Ns = copyRRs(z.NS)
+		msg.Extra = z.glue(append(msg.Answer, msg.Ns...))
+	}
+	if owner != name {
+		// Records synthesized from a wildcard are owned by the name asked for (RFC 4592 section 3.3.1)
+		for _, rr := range msg.Answer {
+			rr.Header().Name = name
+		}
+	}
+	return msg
+}
+
+// wildcard returns the wildcard that answers for name, which does not exist: the one at the
+// closest encloser, the deepest ancestor of name that does exist (RFC 4592 section 3.3.1)
+func (z *Zone) wildcard(name string) string {
+	labels := dns.Split(name)
+	for i := 1; i < len(labels); i++ {
+		encloser := name[labels[i]:]
+		if !dns.IsSubDomain(z.Origin, encloser) {
+			break
+		}
+		if !z.exists(encloser) {
+			continue
+		}
+		if _, exists := z.nodes["*."+encloser]; exists {
+			return "*." + encloser
+		}
+		return ""
+	}
+	return ""
+}
+
+// delegation returns the zone cut at or above name that the query falls under, if any.
+// DS queries for the cut itself are answered by the parent, so they are not referred.
+func (z *Zone) delegation(name string, qType uint16) string {
+	labels := dns.Split(name)
+	for i := len(labels) - 1; i >= 0; i-- {
+		owner := name[labels[i]:]
+		if owner == z.Origin || !dns.IsSubDomain(z.Origin, owner) {
+			continue
+		}
+		if owner == name && qType == dns.TypeDS {
+			return ""
+		}
+		if len(z.rrset(owner, dns.TypeNS)) > 0 {
+			return owner
+		}
+	}
+	return ""
+}
+
+// dname returns the DNAME owned by the closest ancestor of name in the zone, if any
+func (z *Zone) dname(name string) *dns.DNAME {
+	labels := dns.Split(name)
+	for i := len(labels) - 1; i > 0; i-- {
+		owner := name[labels[i]:]
+		if !dns.IsSubDomain(z.Origin, owner) {
+			continue
+		}
+		if rrs := z.rrset(owner, dns.TypeDNAME); len(rrs) > 0 {
+			return rrs[0].(*dns.DNAME)
+		}
+	}
+	return nil
+}
+
+// dnameTarget returns the name dname substitutes for name, or "" when name does not lie below its owner
+func dnameTarget(dname *dns.DNAME, name string) string {
+	owner, name := dns.CanonicalName(dname.Hdr.Name), dns.CanonicalName(name)
+	if name == owner || !dns.IsSubDomain(owner, name) {
+		return ""
+	}
+	labels := dns.SplitDomainName(name)
+	prefix := strings.Join(labels[:len(labels)-dns.CountLabel(owner)], ".") + "."
+	if target := dns.CanonicalName(dname.Target); target != "." {
+		return prefix + target
+	}
+	return prefix
+}
+
+// exists reports whether name exists in the zone, owning records or as an empty non-terminal
+func (z *Zone) exists(name string) bool {
+	return z.names[name]
+}
+
+// rrset returns copies of the records of the given type owned by name, so callers may modify them freely
+func (z *Zone) rrset(name string, rrType uint16) []dns.RR {
+	var rrs []dns.RR
+	for _, rr := range z.nodes[name] {
+		if rr.Header().Rrtype == rrType {
+			rrs = append(rrs, dns.Copy(rr))
+		}
+	}
+	return rrs
+}
+
+// copyRRs returns deep copies of rrs
+func copyRRs(rrs []dns.RR) []dns.RR {
+	out := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		out[i] = dns.Copy(rr)
+	}
+	return out
+}
+
+// glue returns the in-zone A and AAAA records for the targets of NS, MX and SRV records
+func (z *Zone) glue(rrs []dns.RR) []dns.RR {
+	var extra []dns.RR
+	seen := make(map[string]bool)
+	for _, rr := range rrs {
+		var target string
+		switch rr := rr.(type) {
+		case *dns.NS:
+			target = rr.Ns
+		case *dns.MX:
+			target = rr.Mx
+		case *dns.SRV:
+			target = rr.Target
+		default:
+			continue
+		}
+		target = dns.CanonicalName(target)
+		if seen[target] {
+			continue
+		}
+		seen[target] = true
+		extra = append(extra, z.rrset(target, dns.TypeA)...)
+		extra = append(extra, z.rrset(target, dns.TypeAAAA)...)
+	}
+	return extra
+}
+
+// negativeSOA returns the SOA for negative answers, with its TTL lowered to the
+// negative caching TTL as RFC 2308 section 3 requires
+func (z *Zone) negativeSOA() dns.RR {
+	soa := dns.Copy(z.SOA).(*dns.SOA)
+	soa.Hdr.Ttl = min(soa.Hdr.Ttl, soa.Minttl)
+	return soa
+}
+
+// ZoneSet holds the authoritative zones served by dns-go, keyed by origin
+type ZoneSet struct {
+	// OnChange, if set, is called with the origin of every zone that is added or whose serial changes
+	OnChange func(origin string)
+
+	mu    sync.RWMutex
+	zones map[string]*Zone
+}
+
+// NewZoneSet initializes and returns an empty ZoneSet
+func NewZoneSet() *ZoneSet {
+	return &ZoneSet{zones: make(map[string]*Zone)}
+}
+
+// LoadFile loads the master file at path as the zone for origin, replacing any previous version
+func (s *ZoneSet) LoadFile(origin, path string) error {
+	zone, err := LoadZone(origin, path)
+	if err != nil {
+		return err
+	}
+	s.Put(zone)
+	log.Printf("Loaded zone %s from %s (serial %d)", zone.Origin, path, zone.SOA.Serial)
+	return nil
+}
+
+// Put adds or replaces a zone
+func (s *ZoneSet) Put(zone *Zone) {
+	s.mu.Lock()
+	previous, existed := s.zones[zone.Origin]
+	s.zones[zone.Origin] = zone
+	s.mu.Unlock()
+
+	if s.OnChange != nil && (!existed || previous.SOA.Serial != zone.SOA.Serial) {
+		s.OnChange(zone.Origin)
+	}
+}
+
+// Remove stops serving the zone with the given origin
+func (s *ZoneSet) Remove(origin string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.zones, dns.CanonicalName(origin))
+}
+
+// Get returns the zone with exactly the given origin
+func (s *ZoneSet) Get(origin string) (*Zone, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	zone, ok := s.zones[dns.CanonicalName(origin)]
+	return zone, ok
+}
+
+// Find returns the most specific zone containing name, or nil if dns-go is not authoritative for it
+func (s *ZoneSet) Find(name string) *Zone {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	name = dns.CanonicalName(name)
+	for _, offset := range dns.Split(name) {
+		if zone, ok := s.zones[name[offset:]]; ok {
+			return zone
+		}
+	}
+	return s.zones["."]
+}
+
+// Zones returns every zone in the set
+func (s *ZoneSet) Zones() []*Zone {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	zones := make([]*Zone, 0, len(s.zones))
+	for _, zone := range s.zones {
+		zones = append(zones, zone)
+	}
+	return zones
+}
+
+// Reload re-reads every zone that was loaded from a file. A zone that fails to
+// parse keeps serving its previous contents.
+func (s *ZoneSet) Reload() {
+	for _, zone := range s.Zones() {
+		if zone.file == "" {
+			continue
+		}
+		if err := s.LoadFile(zone.Origin, zone.file); err != nil {
+			log.Printf("Failed to reload zone %s, keeping previous version: %v", zone.Origin, err)
+		}
+	}
+}
+
+// ReloadOnSIGHUP reloads all zone files whenever the process receives SIGHUP
+func (s *ZoneSet) ReloadOnSIGHUP() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		log.Println("Received SIGHUP, reloading zones")
+		s.Reload()
+	}
+}
+
+// ZoneFiles maps zone origins to master files. It implements flag.Value so zones can be
+// given as repeated -zone flags of the form "lab.example.=/etc/dns-go/lab.example.zone".
+type ZoneFiles map[string]string
+
+// String returns the zones in flag syntax
+func (z ZoneFiles) String() string {
+	return fmt.Sprint(map[string]string(z))
+}
+
+// Set parses a single "origin=path" zone
+func (z ZoneFiles) Set(value string) error {
+	origin, path, ok := strings.Cut(value, "=")
+	if !ok || path == "" {
+		return fmt.Errorf("zone %q must have the form origin=path", value)
+	}
+	if _, valid := dns.IsDomainName(origin); !valid || origin == "" {
+		return fmt.Errorf("invalid zone origin %q", origin)
+	}
+	z[dns.Fqdn(origin)] = path
+	return nil
+}
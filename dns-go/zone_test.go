@@ -0,0 +1,210 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// zoneTestFile is a master file for example.test. with relative names, a delegation with glue,
+// a wildcard, an empty non-terminal, a DNAME and a CNAME at the apex that must be ignored
+const zoneTestFile = `$TTL 3600
+@        IN SOA ns hostmaster 1 3600 600 86400 60
+@        IN NS  ns
+@        IN MX  10 mail
+@        IN CNAME elsewhere.test.
+ns       IN A   192.0.2.1
+mail     300 IN A 192.0.2.2
+www      IN CNAME mail
+*.apps   IN A   192.0.2.3
+x.deep   IN TXT "deep"
+child    IN NS  ns.child
+child    IN NS  ns.elsewhere.test.
+ns.child IN A   192.0.2.4
+old      IN DNAME new.test.
+outside.test. IN A 192.0.2.5
+`
+
+// loadTestZone writes zoneTestFile to a file and loads it
+func loadTestZone(t *testing.T) *Zone {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "example.test.zone")
+	if err := os.WriteFile(path, []byte(zoneTestFile), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	zone, err := LoadZone("example.test.", path)
+	if err != nil {
+		t.Fatalf("LoadZone: %v", err)
+	}
+	return zone
+}
+
+// rrStrings returns the records in presentation format, sorted
+func rrStrings(rrs []dns.RR) []string {
+	var out []string
+	for _, rr := range rrs {
+		out = append(out, strings.ReplaceAll(rr.String(), "\t", " "))
+	}
+	slices.Sort(out)
+	return out
+}
+
+func TestLoadZone(t *testing.T) {
+	zone := loadTestZone(t)
+	if zone.SOA == nil || zone.SOA.Ns != "ns.example.test." || zone.SOA.Hdr.Ttl != 3600 {
+		t.Errorf("Got SOA %v, want ns.example.test. with the $TTL", zone.SOA)
+	}
+	if len(zone.NS) != 1 {
+		t.Errorf("Got apex NS %v, want one record", zone.NS)
+	}
+	// Records outside the zone and the CNAME at the apex are left out
+	if got := len(zone.Records()); got != 12 {
+		t.Errorf("Got %d records: %v, want 12", got, rrStrings(zone.Records()))
+	}
+	if rrs := zone.rrset("example.test.", dns.TypeCNAME); len(rrs) != 0 {
+		t.Errorf("Got %v at the apex, want no CNAME", rrs)
+	}
+	if rrs := zone.rrset("mail.example.test.", dns.TypeA); len(rrs) != 1 || rrs[0].Header().Ttl != 300 {
+		t.Errorf("Got %v, want mail.example.test. with its own TTL", rrs)
+	}
+
+	for name, content := range map[string]string{
+		"no SOA": "$ORIGIN example.test.\n@ 3600 IN NS ns\n",
+		"no NS":  "$ORIGIN example.test.\n@ 3600 IN SOA ns hostmaster 1 3600 600 86400 60\n",
+		"syntax": "$ORIGIN example.test.\n@ 3600 IN SOA ns hostmaster 1 3600\n",
+	} {
+		if _, err := ParseZone("example.test.", strings.NewReader(content), name); err == nil {
+			t.Errorf("%s: ParseZone succeeded, want an error", name)
+		}
+	}
+}
+
+func TestZoneLookup(t *testing.T) {
+	zone := loadTestZone(t)
+	apexNS := "example.test. 3600 IN NS ns.example.test."
+	negativeSOA := "example.test. 60 IN SOA ns.example.test. hostmaster.example.test. 1 3600 600 86400 60"
+
+	tests := []struct {
+		name          string
+		qname         string
+		qType         uint16
+		rcode         int
+		authoritative bool
+		answer        []string
+		ns            []string
+		extra         []string
+	}{
+		{
+			name: "answer", qname: "ns.example.test.", qType: dns.TypeA, authoritative: true,
+			answer: []string{"ns.example.test. 3600 IN A 192.0.2.1"},
+			ns:     []string{apexNS},
+			extra:  []string{"ns.example.test. 3600 IN A 192.0.2.1"},
+		},
+		{
+			name: "answer in other case", qname: "NS.Example.TEST.", qType: dns.TypeA, authoritative: true,
+			answer: []string{"ns.example.test. 3600 IN A 192.0.2.1"},
+			ns:     []string{apexNS},
+			extra:  []string{"ns.example.test. 3600 IN A 192.0.2.1"},
+		},
+		{
+			name: "MX with glue", qname: "example.test.", qType: dns.TypeMX, authoritative: true,
+			answer: []string{"example.test. 3600 IN MX 10 mail.example.test."},
+			ns:     []string{apexNS},
+			extra:  []string{"mail.example.test. 300 IN A 192.0.2.2", "ns.example.test. 3600 IN A 192.0.2.1"},
+		},
+		{
+			name: "apex without a CNAME", qname: "example.test.", qType: dns.TypeA, authoritative: true,
+			ns: []string{negativeSOA},
+		},
+		{
+			name: "CNAME", qname: "www.example.test.", qType: dns.TypeA, authoritative: true,
+			answer: []string{"www.example.test. 3600 IN CNAME mail.example.test."},
+			ns:     []string{apexNS},
+			extra:  []string{"ns.example.test. 3600 IN A 192.0.2.1"},
+		},
+		{
+			name: "referral with glue", qname: "www.child.example.test.", qType: dns.TypeA,
+			ns:    []string{"child.example.test. 3600 IN NS ns.child.example.test.", "child.example.test. 3600 IN NS ns.elsewhere.test."},
+			extra: []string{"ns.child.example.test. 3600 IN A 192.0.2.4"},
+		},
+		{
+			name: "referral at the cut", qname: "child.example.test.", qType: dns.TypeNS,
+			ns:    []string{"child.example.test. 3600 IN NS ns.child.example.test.", "child.example.test. 3600 IN NS ns.elsewhere.test."},
+			extra: []string{"ns.child.example.test. 3600 IN A 192.0.2.4"},
+		},
+		{
+			name: "DS at the cut", qname: "child.example.test.", qType: dns.TypeDS, authoritative: true,
+			ns: []string{negativeSOA},
+		},
+		{
+			name: "wildcard", qname: "a.apps.example.test.", qType: dns.TypeA, authoritative: true,
+			answer: []string{"a.apps.example.test. 3600 IN A 192.0.2.3"},
+			ns:     []string{apexNS},
+			extra:  []string{"ns.example.test. 3600 IN A 192.0.2.1"},
+		},
+		{
+			name: "empty non-terminal", qname: "deep.example.test.", qType: dns.TypeA, authoritative: true,
+			ns: []string{negativeSOA},
+		},
+		{
+			name: "wildcard does not answer for empty non-terminal", qname: "apps.example.test.", qType: dns.TypeA, authoritative: true,
+			ns: []string{negativeSOA},
+		},
+		{
+			name: "NODATA", qname: "ns.example.test.", qType: dns.TypeAAAA, authoritative: true,
+			ns: []string{negativeSOA},
+		},
+		{
+			name: "NXDOMAIN", qname: "nope.example.test.", qType: dns.TypeA, rcode: dns.RcodeNameError, authoritative: true,
+			ns: []string{negativeSOA},
+		},
+		{
+			name: "NXDOMAIN below empty non-terminal", qname: "y.deep.example.test.", qType: dns.TypeA, rcode: dns.RcodeNameError, authoritative: true,
+			ns: []string{negativeSOA},
+		},
+		{
+			name: "DNAME", qname: "www.old.example.test.", qType: dns.TypeA, authoritative: true,
+			answer: []string{"old.example.test. 3600 IN DNAME new.test.", "www.old.example.test. 3600 IN CNAME www.new.test."},
+		},
+	}
+
+	for _, test := range tests {
+		msg := zone.Lookup(test.qname, test.qType)
+		if msg.Rcode != test.rcode || msg.Authoritative != test.authoritative {
+			t.Errorf("%s: got %s (authoritative %t), want %s (authoritative %t)", test.name,
+				dns.RcodeToString[msg.Rcode], msg.Authoritative, dns.RcodeToString[test.rcode], test.authoritative)
+		}
+		for _, section := range []struct {
+			name      string
+			got, want []string
+		}{{"answer", rrStrings(msg.Answer), test.answer}, {"authority", rrStrings(msg.Ns), test.ns}, {"additional", rrStrings(msg.Extra), test.extra}} {
+			slices.Sort(section.want)
+			if !slices.Equal(section.got, section.want) {
+				t.Errorf("%s: got %s section %q, want %q", test.name, section.name, section.got, section.want)
+			}
+		}
+	}
+}
+
+func TestZoneNames(t *testing.T) {
+	zone := loadTestZone(t)
+	for name, exists := range map[string]bool{
+		"example.test.":          true,
+		"x.deep.example.test.":   true,
+		"deep.example.test.":     true, // empty non-terminal
+		"apps.example.test.":     true, // empty non-terminal above the wildcard
+		"ns.child.example.test.": true,
+		"nope.example.test.":     false,
+		"y.deep.example.test.":   false,
+		"a.apps.example.test.":   false,
+		"test.":                  false,
+	} {
+		if zone.exists(name) != exists {
+			t.Errorf("%s exists: %t, want %t", name, !exists, exists)
+		}
+	}
+}